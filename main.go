@@ -1,22 +1,51 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog/v2"
 
 	semaphoreProvider "github.com/semaphoreci/k8s-metrics-apiserver/pkg/provider"
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/semaphore"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
 	basecmd "sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
 )
 
 type SemaphoreAdapter struct {
 	basecmd.AdapterBase
 	Message string
+
+	// Client-side rate limit for requests to each Semaphore endpoint host.
+	APIRateLimit float64
+	APIBurst     int
+
+	CollectAgentDetails bool
+	EWMAWindows         []time.Duration
+	RateWindow          time.Duration
+	MaxWindows          []time.Duration
+	HistoryFile         string
+	QueueThresholds     []int
+	ForecastHorizon     time.Duration
+	ForecastSeasonality bool
+	ActivationGrace     time.Duration
+	AggregateBy         []string
+	DisabledMetrics     []string
+	DerivedMetrics      string
+	DeniedNamespaces    string
+	AgentTypeNames      bool
+	SemaphorePrefix     string
+	SourcesFile         string
+	ListMetrics         bool
+
+	Tracing tracing.Config
 }
 
 func (a *SemaphoreAdapter) makeProviderOrDie() *semaphoreProvider.SemaphoreMetricsProvider {
@@ -30,12 +59,29 @@ func (a *SemaphoreAdapter) makeProviderOrDie() *semaphoreProvider.SemaphoreMetri
 		klog.Fatalf("unable to construct discovery REST mapper: %v", err)
 	}
 
-	provider, err := semaphoreProvider.New(semaphoreProvider.Config{
-		Client:          client,
-		Mapper:          mapper,
-		SemaphoreClient: semaphore.NewClient(http.DefaultClient, false),
-	})
+	semaphoreClient := semaphore.NewClient(http.DefaultClient, false).
+		WithRateLimiter(semaphore.NewRateLimiter(a.APIRateLimit, a.APIBurst))
+
+	config := a.providerConfig()
+	config.Client = client
+	config.Mapper = mapper
+	config.SemaphoreClient = semaphoreClient
+	config.DerivedMetricsConfigMap = a.DerivedMetrics
+	config.DeniedNamespaceResponse = a.DeniedNamespaces
+	if a.SourcesFile != "" {
+		sources, err := semaphoreProvider.LoadSources(a.SourcesFile, http.DefaultClient)
+		if err != nil {
+			klog.Fatalf("unable to load metrics sources: %v", err)
+		}
+
+		config.Sources = sources
+	}
+
+	if a.HistoryFile != "" {
+		config.HistoryStore = semaphoreProvider.NewFileHistoryStore(a.HistoryFile)
+	}
 
+	provider, err := semaphoreProvider.New(config)
 	if err != nil {
 		klog.Fatalf("unable to construct Semaphore provider: %v", err)
 	}
@@ -43,6 +89,34 @@ func (a *SemaphoreAdapter) makeProviderOrDie() *semaphoreProvider.SemaphoreMetri
 	return provider
 }
 
+// The provider configuration that comes from flags only.
+func (a *SemaphoreAdapter) providerConfig() semaphoreProvider.Config {
+	return semaphoreProvider.Config{
+		CollectAgentDetails:     a.CollectAgentDetails,
+		EWMAWindows:             a.EWMAWindows,
+		RateWindow:              a.RateWindow,
+		MaxWindows:              a.MaxWindows,
+		QueueDurationThresholds: a.QueueThresholds,
+		ForecastHorizon:         a.ForecastHorizon,
+		ForecastSeasonality:     a.ForecastSeasonality,
+		ActivationGracePeriod:   &a.ActivationGrace,
+		AggregateBy:             a.AggregateBy,
+		DisabledMetrics:         a.DisabledMetrics,
+		AgentTypeMetricNames:    a.AgentTypeNames,
+		SemaphoreMetricPrefix:   a.SemaphorePrefix,
+	}
+}
+
+// Prints the metrics exposed with the current flags, as a Markdown table.
+func (a *SemaphoreAdapter) listMetrics() {
+	registry, err := semaphoreProvider.NewRegistry(a.providerConfig())
+	if err != nil {
+		klog.Fatalf("unable to list metrics: %v", err)
+	}
+
+	fmt.Print(registry.Markdown())
+}
+
 func main() {
 	logs.InitLogs()
 	defer logs.FlushLogs()
@@ -50,6 +124,28 @@ func main() {
 	// initialize the flags, with one custom flag for the message
 	cmd := &SemaphoreAdapter{}
 	cmd.Flags().StringVar(&cmd.Message, "msg", "starting semaphore metrics adapter...", "startup message")
+	cmd.Flags().Float64Var(&cmd.APIRateLimit, "semaphore-api-rate-limit", 5, "maximum requests per second to each Semaphore endpoint host; 0 disables rate limiting")
+	cmd.Flags().IntVar(&cmd.APIBurst, "semaphore-api-burst", 10, "maximum burst of requests to each Semaphore endpoint host")
+	cmd.Flags().BoolVar(&cmd.CollectAgentDetails, "collect-agent-details", false, "list the agents for each agent type, and expose metrics about them")
+	cmd.Flags().DurationSliceVar(&cmd.EWMAWindows, "ewma-windows", []time.Duration{time.Minute, 5 * time.Minute}, "windows for the moving averages exposed alongside the raw values, e.g. jobs_queued_avg_5m")
+	cmd.Flags().DurationVar(&cmd.RateWindow, "rate-window", semaphoreProvider.DefaultRateWindow, "trailing window used to calculate rates of change, e.g. jobs_queued_rate_per_minute")
+	cmd.Flags().DurationSliceVar(&cmd.MaxWindows, "max-windows", []time.Duration{10 * time.Minute, 15 * time.Minute}, "trailing windows for the peak values exposed alongside the raw values, e.g. agents_occupied_max_10m")
+	cmd.Flags().IntSliceVar(&cmd.QueueThresholds, "queue-duration-thresholds", []int{}, "queued job counts, in addition to 0, for which to track how long the queue has been above them, in jobs_queued_duration_seconds")
+	cmd.Flags().DurationVar(&cmd.ForecastHorizon, "forecast-horizon", semaphoreProvider.DefaultForecastHorizon, "how far ahead jobs_total is forecast, e.g. jobs_total_forecast_5m")
+	cmd.Flags().BoolVar(&cmd.ForecastSeasonality, "forecast-seasonality", false, "learn a time-of-day profile of the number of jobs, and use it in the forecast")
+	cmd.Flags().DurationVar(&cmd.ActivationGrace, "activation-grace-period", semaphoreProvider.DefaultActivationGracePeriod, "how long the activation metric stays at 1 after the last queued or running job; 0 turns the grace period off")
+	cmd.Flags().StringSliceVar(&cmd.AggregateBy, "aggregate-by", []string{}, "labels on the agent type secrets to aggregate agent types by, e.g. pool, or \"all\" to aggregate all agent types together")
+	cmd.Flags().StringSliceVar(&cmd.DisabledMetrics, "disable-metrics", []string{}, "comma-separated names of metrics not to expose")
+	cmd.Flags().BoolVar(&cmd.AgentTypeNames, "agent-type-metric-names", false, "also expose the metrics for each agent type with the agent type in the name, e.g. semaphore-s1-a-jobs_queued, for consumers that cannot use label selectors")
+	cmd.Flags().StringVar(&cmd.SemaphorePrefix, "semaphore-metric-prefix", "", "prefix for the names of the Semaphore metrics, e.g. semaphore_ for semaphore_jobs_queued")
+	cmd.Flags().StringVar(&cmd.SourcesFile, "metrics-sources-file", "", "YAML file with other sources to collect metrics from, exposed alongside the Semaphore metrics")
+	cmd.Flags().BoolVar(&cmd.ListMetrics, "list-metrics", false, "print the metrics exposed with the given flags, as a Markdown table, and exit")
+	cmd.Flags().StringVar(&cmd.DerivedMetrics, "derived-metrics-configmap", "", "name of the ConfigMap, in the adapter namespace, with the derived metric definitions; reloaded when it changes")
+	cmd.Flags().StringVar(&cmd.DeniedNamespaces, "denied-namespace-response", semaphoreProvider.DeniedNamespaceEmpty, "what reads from namespaces where the agent type metrics are not visible get back: \"empty\" or \"forbidden\"")
+	cmd.Flags().StringVar(&cmd.HistoryFile, "history-file", "", "file where the sample history is persisted, so the trailing windows survive restarts; kept only in memory if empty")
+	cmd.Flags().StringVar(&cmd.Tracing.Endpoint, "otlp-endpoint", "", "OTLP gRPC endpoint to export traces to, e.g. localhost:4317; tracing is disabled if empty")
+	cmd.Flags().BoolVar(&cmd.Tracing.Insecure, "otlp-insecure", false, "do not use TLS when exporting traces")
+	cmd.Flags().Float64Var(&cmd.Tracing.SamplingRatio, "trace-sampling-ratio", 0.1, "fraction of traces to sample, between 0 and 1")
 
 	// make sure you get the klog flags
 	logs.AddFlags(cmd.Flags())
@@ -57,13 +153,51 @@ func main() {
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 	cmd.Flags().Parse(os.Args)
 
+	if cmd.ListMetrics {
+		cmd.listMetrics()
+		return
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cmd.Tracing)
+	if err != nil {
+		klog.Fatalf("unable to set up tracing: %v", err)
+	}
+
 	provider := cmd.makeProviderOrDie()
 	cmd.WithExternalMetrics(provider)
+	cmd.WithCustomMetrics(provider)
 	klog.Infof(cmd.Message)
 
 	go provider.Collect()
 
-	if err := cmd.Run(wait.NeverStop); err != nil {
+	// The spans still buffered are exported before exiting,
+	// both when the adapter is stopped and when it fails.
+	err = cmd.Run(stopOnSignal())
+	flushTraces(shutdownTracing)
+	if err != nil {
 		klog.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
 }
+
+// Returns a channel closed when the process is asked to stop.
+func stopOnSignal() <-chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		klog.Infof("Stopping semaphore metrics adapter...")
+		close(stop)
+	}()
+
+	return stop
+}
+
+func flushTraces(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := shutdown(ctx); err != nil {
+		klog.Errorf("Error flushing traces: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"sort"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const (
+	MetricAgentsByVersion       = "agents_by_version"
+	MetricAgentsByPlatform      = "agents_by_platform"
+	MetricAgentsByConnectionAge = "agents_by_connection_age"
+	MetricAgentsWithoutPod      = "agents_without_pod"
+)
+
+// Metrics generated from the agents listing,
+// only exposed if collecting agent details is enabled.
+var AgentDetailMetrics = []MetricDefinition{
+	{
+		Name:        MetricAgentsByVersion,
+		Description: "Agents per agent version.",
+		Unit:        "agents",
+		Labels:      []string{"version"},
+	},
+	{
+		Name:        MetricAgentsByPlatform,
+		Description: "Agents per operating system and architecture.",
+		Unit:        "agents",
+		Labels:      []string{"os", "arch"},
+	},
+	{
+		Name:        MetricAgentsByConnectionAge,
+		Description: "Agents per connection age bucket: `lt_5m`, `5m_1h`, `1h_24h` or `gte_24h`.",
+		Unit:        "agents",
+		Labels:      []string{"age"},
+	},
+	{
+		Name:        MetricAgentsWithoutPod,
+		Description: "Agents whose hostname does not match any pod in the namespace.",
+		Unit:        "agents",
+	},
+}
+
+// Agent is a single agent registered for an agent type in Semaphore.
+type Agent struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	OS          string    `json:"os"`
+	Arch        string    `json:"arch"`
+	Hostname    string    `json:"hostname"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Buckets used for the agents_by_connection_age metric.
+var connectionAgeBuckets = []struct {
+	label string
+	upTo  time.Duration
+}{
+	{label: "lt_5m", upTo: 5 * time.Minute},
+	{label: "5m_1h", upTo: time.Hour},
+	{label: "1h_24h", upTo: 24 * time.Hour},
+}
+
+const connectionAgeBucketOver24h = "gte_24h"
+
+func connectionAgeBucket(age time.Duration) string {
+	for _, bucket := range connectionAgeBuckets {
+		if age < bucket.upTo {
+			return bucket.label
+		}
+	}
+
+	return connectionAgeBucketOver24h
+}
+
+type AgentDetails struct {
+	Agents []Agent
+
+	// Names of the pods that currently exist for the agent type.
+	// An agent whose hostname is not one of them is registered
+	// in Semaphore, but its pod is gone. If nil, the pods are not known,
+	// and agents_without_pod is not generated.
+	Pods map[string]bool
+}
+
+func (d *AgentDetails) GenerateAll(labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	byVersion := map[string]int{}
+	byPlatform := map[[2]string]int{}
+	byConnectionAge := map[string]int{}
+	withoutPod := 0
+
+	for _, agent := range d.Agents {
+		byVersion[agent.Version]++
+		byPlatform[[2]string{agent.OS, agent.Arch}]++
+		byConnectionAge[connectionAgeBucket(now.Sub(agent.ConnectedAt))]++
+		if !d.Pods[agent.Hostname] {
+			withoutPod++
+		}
+	}
+
+	for _, version := range sortedKeys(byVersion) {
+		values = append(values, newValue(MetricAgentsByVersion, byVersion[version], now, WithLabels(labels, "version", version)))
+	}
+
+	platforms := [][2]string{}
+	for platform := range byPlatform {
+		platforms = append(platforms, platform)
+	}
+
+	sort.Slice(platforms, func(i, j int) bool {
+		return platforms[i][0]+"/"+platforms[i][1] < platforms[j][0]+"/"+platforms[j][1]
+	})
+
+	for _, platform := range platforms {
+		values = append(values, newValue(MetricAgentsByPlatform, byPlatform[platform], now, WithLabels(labels, "os", platform[0], "arch", platform[1])))
+	}
+
+	// All buckets are always reported, so a bucket going to zero is visible.
+	for _, bucket := range connectionAgeBuckets {
+		values = append(values, newValue(MetricAgentsByConnectionAge, byConnectionAge[bucket.label], now, WithLabels(labels, "age", bucket.label)))
+	}
+
+	values = append(values, newValue(MetricAgentsByConnectionAge, byConnectionAge[connectionAgeBucketOver24h], now, WithLabels(labels, "age", connectionAgeBucketOver24h)))
+	if d.Pods != nil {
+		values = append(values, newValue(MetricAgentsWithoutPod, withoutPod, now, labels))
+	}
+
+	return values
+}
+
+func newValue(metricName string, value int, now time.Time, labels map[string]string) external_metrics.ExternalMetricValue {
+	return external_metrics.ExternalMetricValue{
+		MetricName:   metricName,
+		Timestamp:    v1.NewTime(now),
+		Value:        NewQuantity(float64(value)),
+		MetricLabels: labels,
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Copies the labels, adding the key-value pairs given.
+func WithLabels(labels map[string]string, keysAndValues ...string) map[string]string {
+	l := map[string]string{}
+	for k, v := range labels {
+		l[k] = v
+	}
+
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		l[keysAndValues[i]] = keysAndValues[i+1]
+	}
+
+	return l
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__AgentDetails(t *testing.T) {
+	now := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	details := AgentDetails{
+		Agents: []Agent{
+			{Name: "a", Version: "v2.2.0", OS: "linux", Arch: "amd64", Hostname: "pod-a", ConnectedAt: now.Add(-time.Minute)},
+			{Name: "b", Version: "v2.2.0", OS: "linux", Arch: "arm64", Hostname: "pod-b", ConnectedAt: now.Add(-2 * time.Hour)},
+			{Name: "c", Version: "v2.1.0", OS: "linux", Arch: "amd64", Hostname: "pod-c", ConnectedAt: now.Add(-48 * time.Hour)},
+		},
+		Pods: map[string]bool{"pod-a": true, "pod-b": true, "pod-other": true},
+	}
+
+	values := details.GenerateAll(map[string]string{"agent_type": "s1-test"}, now)
+
+	type value struct {
+		name   string
+		labels map[string]string
+		value  int64
+	}
+
+	got := []value{}
+	for _, v := range values {
+		got = append(got, value{name: v.MetricName, labels: v.MetricLabels, value: v.Value.Value()})
+	}
+
+	assert.Equal(t, []value{
+		{name: MetricAgentsByVersion, labels: map[string]string{"agent_type": "s1-test", "version": "v2.1.0"}, value: 1},
+		{name: MetricAgentsByVersion, labels: map[string]string{"agent_type": "s1-test", "version": "v2.2.0"}, value: 2},
+		{name: MetricAgentsByPlatform, labels: map[string]string{"agent_type": "s1-test", "os": "linux", "arch": "amd64"}, value: 2},
+		{name: MetricAgentsByPlatform, labels: map[string]string{"agent_type": "s1-test", "os": "linux", "arch": "arm64"}, value: 1},
+		{name: MetricAgentsByConnectionAge, labels: map[string]string{"agent_type": "s1-test", "age": "lt_5m"}, value: 1},
+		{name: MetricAgentsByConnectionAge, labels: map[string]string{"agent_type": "s1-test", "age": "5m_1h"}, value: 0},
+		{name: MetricAgentsByConnectionAge, labels: map[string]string{"agent_type": "s1-test", "age": "1h_24h"}, value: 1},
+		{name: MetricAgentsByConnectionAge, labels: map[string]string{"agent_type": "s1-test", "age": "gte_24h"}, value: 1},
+		{name: MetricAgentsWithoutPod, labels: map[string]string{"agent_type": "s1-test"}, value: 1},
+	}, got)
+}
+
+func Test__AgentDetailsWithoutPods(t *testing.T) {
+	now := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	details := AgentDetails{
+		Agents: []Agent{{Name: "a", Version: "v2.2.0", Hostname: "pod-a", ConnectedAt: now}},
+	}
+
+	names := map[string]bool{}
+	for _, v := range details.GenerateAll(map[string]string{"agent_type": "s1-test"}, now) {
+		names[v.MetricName] = true
+	}
+
+	assert.True(t, names[MetricAgentsByVersion])
+	assert.True(t, names[MetricAgentsByConnectionAge])
+	assert.False(t, names[MetricAgentsWithoutPod])
+}
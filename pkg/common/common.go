@@ -2,7 +2,7 @@ package common
 
 import (
 	"fmt"
-	"strconv"
+	"math"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -15,40 +15,118 @@ const (
 	MetricAgentsIdle               = "agents_idle"
 	MetricAgentsOccupied           = "agents_occupied"
 	MetricAgentsOccupiedPercentage = "agents_occupied_percentage"
+	MetricAgentsOccupiedRatio      = "agents_occupied_ratio"
 	MetricJobsTotal                = "jobs_total"
 	MetricJobsQueued               = "jobs_queued"
 	MetricJobsRunning              = "jobs_running"
+	MetricJobsQueuedPerIdleAgent   = "jobs_queued_per_idle_agent"
+	MetricJobsDemandCapacityRatio  = "jobs_demand_capacity_ratio"
 )
 
 type AgentType struct {
 	Name     string
 	Endpoint string
 	Token    string
+
+	// Hint for which version of the Semaphore API response to expect.
+	// If empty, the default version is used.
+	APIVersion string
+
+	// How to authenticate requests to the Semaphore API.
+	Auth AuthConfig
+
+	DesiredAgents DesiredAgentsConfig
+
+	// Minimum number of agents to keep at certain times, also applied to desired_agents.
+	Schedules Schedules
+
+	// Labels on the agent type secret, used to group agent types together, e.g. pool=arm64.
+	SecretLabels map[string]string
+
+	// Namespaces where the metrics for the agent type can be read, or "*" for all of them.
+	Namespaces []string
 }
 
-var AllMetrics = []string{
-	MetricAgentsTotal,
-	MetricAgentsIdle,
-	MetricAgentsOccupied,
-	MetricAgentsOccupiedPercentage,
-	MetricJobsTotal,
-	MetricJobsQueued,
-	MetricJobsRunning,
+// AllNamespaces allows the metrics for an agent type to be read from any namespace.
+const AllNamespaces = "*"
+
+// VisibleIn tells whether the metrics for the agent type can be read from a namespace.
+func (a *AgentType) VisibleIn(namespace string) bool {
+	for _, n := range a.Namespaces {
+		if n == AllNamespaces || n == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Labels identifying the metrics for the agent type.
+func (a *AgentType) Labels() map[string]string {
+	return map[string]string{"agent_type": a.Name}
+}
+
+const (
+	AuthSchemeToken  = "token"
+	AuthSchemeBearer = "bearer"
+	AuthSchemeOAuth2 = "oauth2"
+	AuthSchemeMTLS   = "mtls"
+)
+
+// AuthConfig holds everything needed to authenticate with the Semaphore API.
+// Which fields are used depends on the scheme. Scopes are kept
+// as a space-separated string, so the config can be used as a map key.
+type AuthConfig struct {
+	Scheme string
+
+	// For the oauth2 scheme
+	ClientID     string
+	ClientSecret string
+	TokenURL     string
+	Scopes       string
+
+	// For the mtls scheme, PEM-encoded
+	ClientCert string
+	ClientKey  string
+	CACert     string
 }
 
 type Metrics struct {
-	Jobs   JobMetrics
-	Agents AgentMetrics
+	Jobs   JobMetrics   `json:"jobs"`
+	Agents AgentMetrics `json:"agents"`
+}
+
+// GenerateForAgentType generates all the values for an agent type,
+// including the ones depending on the agent type configuration,
+// with the schedules active at the time of the sample.
+func GenerateForAgentType(agentType *AgentType, m *Metrics, now time.Time) []external_metrics.ExternalMetricValue {
+	labels := agentType.Labels()
+	values := m.GenerateAll(labels)
+
+	scheduledMin := agentType.Schedules.MinAgents(now)
+	values = append(values, external_metrics.ExternalMetricValue{
+		MetricName:   MetricScheduledMinAgents,
+		Timestamp:    v1.NewTime(now),
+		Value:        NewQuantity(float64(scheduledMin)),
+		MetricLabels: labels,
+	})
+
+	if agentType.DesiredAgents.Invalid {
+		return values
+	}
+
+	desiredAgents := agentType.DesiredAgents.WithFloor(scheduledMin)
+	return append(values, desiredAgents.Generate(m, labels, now))
 }
 
 func (m *Metrics) GenerateAll(labels map[string]string) []external_metrics.ExternalMetricValue {
 	values := []external_metrics.ExternalMetricValue{}
 
-	for _, metricName := range AllMetrics {
+	for _, definition := range BaseMetrics {
 		values = append(values, external_metrics.ExternalMetricValue{
-			MetricName:   metricName,
+			MetricName:   definition.Name,
 			Timestamp:    v1.NewTime(time.Now()),
-			Value:        resource.MustParse(m.Calc(metricName)),
+			Value:        NewQuantity(definition.Value(m)),
 			MetricLabels: labels,
 		})
 	}
@@ -56,25 +134,29 @@ func (m *Metrics) GenerateAll(labels map[string]string) []external_metrics.Exter
 	return values
 }
 
-func (m *Metrics) Calc(metricName string) string {
-	switch metricName {
-	case MetricAgentsTotal:
-		return strconv.Itoa(m.Agents.Total())
-	case MetricAgentsIdle:
-		return strconv.Itoa(m.Agents.Idle)
-	case MetricAgentsOccupied:
-		return strconv.Itoa(m.Agents.Occupied)
-	case MetricAgentsOccupiedPercentage:
-		return strconv.Itoa(m.Agents.OccupiedPercentage())
-	case MetricJobsTotal:
-		return strconv.Itoa(m.Jobs.Total())
-	case MetricJobsQueued:
-		return strconv.Itoa(m.Jobs.Queued)
-	case MetricJobsRunning:
-		return strconv.Itoa(m.Jobs.Running)
-	default:
-		return ""
+// Calc returns the value of a base metric. Other metrics are 0.
+func (m *Metrics) Calc(metricName string) float64 {
+	if definition, ok := baseMetricsIndex[metricName]; ok {
+		return definition.Value(m)
 	}
+
+	return 0
+}
+
+// NewQuantity converts a metric value into a quantity with milli-unit precision,
+// so fractional values like ratios are not rounded to integers.
+func NewQuantity(value float64) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI)
+}
+
+// Divides n by d, treating a zero d as 1. For example, with no idle agents,
+// every queued job counts fully towards the number of queued jobs per idle agent.
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return float64(n)
+	}
+
+	return float64(n) / float64(d)
 }
 
 func (m *Metrics) String() string {
@@ -88,8 +170,8 @@ func (m *Metrics) String() string {
 }
 
 type JobMetrics struct {
-	Queued  int
-	Running int
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
 }
 
 func (m *JobMetrics) Total() int {
@@ -97,17 +179,21 @@ func (m *JobMetrics) Total() int {
 }
 
 type AgentMetrics struct {
-	Idle     int
-	Occupied int
+	Idle     int `json:"idle"`
+	Occupied int `json:"occupied"`
 }
 
 func (m *AgentMetrics) Total() int {
 	return m.Idle + m.Occupied
 }
 
-func (m *AgentMetrics) OccupiedPercentage() int {
+func (m *AgentMetrics) OccupiedPercentage() float64 {
+	return 100 * m.OccupiedRatio()
+}
+
+func (m *AgentMetrics) OccupiedRatio() float64 {
 	if m.Total() > 0 {
-		return 100 * (m.Occupied / m.Total())
+		return float64(m.Occupied) / float64(m.Total())
 	}
 
 	// TODO: not sure we should return 0 here
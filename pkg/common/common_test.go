@@ -0,0 +1,47 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__Metrics(t *testing.T) {
+	t.Run("utilization is fractional", func(t *testing.T) {
+		m := Metrics{
+			Agents: AgentMetrics{Idle: 1, Occupied: 3},
+			Jobs:   JobMetrics{Queued: 3, Running: 3},
+		}
+
+		assert.Equal(t, 75.0, m.Calc(MetricAgentsOccupiedPercentage))
+		assert.Equal(t, 0.75, m.Calc(MetricAgentsOccupiedRatio))
+		assert.Equal(t, 3.0, m.Calc(MetricJobsQueuedPerIdleAgent))
+		assert.Equal(t, 1.5, m.Calc(MetricJobsDemandCapacityRatio))
+	})
+
+	t.Run("no agents", func(t *testing.T) {
+		m := Metrics{Jobs: JobMetrics{Queued: 2}}
+
+		assert.Equal(t, 0.0, m.Calc(MetricAgentsOccupiedPercentage))
+		assert.Equal(t, 0.0, m.Calc(MetricAgentsOccupiedRatio))
+		assert.Equal(t, 2.0, m.Calc(MetricJobsQueuedPerIdleAgent))
+		assert.Equal(t, 2.0, m.Calc(MetricJobsDemandCapacityRatio))
+	})
+
+	t.Run("values are generated with milli precision", func(t *testing.T) {
+		m := Metrics{Agents: AgentMetrics{Idle: 2, Occupied: 1}}
+
+		values := map[string]string{}
+		for _, v := range m.GenerateAll(map[string]string{}) {
+			values[v.MetricName] = v.Value.String()
+		}
+
+		assert.Equal(t, "3", values[MetricAgentsTotal])
+		assert.Equal(t, "33333m", values[MetricAgentsOccupiedPercentage])
+		assert.Equal(t, "333m", values[MetricAgentsOccupiedRatio])
+		assert.Equal(t, "0", values[MetricJobsQueuedPerIdleAgent])
+
+		q := NewQuantity(0.3335)
+		assert.Equal(t, int64(334), q.MilliValue())
+	})
+}
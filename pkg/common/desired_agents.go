@@ -0,0 +1,85 @@
+package common
+
+import (
+	"math"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const MetricDesiredAgents = "desired_agents"
+
+// Metrics that depend on the agent type configuration, and not only on the Semaphore metrics.
+var AgentTypeMetrics = []MetricDefinition{
+	{
+		Name:        MetricDesiredAgents,
+		Description: "Running jobs, plus queued jobs, plus headroom, clamped between a minimum and a maximum.",
+		Unit:        "agents",
+	},
+	{
+		Name:        MetricScheduledMinAgents,
+		Description: "Minimum number of agents required by the schedules active now. `0` if none are.",
+		Unit:        "agents",
+	},
+}
+
+// DesiredAgentsConfig controls how the desired_agents metric is calculated for an agent type.
+// The desired number of agents is the number of running and queued jobs, plus some headroom,
+// clamped between Min and Max.
+type DesiredAgentsConfig struct {
+	// Fixed number of extra agents.
+	HeadroomCount int
+
+	// Extra agents, as a percentage of the running and queued jobs.
+	// Used instead of HeadroomCount, if set.
+	HeadroomPercent float64
+
+	Min int
+
+	// Zero means no maximum.
+	Max int
+
+	// The maximum could not be parsed, so desired_agents is not generated,
+	// instead of being generated without it.
+	Invalid bool
+}
+
+func (c *DesiredAgentsConfig) Calc(m *Metrics) float64 {
+	demand := m.Jobs.Total()
+
+	headroom := c.HeadroomCount
+	if c.HeadroomPercent > 0 {
+		headroom = int(math.Ceil(float64(demand) * c.HeadroomPercent / 100))
+	}
+
+	desired := demand + headroom
+	if desired < c.Min {
+		desired = c.Min
+	}
+
+	if c.Max > 0 && desired > c.Max {
+		desired = c.Max
+	}
+
+	return float64(desired)
+}
+
+// WithFloor returns a copy of the config, with a minimum at least as high as the floor given.
+// The maximum still applies, even if it is lower than the floor.
+func (c DesiredAgentsConfig) WithFloor(floor int) DesiredAgentsConfig {
+	if floor > c.Min {
+		c.Min = floor
+	}
+
+	return c
+}
+
+func (c *DesiredAgentsConfig) Generate(m *Metrics, labels map[string]string, now time.Time) external_metrics.ExternalMetricValue {
+	return external_metrics.ExternalMetricValue{
+		MetricName:   MetricDesiredAgents,
+		Timestamp:    v1.NewTime(now),
+		Value:        NewQuantity(c.Calc(m)),
+		MetricLabels: labels,
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__DesiredAgents(t *testing.T) {
+	m := &Metrics{Jobs: JobMetrics{Running: 7, Queued: 3}}
+
+	t.Run("no headroom", func(t *testing.T) {
+		c := DesiredAgentsConfig{}
+		assert.Equal(t, 10.0, c.Calc(m))
+	})
+
+	t.Run("fixed headroom", func(t *testing.T) {
+		c := DesiredAgentsConfig{HeadroomCount: 2}
+		assert.Equal(t, 12.0, c.Calc(m))
+	})
+
+	t.Run("percentage headroom is rounded up", func(t *testing.T) {
+		c := DesiredAgentsConfig{HeadroomPercent: 25}
+		assert.Equal(t, 13.0, c.Calc(m))
+	})
+
+	t.Run("clamped to min", func(t *testing.T) {
+		c := DesiredAgentsConfig{HeadroomCount: 1, Min: 5}
+		assert.Equal(t, 5.0, c.Calc(&Metrics{}))
+	})
+
+	t.Run("clamped to max", func(t *testing.T) {
+		c := DesiredAgentsConfig{HeadroomCount: 5, Max: 12}
+		assert.Equal(t, 12.0, c.Calc(m))
+	})
+
+	t.Run("floor raises min", func(t *testing.T) {
+		c := DesiredAgentsConfig{Min: 5}
+		raised := c.WithFloor(20)
+		assert.Equal(t, 20.0, raised.Calc(m))
+		notRaised := c.WithFloor(2)
+		assert.Equal(t, 10.0, notRaised.Calc(m))
+		assert.Equal(t, 5, c.Min)
+	})
+
+	t.Run("max still applies with a floor", func(t *testing.T) {
+		c := DesiredAgentsConfig{Max: 15}
+		clamped := c.WithFloor(20)
+		assert.Equal(t, 15.0, clamped.Calc(m))
+	})
+
+	t.Run("invalid config -> not generated", func(t *testing.T) {
+		names := func(agentType *AgentType) []string {
+			names := []string{}
+			for _, v := range GenerateForAgentType(agentType, m, time.Now()) {
+				names = append(names, v.MetricName)
+			}
+
+			return names
+		}
+
+		assert.Contains(t, names(&AgentType{Name: "s1-a"}), MetricDesiredAgents)
+
+		invalid := &AgentType{Name: "s1-a", DesiredAgents: DesiredAgentsConfig{HeadroomCount: 2, Invalid: true}}
+		assert.NotContains(t, names(invalid), MetricDesiredAgents)
+		assert.Contains(t, names(invalid), MetricScheduledMinAgents)
+	})
+
+	t.Run("schedules apply at the time of the sample", func(t *testing.T) {
+		schedules, err := ParseSchedules("mon-fri 08:00-18:00 UTC min=20")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		agentType := &AgentType{Name: "s1-a", Schedules: schedules}
+		values := func(now time.Time) map[string]float64 {
+			values := map[string]float64{}
+			for _, v := range GenerateForAgentType(agentType, m, now) {
+				values[v.MetricName] = v.Value.AsApproximateFloat64()
+			}
+
+			return values
+		}
+
+		monday := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+		before := values(monday.Add(18*time.Hour - time.Second))
+		assert.Equal(t, 20.0, before[MetricScheduledMinAgents])
+		assert.Equal(t, 20.0, before[MetricDesiredAgents])
+
+		after := values(monday.Add(18 * time.Hour))
+		assert.Equal(t, 0.0, after[MetricScheduledMinAgents])
+		assert.Equal(t, 10.0, after[MetricDesiredAgents])
+	})
+}
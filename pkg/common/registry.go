@@ -0,0 +1,201 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MetricDefinition describes a metric exposed by the adapter.
+type MetricDefinition struct {
+	Name        string
+	Description string
+
+	// What the value is measured in, e.g. agents, jobs or seconds.
+	Unit string
+
+	// Labels the values have, in addition to agent_type.
+	Labels []string
+
+	// Calculates the value from the Semaphore metrics for an agent type.
+	// Nil for metrics that need more than that, like moving averages,
+	// which are generated by their own components.
+	Value func(m *Metrics) float64
+}
+
+// Registry keeps the definitions for the metrics exposed,
+// in the order they were registered, and which ones are disabled.
+type Registry struct {
+	definitions []MetricDefinition
+	index       map[string]int
+	disabled    map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		definitions: []MetricDefinition{},
+		index:       map[string]int{},
+		disabled:    map[string]bool{},
+	}
+}
+
+func (r *Registry) Register(definitions ...MetricDefinition) error {
+	for _, definition := range definitions {
+		if definition.Name == "" {
+			return fmt.Errorf("metric definition without a name")
+		}
+
+		if _, ok := r.index[definition.Name]; ok {
+			return fmt.Errorf("metric '%s' is already registered", definition.Name)
+		}
+
+		r.index[definition.Name] = len(r.definitions)
+		r.definitions = append(r.definitions, definition)
+	}
+
+	return nil
+}
+
+// Disable stops metrics from being exposed.
+func (r *Registry) Disable(names ...string) error {
+	for _, name := range names {
+		if _, ok := r.index[name]; !ok {
+			return fmt.Errorf("unknown metric '%s'", name)
+		}
+
+		r.disabled[name] = true
+	}
+
+	return nil
+}
+
+func (r *Registry) Enabled(name string) bool {
+	_, ok := r.index[name]
+	return ok && !r.disabled[name]
+}
+
+func (r *Registry) Get(name string) (MetricDefinition, bool) {
+	i, ok := r.index[name]
+	if !ok {
+		return MetricDefinition{}, false
+	}
+
+	return r.definitions[i], true
+}
+
+// Registered returns the definitions for all the metrics, including the disabled ones.
+func (r *Registry) Registered() []MetricDefinition {
+	return append([]MetricDefinition{}, r.definitions...)
+}
+
+// Definitions returns the definitions for the enabled metrics.
+func (r *Registry) Definitions() []MetricDefinition {
+	definitions := []MetricDefinition{}
+	for _, definition := range r.definitions {
+		if !r.disabled[definition.Name] {
+			definitions = append(definitions, definition)
+		}
+	}
+
+	return definitions
+}
+
+// Names returns the names of the enabled metrics.
+func (r *Registry) Names() []string {
+	names := []string{}
+	for _, definition := range r.Definitions() {
+		names = append(names, definition.Name)
+	}
+
+	return names
+}
+
+// Markdown documents the enabled metrics as a table.
+func (r *Registry) Markdown() string {
+	var b strings.Builder
+	b.WriteString("| Metric | Unit | Labels | Description |\n")
+	b.WriteString("|--------|------|--------|-------------|\n")
+
+	for _, definition := range r.Definitions() {
+		labels := []string{"`agent_type`"}
+		for _, label := range definition.Labels {
+			labels = append(labels, "`"+label+"`")
+		}
+
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", definition.Name, definition.Unit, strings.Join(labels, ", "), definition.Description)
+	}
+
+	return b.String()
+}
+
+// Metrics calculated only from the Semaphore metrics for an agent type.
+var BaseMetrics = []MetricDefinition{
+	{
+		Name:        MetricAgentsTotal,
+		Description: "Idle and occupied agents.",
+		Unit:        "agents",
+		Value:       func(m *Metrics) float64 { return float64(m.Agents.Total()) },
+	},
+	{
+		Name:        MetricAgentsIdle,
+		Description: "Agents waiting for jobs.",
+		Unit:        "agents",
+		Value:       func(m *Metrics) float64 { return float64(m.Agents.Idle) },
+	},
+	{
+		Name:        MetricAgentsOccupied,
+		Description: "Agents running jobs.",
+		Unit:        "agents",
+		Value:       func(m *Metrics) float64 { return float64(m.Agents.Occupied) },
+	},
+	{
+		Name:        MetricAgentsOccupiedPercentage,
+		Description: "Occupied agents over total agents, between `0` and `100`.",
+		Unit:        "percent",
+		Value:       func(m *Metrics) float64 { return m.Agents.OccupiedPercentage() },
+	},
+	{
+		Name:        MetricAgentsOccupiedRatio,
+		Description: "Occupied agents over total agents, between `0` and `1`.",
+		Unit:        "ratio",
+		Value:       func(m *Metrics) float64 { return m.Agents.OccupiedRatio() },
+	},
+	{
+		Name:        MetricJobsTotal,
+		Description: "Running and queued jobs.",
+		Unit:        "jobs",
+		Value:       func(m *Metrics) float64 { return float64(m.Jobs.Total()) },
+	},
+	{
+		Name:        MetricJobsQueued,
+		Description: "Jobs waiting for an agent.",
+		Unit:        "jobs",
+		Value:       func(m *Metrics) float64 { return float64(m.Jobs.Queued) },
+	},
+	{
+		Name:        MetricJobsRunning,
+		Description: "Jobs running on an agent.",
+		Unit:        "jobs",
+		Value:       func(m *Metrics) float64 { return float64(m.Jobs.Running) },
+	},
+	{
+		Name:        MetricJobsQueuedPerIdleAgent,
+		Description: "Queued jobs over idle agents. With no idle agents, this is the number of queued jobs.",
+		Unit:        "ratio",
+		Value:       func(m *Metrics) float64 { return ratio(m.Jobs.Queued, m.Agents.Idle) },
+	},
+	{
+		Name:        MetricJobsDemandCapacityRatio,
+		Description: "Total jobs over total agents. With no agents, this is the number of jobs.",
+		Unit:        "ratio",
+		Value:       func(m *Metrics) float64 { return ratio(m.Jobs.Total(), m.Agents.Total()) },
+	},
+}
+
+var baseMetricsIndex = func() map[string]MetricDefinition {
+	index := map[string]MetricDefinition{}
+	for _, definition := range BaseMetrics {
+		index[definition.Name] = definition
+	}
+
+	return index
+}()
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Registry(t *testing.T) {
+	newRegistry := func() *Registry {
+		r := NewRegistry()
+		require.NoError(t, r.Register(BaseMetrics...))
+		require.NoError(t, r.Register(AgentTypeMetrics...))
+		return r
+	}
+
+	t.Run("names are kept in order", func(t *testing.T) {
+		r := newRegistry()
+		names := r.Names()
+		require.Len(t, names, len(BaseMetrics)+len(AgentTypeMetrics))
+		assert.Equal(t, MetricAgentsTotal, names[0])
+		assert.Equal(t, MetricDesiredAgents, names[len(BaseMetrics)])
+	})
+
+	t.Run("duplicated names -> error", func(t *testing.T) {
+		r := newRegistry()
+		err := r.Register(MetricDefinition{Name: MetricJobsQueued})
+		assert.ErrorContains(t, err, "metric 'jobs_queued' is already registered")
+		assert.ErrorContains(t, r.Register(MetricDefinition{}), "without a name")
+	})
+
+	t.Run("disabled metrics are not listed", func(t *testing.T) {
+		r := newRegistry()
+		require.NoError(t, r.Disable(MetricJobsQueued))
+		assert.NotContains(t, r.Names(), MetricJobsQueued)
+		assert.False(t, r.Enabled(MetricJobsQueued))
+		assert.True(t, r.Enabled(MetricJobsRunning))
+		assert.False(t, r.Enabled("does-not-exist"))
+
+		_, ok := r.Get(MetricJobsQueued)
+		assert.True(t, ok)
+	})
+
+	t.Run("unknown metric cannot be disabled", func(t *testing.T) {
+		assert.ErrorContains(t, newRegistry().Disable("does-not-exist"), "unknown metric 'does-not-exist'")
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		r := NewRegistry()
+		require.NoError(t, r.Register(MetricDefinition{Name: "a", Unit: "jobs", Description: "A.", Labels: []string{"x"}}))
+		assert.Equal(t, "| Metric | Unit | Labels | Description |\n|--------|------|--------|-------------|\n| `a` | jobs | `agent_type`, `x` | A. |\n", r.Markdown())
+	})
+
+	t.Run("every base metric has a value", func(t *testing.T) {
+		for _, definition := range BaseMetrics {
+			assert.NotNil(t, definition.Value, definition.Name)
+			assert.NotEmpty(t, definition.Description, definition.Name)
+			assert.NotEmpty(t, definition.Unit, definition.Name)
+		}
+	})
+}
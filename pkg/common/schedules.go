@@ -0,0 +1,213 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Schedules use IANA time zones, which are not always available
+	// in the container image, so the time zone database is embedded.
+	_ "time/tzdata"
+)
+
+const MetricScheduledMinAgents = "scheduled_min_agents"
+
+// Schedule is a minimum number of agents to keep during some hours of some days of the week,
+// in a time zone, e.g. "mon-fri 08:00-18:00 Europe/Berlin min=20".
+// Times are wall clock times in the time zone, so the schedule follows daylight saving time changes.
+// If the end is before the start, the schedule ends on the next day, e.g. "fri 22:00-06:00".
+type Schedule struct {
+	Days [7]bool
+
+	// Minutes since midnight. The end can be 24:00, to include the last minute of the day.
+	Start int
+	End   int
+
+	Location  *time.Location
+	MinAgents int
+
+	spec string
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// ActiveAt tells whether the schedule applies at a point in time.
+func (s *Schedule) ActiveAt(t time.Time) bool {
+	local := t.In(s.Location)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	if s.Start < s.End {
+		return s.Days[today] && minute >= s.Start && minute < s.End
+	}
+
+	// Overnight schedules start on one of the days, and end on the next one.
+	return (s.Days[today] && minute >= s.Start) || (s.Days[yesterday] && minute < s.End)
+}
+
+type Schedules []*Schedule
+
+// Active returns the schedule with the highest minimum number of agents
+// among the ones that apply at a point in time, or nil, if none do.
+func (s Schedules) Active(t time.Time) *Schedule {
+	var active *Schedule
+	for _, schedule := range s {
+		if schedule.ActiveAt(t) && (active == nil || schedule.MinAgents > active.MinAgents) {
+			active = schedule
+		}
+	}
+
+	return active
+}
+
+// MinAgents returns the minimum number of agents required by the schedules at a point in time.
+func (s Schedules) MinAgents(t time.Time) int {
+	if active := s.Active(t); active != nil {
+		return active.MinAgents
+	}
+
+	return 0
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedules parses schedules separated by semicolons or new lines, e.g.:
+//
+//	mon-fri 08:00-18:00 Europe/Berlin min=20; sat,sun 10:00-14:00 UTC min=5
+//
+// Days can be lists and ranges of mon, tue, wed, thu, fri, sat and sun,
+// or weekdays, weekends and daily. Times are HH:MM, and 24:00 is the end of the day.
+func ParseSchedules(s string) (Schedules, error) {
+	schedules := Schedules{}
+	for _, spec := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", spec, err)
+		}
+
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+func parseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("expected '<days> <HH:MM>-<HH:MM> <time zone> min=<agents>'")
+	}
+
+	days, err := parseDays(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	hours := strings.SplitN(fields[1], "-", 2)
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("invalid hours '%s': expected <HH:MM>-<HH:MM>", fields[1])
+	}
+
+	start, err := parseClock(hours[0])
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := parseClock(hours[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("start and end are the same")
+	}
+
+	if start == 24*60 {
+		return nil, fmt.Errorf("invalid start '24:00'")
+	}
+
+	location, err := time.LoadLocation(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone '%s'", fields[2])
+	}
+
+	if !strings.HasPrefix(fields[3], "min=") {
+		return nil, fmt.Errorf("invalid '%s': expected min=<agents>", fields[3])
+	}
+
+	min, err := strconv.Atoi(strings.TrimPrefix(fields[3], "min="))
+	if err != nil || min < 0 {
+		return nil, fmt.Errorf("invalid '%s': must be a non-negative number", fields[3])
+	}
+
+	return &Schedule{Days: days, Start: start, End: end, Location: location, MinAgents: min, spec: spec}, nil
+}
+
+func parseDays(s string) ([7]bool, error) {
+	days := [7]bool{}
+
+	switch s {
+	case "daily", "*":
+		s = "sun-sat"
+	case "weekdays":
+		s = "mon-fri"
+	case "weekends":
+		s = "sat,sun"
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("invalid day '%s'", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdays[bounds[1]]
+			if !ok {
+				return days, fmt.Errorf("invalid day '%s'", bounds[1])
+			}
+		}
+
+		// Ranges can wrap around the end of the week, e.g. fri-mon.
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// Parses HH:MM into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	return 0, fmt.Errorf("invalid time '%s': expected HH:MM", s)
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__ParseSchedules(t *testing.T) {
+	t.Run("multiple schedules", func(t *testing.T) {
+		schedules, err := ParseSchedules("mon-fri 08:00-18:00 Europe/Berlin min=20; weekends 10:00-14:00 UTC min=5\ndaily 22:00-06:00 America/New_York min=1")
+		require.NoError(t, err)
+		require.Len(t, schedules, 3)
+
+		assert.Equal(t, [7]bool{false, true, true, true, true, true, false}, schedules[0].Days)
+		assert.Equal(t, 8*60, schedules[0].Start)
+		assert.Equal(t, 18*60, schedules[0].End)
+		assert.Equal(t, "Europe/Berlin", schedules[0].Location.String())
+		assert.Equal(t, 20, schedules[0].MinAgents)
+		assert.Equal(t, "mon-fri 08:00-18:00 Europe/Berlin min=20", schedules[0].String())
+
+		assert.Equal(t, [7]bool{true, false, false, false, false, false, true}, schedules[1].Days)
+		assert.Equal(t, [7]bool{true, true, true, true, true, true, true}, schedules[2].Days)
+	})
+
+	t.Run("day lists and ranges wrapping around the week", func(t *testing.T) {
+		schedules, err := ParseSchedules("fri-mon,wed 00:00-24:00 UTC min=1")
+		require.NoError(t, err)
+		assert.Equal(t, [7]bool{true, true, false, true, false, true, true}, schedules[0].Days)
+	})
+
+	t.Run("empty -> no schedules", func(t *testing.T) {
+		schedules, err := ParseSchedules(" ; ")
+		require.NoError(t, err)
+		assert.Empty(t, schedules)
+	})
+
+	testCases := map[string]string{
+		"mon-fri 08:00-18:00 Europe/Berlin":       "expected '<days> <HH:MM>-<HH:MM> <time zone> min=<agents>'",
+		"someday 08:00-18:00 UTC min=1":           "invalid day 'someday'",
+		"mon-xyz 08:00-18:00 UTC min=1":           "invalid day 'xyz'",
+		"mon 08:00 UTC min=1":                     "invalid hours '08:00'",
+		"mon 8am-18:00 UTC min=1":                 "invalid time '8am'",
+		"mon 08:00-25:00 UTC min=1":               "invalid time '25:00'",
+		"mon 08:00-08:00 UTC min=1":               "start and end are the same",
+		"mon 24:00-08:00 UTC min=1":               "invalid start '24:00'",
+		"mon 08:00-18:00 Mars/Olympus_Mons min=1": "invalid time zone 'Mars/Olympus_Mons'",
+		"mon 08:00-18:00 UTC max=1":               "expected min=<agents>",
+		"mon 08:00-18:00 UTC min=-1":              "must be a non-negative number",
+	}
+
+	for spec, expected := range testCases {
+		t.Run(spec+" -> error", func(t *testing.T) {
+			_, err := ParseSchedules(spec)
+			assert.ErrorContains(t, err, "invalid schedule '"+spec+"'")
+			assert.ErrorContains(t, err, expected)
+		})
+	}
+}
+
+func Test__Schedules(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+
+		return t
+	}
+
+	parse := func(s string) Schedules {
+		schedules, err := ParseSchedules(s)
+		require.NoError(t, err)
+		return schedules
+	}
+
+	t.Run("active during the hours, on the days", func(t *testing.T) {
+		s := parse("mon-fri 08:00-18:00 UTC min=20")
+
+		// 2023-01-02 is a Monday
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-02T07:59:00Z")))
+		assert.Equal(t, 20, s.MinAgents(at("2023-01-02T08:00:00Z")))
+		assert.Equal(t, 20, s.MinAgents(at("2023-01-02T17:59:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-02T18:00:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-07T12:00:00Z")))
+	})
+
+	t.Run("times are in the time zone", func(t *testing.T) {
+		s := parse("mon-fri 08:00-18:00 Asia/Tokyo min=20")
+
+		// 2023-01-02 08:30 in Tokyo is 2023-01-01 23:30 UTC, a Sunday
+		assert.Equal(t, 20, s.MinAgents(at("2023-01-01T23:30:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-02T10:00:00Z")))
+	})
+
+	t.Run("schedules follow daylight saving time changes", func(t *testing.T) {
+		s := parse("daily 08:00-18:00 Europe/Berlin min=20")
+
+		// 06:30 UTC is 07:30 in Berlin before the change to summer time, on 2023-03-26,
+		// and 08:30 after it.
+		assert.Equal(t, 0, s.MinAgents(at("2023-03-25T06:30:00Z")))
+		assert.Equal(t, 20, s.MinAgents(at("2023-03-27T06:30:00Z")))
+
+		// the day of the change is still covered, even though it's shorter
+		assert.Equal(t, 20, s.MinAgents(at("2023-03-26T06:00:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-03-26T16:00:00Z")))
+	})
+
+	t.Run("overnight schedules end on the next day", func(t *testing.T) {
+		s := parse("fri 22:00-06:00 UTC min=3")
+
+		// 2023-01-06 is a Friday
+		assert.Equal(t, 3, s.MinAgents(at("2023-01-06T23:00:00Z")))
+		assert.Equal(t, 3, s.MinAgents(at("2023-01-07T05:59:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-07T06:00:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-06T05:00:00Z")))
+	})
+
+	t.Run("until the end of the day", func(t *testing.T) {
+		s := parse("mon 12:00-24:00 UTC min=3")
+		assert.Equal(t, 3, s.MinAgents(at("2023-01-02T23:59:00Z")))
+		assert.Equal(t, 0, s.MinAgents(at("2023-01-03T00:00:00Z")))
+	})
+
+	t.Run("highest minimum wins when schedules overlap", func(t *testing.T) {
+		s := parse("daily 00:00-24:00 UTC min=2; mon 09:00-10:00 UTC min=10")
+		assert.Equal(t, 10, s.MinAgents(at("2023-01-02T09:30:00Z")))
+		assert.Equal(t, "mon 09:00-10:00 UTC min=10", s.Active(at("2023-01-02T09:30:00Z")).String())
+		assert.Equal(t, 2, s.MinAgents(at("2023-01-02T10:30:00Z")))
+	})
+
+	t.Run("no schedules -> nothing active", func(t *testing.T) {
+		assert.Nil(t, Schedules{}.Active(at("2023-01-02T09:30:00Z")))
+		assert.Equal(t, 0, Schedules{}.MinAgents(at("2023-01-02T09:30:00Z")))
+	})
+}
@@ -0,0 +1,456 @@
+// Package expression implements a small arithmetic expression language
+// for metrics derived from other metrics, e.g. "agents_idle - jobs_queued".
+//
+// Expressions are made of numbers, variables, the + - * / operators,
+// parentheses and a fixed set of functions: min, max, abs, ceil, floor and round.
+// There are no loops, assignments or side effects, so expressions
+// from untrusted configuration can be evaluated safely.
+package expression
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions longer or more deeply nested than this are rejected,
+// so a bad configuration cannot make evaluation expensive.
+const (
+	MaxLength = 1024
+	MaxDepth  = 32
+)
+
+type Expression struct {
+	source    string
+	root      node
+	variables []string
+}
+
+// Parse parses and validates an expression.
+func Parse(source string) (*Expression, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", MaxLength)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", p.peek().text, p.peek().pos)
+	}
+
+	variables := map[string]bool{}
+	root.collectVariables(variables)
+
+	names := []string{}
+	for name := range variables {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return &Expression{source: source, root: root, variables: names}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Variables returns the names of the variables used in the expression, sorted.
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+// Evaluate returns the value of the expression, with the variables given.
+// Using a variable that is not given, or dividing by zero, is an error.
+func (e *Expression) Evaluate(variables map[string]float64) (float64, error) {
+	v, err := e.root.evaluate(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("expression does not evaluate to a finite number")
+	}
+
+	return v, nil
+}
+
+type node interface {
+	evaluate(variables map[string]float64) (float64, error)
+	collectVariables(names map[string]bool)
+}
+
+type number float64
+
+func (n number) evaluate(map[string]float64) (float64, error) { return float64(n), nil }
+func (n number) collectVariables(map[string]bool)             {}
+
+type variable string
+
+func (v variable) evaluate(variables map[string]float64) (float64, error) {
+	value, ok := variables[string(v)]
+	if !ok {
+		return 0, fmt.Errorf("no value for '%s'", string(v))
+	}
+
+	return value, nil
+}
+
+func (v variable) collectVariables(names map[string]bool) {
+	names[string(v)] = true
+}
+
+type negation struct {
+	operand node
+}
+
+func (n negation) evaluate(variables map[string]float64) (float64, error) {
+	v, err := n.operand.evaluate(variables)
+	return -v, err
+}
+
+func (n negation) collectVariables(names map[string]bool) {
+	n.operand.collectVariables(names)
+}
+
+type binary struct {
+	operator    byte
+	left, right node
+}
+
+func (b binary) evaluate(variables map[string]float64) (float64, error) {
+	left, err := b.left.evaluate(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	right, err := b.right.evaluate(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.operator {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+
+		return left / right, nil
+	}
+}
+
+func (b binary) collectVariables(names map[string]bool) {
+	b.left.collectVariables(names)
+	b.right.collectVariables(names)
+}
+
+type call struct {
+	function  function
+	arguments []node
+}
+
+func (c call) evaluate(variables map[string]float64) (float64, error) {
+	arguments := []float64{}
+	for _, argument := range c.arguments {
+		v, err := argument.evaluate(variables)
+		if err != nil {
+			return 0, err
+		}
+
+		arguments = append(arguments, v)
+	}
+
+	return c.function.apply(arguments), nil
+}
+
+func (c call) collectVariables(names map[string]bool) {
+	for _, argument := range c.arguments {
+		argument.collectVariables(names)
+	}
+}
+
+type function struct {
+	// Minimum and maximum number of arguments. A negative max means no maximum.
+	minArgs, maxArgs int
+	apply            func(arguments []float64) float64
+}
+
+var functions = map[string]function{
+	"min":   {minArgs: 1, maxArgs: -1, apply: func(a []float64) float64 { return reduce(a, math.Min) }},
+	"max":   {minArgs: 1, maxArgs: -1, apply: func(a []float64) float64 { return reduce(a, math.Max) }},
+	"abs":   {minArgs: 1, maxArgs: 1, apply: func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {minArgs: 1, maxArgs: 1, apply: func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {minArgs: 1, maxArgs: 1, apply: func(a []float64) float64 { return math.Floor(a[0]) }},
+	"round": {minArgs: 1, maxArgs: 1, apply: func(a []float64) float64 { return math.Round(a[0]) }},
+}
+
+func reduce(values []float64, f func(a, b float64) float64) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		result = f(result, v)
+	}
+
+	return result
+}
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenIdentifier
+	tokenOperator
+	tokenOpenParen
+	tokenCloseParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(source string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '+' || r == '-' || r == '*' || r == '/':
+			tokens = append(tokens, token{kind: tokenOperator, text: string(r), pos: i})
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpenParen, text: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenCloseParen, text: ")", pos: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdentifier, text: string(runes[start:i]), pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at position %d", r, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+// Recursive descent parser for:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | identifier | identifier "(" expression { "," expression } ")" | "(" expression ")"
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) done() bool {
+	return p.next >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) nextIs(kind tokenKind, texts ...string) bool {
+	if p.done() || p.peek().kind != kind {
+		return false
+	}
+
+	if len(texts) == 0 {
+		return true
+	}
+
+	for _, text := range texts {
+		if p.peek().text == text {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) parseExpression(depth int) (node, error) {
+	if depth > MaxDepth {
+		return nil, fmt.Errorf("expression is nested more than %d levels deep", MaxDepth)
+	}
+
+	left, err := p.parseTerm(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.nextIs(tokenOperator, "+", "-") {
+		operator := p.peek().text[0]
+		p.next++
+
+		right, err := p.parseTerm(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		left = binary{operator: operator, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseTerm(depth int) (node, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.nextIs(tokenOperator, "*", "/") {
+		operator := p.peek().text[0]
+		p.next++
+
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+
+		left = binary{operator: operator, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if p.nextIs(tokenOperator, "-") {
+		if depth > MaxDepth {
+			return nil, fmt.Errorf("expression is nested more than %d levels deep", MaxDepth)
+		}
+
+		p.next++
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		return negation{operand: operand}, nil
+	}
+
+	return p.parsePrimary(depth)
+}
+
+func (p *parser) parsePrimary(depth int) (node, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	t := p.peek()
+	switch t.kind {
+	case tokenNumber:
+		p.next++
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", t.text, t.pos)
+		}
+
+		return number(v), nil
+
+	case tokenIdentifier:
+		p.next++
+		if !p.nextIs(tokenOpenParen) {
+			return variable(t.text), nil
+		}
+
+		return p.parseCall(t, depth)
+
+	case tokenOpenParen:
+		p.next++
+		inner, err := p.parseExpression(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.nextIs(tokenCloseParen) {
+			return nil, fmt.Errorf("missing ')' for '(' at position %d", t.pos)
+		}
+
+		p.next++
+		return inner, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+	}
+}
+
+func (p *parser) parseCall(name token, depth int) (node, error) {
+	f, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s' at position %d", name.text, name.pos)
+	}
+
+	// skip the opening parenthesis
+	p.next++
+
+	arguments := []node{}
+	for {
+		argument, err := p.parseExpression(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		arguments = append(arguments, argument)
+		if p.nextIs(tokenComma) {
+			p.next++
+			continue
+		}
+
+		if !p.nextIs(tokenCloseParen) {
+			return nil, fmt.Errorf("missing ')' for '%s' at position %d", name.text, name.pos)
+		}
+
+		p.next++
+		break
+	}
+
+	if len(arguments) < f.minArgs || (f.maxArgs >= 0 && len(arguments) > f.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments for '%s': %d", name.text, len(arguments))
+	}
+
+	return call{function: f, arguments: arguments}, nil
+}
@@ -0,0 +1,99 @@
+package expression
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Evaluate(t *testing.T) {
+	variables := map[string]float64{
+		"agents_idle":        3,
+		"jobs_queued":        5,
+		"jobs_queued_avg_5m": 2.5,
+	}
+
+	testCases := map[string]float64{
+		"agents_idle - jobs_queued":              -2,
+		"1 + 2 * 3":                              7,
+		"(1 + 2) * 3":                            9,
+		"10 / 4":                                 2.5,
+		"10 - 4 - 3":                             3,
+		"-jobs_queued + 1":                       -4,
+		"--2":                                    2,
+		"max(0, agents_idle - jobs_queued)":      0,
+		"min(jobs_queued, 4, 10)":                4,
+		"abs(agents_idle - jobs_queued)":         2,
+		"ceil(jobs_queued_avg_5m)":               3,
+		"floor(jobs_queued_avg_5m)":              2,
+		"round(jobs_queued_avg_5m)":              3,
+		"0.5 * jobs_queued":                      2.5,
+		"max(jobs_queued, jobs_queued_avg_5m*4)": 10,
+	}
+
+	for source, expected := range testCases {
+		t.Run(source, func(t *testing.T) {
+			e, err := Parse(source)
+			require.NoError(t, err)
+
+			v, err := e.Evaluate(variables)
+			require.NoError(t, err)
+			assert.Equal(t, expected, v)
+		})
+	}
+}
+
+func Test__EvaluateErrors(t *testing.T) {
+	t.Run("missing variable -> error", func(t *testing.T) {
+		e, err := Parse("jobs_queued + 1")
+		require.NoError(t, err)
+		_, err = e.Evaluate(map[string]float64{})
+		assert.ErrorContains(t, err, "no value for 'jobs_queued'")
+	})
+
+	t.Run("division by zero -> error", func(t *testing.T) {
+		e, err := Parse("1 / agents_idle")
+		require.NoError(t, err)
+		_, err = e.Evaluate(map[string]float64{"agents_idle": 0})
+		assert.ErrorContains(t, err, "division by zero")
+	})
+}
+
+func Test__Parse(t *testing.T) {
+	t.Run("variables are collected", func(t *testing.T) {
+		e, err := Parse("max(jobs_queued, agents_idle) - jobs_queued")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"agents_idle", "jobs_queued"}, e.Variables())
+		assert.Equal(t, "max(jobs_queued, agents_idle) - jobs_queued", e.String())
+	})
+
+	testCases := map[string]string{
+		"":          "empty expression",
+		"1 +":       "unexpected end of expression",
+		"(1 + 2":    "missing ')'",
+		"1 + 2)":    "unexpected ')' at position 5",
+		"1 % 2":     "unexpected '%' at position 2",
+		"exec(1)":   "unknown function 'exec'",
+		"abs(1, 2)": "wrong number of arguments for 'abs': 2",
+		"min()":     "unexpected ')'",
+		"1..2":      "invalid number '1..2'",
+		"a b":       "unexpected 'b'",
+		strings.Repeat("(", 40) + "1" + strings.Repeat(")", 40): "nested more than 32 levels deep",
+		strings.Repeat("-", 40) + "1":                           "nested more than 32 levels deep",
+		strings.Repeat("1+", 600) + "1":                         "longer than 1024 characters",
+	}
+
+	for source, expected := range testCases {
+		name := source
+		if len(name) > 20 {
+			name = name[:20] + "..."
+		}
+
+		t.Run(name+" -> error", func(t *testing.T) {
+			_, err := Parse(source)
+			assert.ErrorContains(t, err, expected)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+const MetricActivation = "activation"
+
+const DefaultActivationGracePeriod = 10 * time.Minute
+
+// Activation tells whether the pool for an agent type should be running at all:
+// 1 while there are queued or running jobs, and for a grace period after the last one,
+// if there is one, and 0 after that, so external controllers can scale the pool to zero.
+type Activation struct {
+	gracePeriod time.Duration
+	agentTypes  map[string]*activity
+}
+
+type activity struct {
+	source     string
+	lastActive time.Time
+
+	// Whether there were jobs in the last sample, which keeps the
+	// agent type active even when there is no grace period.
+	hasJobs bool
+}
+
+func NewActivation(gracePeriod time.Duration) *Activation {
+	return &Activation{
+		gracePeriod: gracePeriod,
+		agentTypes:  map[string]*activity{},
+	}
+}
+
+func (a *Activation) Definition() common.MetricDefinition {
+	description := "`1` while there are queued or running jobs, `0` after that."
+	if a.gracePeriod > 0 {
+		description = fmt.Sprintf("`1` while there are queued or running jobs, and for %s after the last ones, `0` after that.", formatWindow(a.gracePeriod))
+	}
+
+	return common.MetricDefinition{
+		Name:        MetricActivation,
+		Description: description,
+		Unit:        "boolean",
+	}
+}
+
+// Record updates the last time an agent type had jobs.
+// We don't know when an agent type we have not seen before last had jobs,
+// e.g. after a restart, so it is considered active, to not scale it down too early.
+func (a *Activation) Record(agentType *common.AgentType, m *common.Metrics, at time.Time) {
+	s := sourceOf(agentType)
+	state, ok := a.agentTypes[agentType.Name]
+	if !ok || state.source != s {
+		a.agentTypes[agentType.Name] = &activity{source: s, lastActive: at, hasJobs: m.Jobs.Total() > 0}
+		return
+	}
+
+	state.hasJobs = m.Jobs.Total() > 0
+	if state.hasJobs && at.After(state.lastActive) {
+		state.lastActive = at
+	}
+}
+
+func (a *Activation) Generate(agentType string, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	state, ok := a.agentTypes[agentType]
+	if !ok {
+		return []external_metrics.ExternalMetricValue{}
+	}
+
+	value := 0.0
+	if state.hasJobs || now.Sub(state.lastActive) < a.gracePeriod {
+		value = 1
+	}
+
+	return []external_metrics.ExternalMetricValue{
+		{
+			MetricName:   MetricActivation,
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(value),
+			MetricLabels: labels,
+		},
+	}
+}
+
+// Forget drops the activity for agent types that do not exist anymore.
+func (a *Activation) Forget(existing map[string]bool) {
+	for agentType := range a.agentTypes {
+		if !existing[agentType] {
+			delete(a.agentTypes, agentType)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Activation(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	agentType := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t1"}
+
+	activation := func(a *Activation, now time.Time) float64 {
+		values := a.Generate("s1-a", agentType.Labels(), now)
+		require.Len(t, values, 1)
+		assert.Equal(t, MetricActivation, values[0].MetricName)
+		assert.Equal(t, "s1-a", values[0].MetricLabels["agent_type"])
+		return values[0].Value.AsApproximateFloat64()
+	}
+
+	jobs := func(running, queued int) *common.Metrics {
+		return &common.Metrics{Jobs: common.JobMetrics{Running: running, Queued: queued}}
+	}
+
+	t.Run("unknown agent type -> no values", func(t *testing.T) {
+		a := NewActivation(10 * time.Minute)
+		assert.Empty(t, a.Generate("s1-a", agentType.Labels(), start))
+	})
+
+	t.Run("first sample without jobs -> active until grace period ends", func(t *testing.T) {
+		a := NewActivation(10 * time.Minute)
+		a.Record(agentType, jobs(0, 0), start)
+		assert.Equal(t, 1.0, activation(a, start))
+		assert.Equal(t, 1.0, activation(a, start.Add(9*time.Minute)))
+		assert.Equal(t, 0.0, activation(a, start.Add(10*time.Minute)))
+	})
+
+	t.Run("queued or running jobs -> active", func(t *testing.T) {
+		a := NewActivation(time.Minute)
+		a.Record(agentType, jobs(0, 0), start)
+		a.Record(agentType, jobs(0, 0), start.Add(2*time.Minute))
+		assert.Equal(t, 0.0, activation(a, start.Add(2*time.Minute)))
+
+		a.Record(agentType, jobs(0, 3), start.Add(3*time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(3*time.Minute)))
+
+		a.Record(agentType, jobs(2, 0), start.Add(4*time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(4*time.Minute)))
+	})
+
+	t.Run("stays active for grace period after last jobs", func(t *testing.T) {
+		a := NewActivation(5 * time.Minute)
+		a.Record(agentType, jobs(1, 0), start)
+		a.Record(agentType, jobs(0, 0), start.Add(time.Minute))
+		a.Record(agentType, jobs(0, 0), start.Add(4*time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(4*time.Minute)))
+
+		a.Record(agentType, jobs(0, 0), start.Add(5*time.Minute))
+		assert.Equal(t, 0.0, activation(a, start.Add(5*time.Minute)))
+	})
+
+	t.Run("source change -> grace period starts again", func(t *testing.T) {
+		a := NewActivation(time.Minute)
+		a.Record(agentType, jobs(0, 0), start)
+		assert.Equal(t, 0.0, activation(a, start.Add(2*time.Minute)))
+
+		changed := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t2"}
+		a.Record(changed, jobs(0, 0), start.Add(2*time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(2*time.Minute)))
+	})
+
+	t.Run("no grace period -> active only while there are jobs", func(t *testing.T) {
+		a := NewActivation(0)
+		a.Record(agentType, jobs(0, 0), start)
+		assert.Equal(t, 0.0, activation(a, start))
+
+		a.Record(agentType, jobs(0, 2), start.Add(time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(time.Minute)))
+
+		a.Record(agentType, jobs(1, 0), start.Add(2*time.Minute))
+		assert.Equal(t, 1.0, activation(a, start.Add(2*time.Minute)))
+
+		a.Record(agentType, jobs(0, 0), start.Add(3*time.Minute))
+		assert.Equal(t, 0.0, activation(a, start.Add(3*time.Minute)))
+	})
+
+	t.Run("forget removes agent types that do not exist anymore", func(t *testing.T) {
+		a := NewActivation(time.Minute)
+		a.Record(agentType, jobs(1, 0), start)
+		a.Forget(map[string]bool{})
+		assert.Empty(t, a.Generate("s1-a", agentType.Labels(), start))
+	})
+}
@@ -8,10 +8,13 @@ import (
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
 )
 
 // We cache the agent type secret information
@@ -57,8 +60,14 @@ func NewAgentTypeFinder(client dynamic.Interface, namespace string) (*AgentTypeF
 	}, nil
 }
 
-func (f *AgentTypeFinder) Find() ([]*common.AgentType, error) {
-	list, err := f.secretsInterface.List(context.Background(), v1.ListOptions{
+func (f *AgentTypeFinder) Find(ctx context.Context) (agentTypes []*common.AgentType, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "AgentTypeFinder.Find")
+	defer func() {
+		span.SetAttributes(attribute.Int("agent_types", len(agentTypes)))
+		tracing.End(span, err)
+	}()
+
+	list, err := f.secretsInterface.List(ctx, v1.ListOptions{
 		LabelSelector: "semaphore-agent/autoscaled=true",
 	})
 
@@ -66,9 +75,9 @@ func (f *AgentTypeFinder) Find() ([]*common.AgentType, error) {
 		return []*common.AgentType{}, fmt.Errorf("error listing secrets: %v", err)
 	}
 
-	agentTypes := []*common.AgentType{}
+	agentTypes = []*common.AgentType{}
 	for _, secret := range list.Items {
-		agentType, err := f.findAgentType(secret.GetName())
+		agentType, err := f.findAgentType(ctx, secret.GetName())
 		if err != nil {
 			return []*common.AgentType{}, fmt.Errorf("error converting secret '%s' to agent type information: %v", secret.GetName(), err)
 		}
@@ -81,17 +90,24 @@ func (f *AgentTypeFinder) Find() ([]*common.AgentType, error) {
 
 // Get the agent type information (endpoint and token) from the secret specified.
 // We also cache this information to avoid going to the Kubernetes API on every iteration.
-func (f *AgentTypeFinder) findAgentType(secretName string) (*common.AgentType, error) {
+func (f *AgentTypeFinder) findAgentType(ctx context.Context, secretName string) (agentType *common.AgentType, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "AgentTypeFinder.findAgentType")
+	span.SetAttributes(attribute.String("secret", secretName))
+	defer func() { tracing.End(span, err) }()
+
 	value, found := f.cache.Get(secretName)
 	if found {
 		if info, ok := value.(*common.AgentType); ok {
+			span.SetAttributes(attribute.Bool("cache_hit", true))
 			return info, nil
 		}
 	}
 
+	span.SetAttributes(attribute.Bool("cache_hit", false))
+
 	// If the agent type info does not exist in the cache,
 	// we fetch the information from the Kubernetes API.
-	o, err := f.secretsInterface.Get(context.Background(), secretName, v1.GetOptions{})
+	o, err := f.secretsInterface.Get(ctx, secretName, v1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("error describing secret: %v", err)
 	}
@@ -111,18 +127,83 @@ func (f *AgentTypeFinder) unstructuredSecretToAgentType(secret *unstructured.Uns
 		return nil, err
 	}
 
-	token, err := getNestedString(secret, "data", "token")
+	apiVersion, err := getOptionalNestedString(secret, "data", "api_version")
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := unstructuredSecretToAuthConfig(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invalid desired agents annotations only affect desired_agents, not the other metrics.
+	desiredAgents, err := parseDesiredAgentsConfig(secret.GetAnnotations())
+	if err != nil {
+		klog.Errorf("Ignoring invalid annotations on secret '%s': %v", secret.GetName(), err)
+	}
+
+	schedules, err := parseSchedules(secret.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := parseNamespaces(secret.GetNamespace(), secret.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+
+	// The token is not used by all auth schemes.
+	var token string
+	switch auth.Scheme {
+	case common.AuthSchemeOAuth2, common.AuthSchemeMTLS:
+		token, err = getOptionalNestedString(secret, "data", "token")
+	default:
+		token, err = getNestedString(secret, "data", "token")
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
 	return &common.AgentType{
-		Name:     secret.GetName(),
-		Endpoint: endpoint,
-		Token:    token,
+		Name:          secret.GetName(),
+		Endpoint:      endpoint,
+		Token:         token,
+		APIVersion:    apiVersion,
+		Auth:          *auth,
+		DesiredAgents: *desiredAgents,
+		Schedules:     schedules,
+		SecretLabels:  secret.GetLabels(),
+		Namespaces:    namespaces,
 	}, nil
 }
 
+func unstructuredSecretToAuthConfig(secret *unstructured.Unstructured) (*common.AuthConfig, error) {
+	auth := common.AuthConfig{}
+	fields := map[string]*string{
+		"auth_scheme":          &auth.Scheme,
+		"oauth2_client_id":     &auth.ClientID,
+		"oauth2_client_secret": &auth.ClientSecret,
+		"oauth2_token_url":     &auth.TokenURL,
+		"oauth2_scopes":        &auth.Scopes,
+		"tls_cert":             &auth.ClientCert,
+		"tls_key":              &auth.ClientKey,
+		"tls_ca":               &auth.CACert,
+	}
+
+	for key, field := range fields {
+		v, err := getOptionalNestedString(secret, "data", key)
+		if err != nil {
+			return nil, err
+		}
+
+		*field = v
+	}
+
+	return &auth, nil
+}
+
 func getNestedString(o *unstructured.Unstructured, fields ...string) (string, error) {
 	v, found, err := unstructured.NestedString(o.Object, fields...)
 	if !found || err != nil {
@@ -136,3 +217,12 @@ func getNestedString(o *unstructured.Unstructured, fields ...string) (string, er
 
 	return string(decoded), nil
 }
+
+func getOptionalNestedString(o *unstructured.Unstructured, fields ...string) (string, error) {
+	_, found, _ := unstructured.NestedString(o.Object, fields...)
+	if !found {
+		return "", nil
+	}
+
+	return getNestedString(o, fields...)
+}
@@ -1,9 +1,12 @@
 package provider
 
 import (
+	"context"
 	"testing"
 
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -15,7 +18,7 @@ func Test__AgentTypeFinder(t *testing.T) {
 	t.Run("no secrets -> no agent types", func(t *testing.T) {
 		c := dynamicfake.NewSimpleDynamicClient(newTestScheme())
 		f, _ := NewAgentTypeFinder(c, "default")
-		types, err := f.Find()
+		types, err := f.Find(context.Background())
 		assert.NoError(t, err)
 		assert.Empty(t, types)
 	})
@@ -30,7 +33,7 @@ func Test__AgentTypeFinder(t *testing.T) {
 		}...)
 
 		f, _ := NewAgentTypeFinder(c, "default")
-		types, err := f.Find()
+		types, err := f.Find(context.Background())
 		assert.NoError(t, err)
 		assert.Empty(t, types)
 	})
@@ -45,7 +48,7 @@ func Test__AgentTypeFinder(t *testing.T) {
 		}...)
 
 		f, _ := NewAgentTypeFinder(c, "default")
-		types, err := f.Find()
+		types, err := f.Find(context.Background())
 		assert.NoError(t, err)
 		assert.Empty(t, types)
 	})
@@ -64,7 +67,7 @@ func Test__AgentTypeFinder(t *testing.T) {
 		}...)
 
 		f, _ := NewAgentTypeFinder(c, "default")
-		types, err := f.Find()
+		types, err := f.Find(context.Background())
 		assert.Error(t, err)
 		assert.Empty(t, types)
 	})
@@ -86,14 +89,151 @@ func Test__AgentTypeFinder(t *testing.T) {
 		}...)
 
 		f, _ := NewAgentTypeFinder(c, "default")
-		types, err := f.Find()
+		types, err := f.Find(context.Background())
 		assert.NoError(t, err)
 		if assert.Len(t, types, 1) {
 			assert.Equal(t, types[0].Name, "agent-type-1")
 			assert.Equal(t, types[0].Token, "asdasdasd")
 			assert.Equal(t, types[0].Endpoint, "testing.com")
+			assert.Equal(t, types[0].APIVersion, "")
 		}
 	})
+
+	t.Run("secret with API version -> agent type is returned with API version", func(t *testing.T) {
+		c := dynamicfake.NewSimpleDynamicClient(newTestScheme(), []runtime.Object{
+			&corev1.Secret{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-type-1",
+					Namespace: "default",
+					Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					"endpoint":    []byte("testing.com"),
+					"token":       []byte("asdasdasd"),
+					"api_version": []byte("v1"),
+				},
+			},
+		}...)
+
+		f, _ := NewAgentTypeFinder(c, "default")
+		types, err := f.Find(context.Background())
+		assert.NoError(t, err)
+		if assert.Len(t, types, 1) {
+			assert.Equal(t, types[0].APIVersion, "v1")
+		}
+	})
+
+	t.Run("secret with desired agents annotations -> agent type is returned with config", func(t *testing.T) {
+		c := dynamicfake.NewSimpleDynamicClient(newTestScheme(), []runtime.Object{
+			&corev1.Secret{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-type-1",
+					Namespace: "default",
+					Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+					Annotations: map[string]string{
+						AnnotationDesiredAgentsHeadroom: "20%",
+						AnnotationDesiredAgentsMax:      "50",
+					},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					"endpoint": []byte("testing.com"),
+					"token":    []byte("asdasdasd"),
+				},
+			},
+		}...)
+
+		f, _ := NewAgentTypeFinder(c, "default")
+		types, err := f.Find(context.Background())
+		assert.NoError(t, err)
+		if assert.Len(t, types, 1) {
+			assert.Equal(t, types[0].DesiredAgents, common.DesiredAgentsConfig{HeadroomPercent: 20, Max: 50})
+		}
+	})
+
+	t.Run("secret with invalid desired agents annotations -> agent type is returned without them", func(t *testing.T) {
+		c := dynamicfake.NewSimpleDynamicClient(newTestScheme(), []runtime.Object{
+			&corev1.Secret{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-type-1",
+					Namespace: "default",
+					Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+					Annotations: map[string]string{
+						AnnotationDesiredAgentsHeadroom: "20%",
+						AnnotationDesiredAgentsMax:      "fifty",
+					},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					"endpoint": []byte("testing.com"),
+					"token":    []byte("asdasdasd"),
+				},
+			},
+		}...)
+
+		f, _ := NewAgentTypeFinder(c, "default")
+		types, err := f.Find(context.Background())
+		assert.NoError(t, err)
+		if assert.Len(t, types, 1) {
+			assert.Equal(t, types[0].DesiredAgents, common.DesiredAgentsConfig{HeadroomPercent: 20, Invalid: true})
+		}
+	})
+
+	t.Run("secret with oauth2 auth scheme and no token -> agent type is returned", func(t *testing.T) {
+		c := dynamicfake.NewSimpleDynamicClient(newTestScheme(), []runtime.Object{
+			&corev1.Secret{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-type-1",
+					Namespace: "default",
+					Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					"endpoint":             []byte("testing.com"),
+					"auth_scheme":          []byte("oauth2"),
+					"oauth2_client_id":     []byte("id"),
+					"oauth2_client_secret": []byte("secret"),
+					"oauth2_token_url":     []byte("https://auth.testing.com/token"),
+				},
+			},
+		}...)
+
+		f, _ := NewAgentTypeFinder(c, "default")
+		types, err := f.Find(context.Background())
+		assert.NoError(t, err)
+		if assert.Len(t, types, 1) {
+			assert.Equal(t, types[0].Token, "")
+			assert.Equal(t, types[0].Auth, common.AuthConfig{
+				Scheme:       common.AuthSchemeOAuth2,
+				ClientID:     "id",
+				ClientSecret: "secret",
+				TokenURL:     "https://auth.testing.com/token",
+			})
+		}
+	})
+
+	t.Run("secret with token auth scheme and no token -> error", func(t *testing.T) {
+		c := dynamicfake.NewSimpleDynamicClient(newTestScheme(), []runtime.Object{
+			&corev1.Secret{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "agent-type-1",
+					Namespace: "default",
+					Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					"endpoint":    []byte("testing.com"),
+					"auth_scheme": []byte("bearer"),
+				},
+			},
+		}...)
+
+		f, _ := NewAgentTypeFinder(c, "default")
+		types, err := f.Find(context.Background())
+		assert.Error(t, err)
+		assert.Empty(t, types)
+	})
 }
 
 func newTestScheme() *runtime.Scheme {
@@ -111,5 +251,53 @@ func newTestScheme() *runtime.Scheme {
 		Kind:    "Secret",
 	}, &corev1.Secret{})
 
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "",
+		Version: "v1",
+		Kind:    "PodList",
+	}, &corev1.PodList{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "",
+		Version: "v1",
+		Kind:    "Pod",
+	}, &corev1.Pod{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "",
+		Version: "v1",
+		Kind:    "ConfigMapList",
+	}, &corev1.ConfigMapList{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "",
+		Version: "v1",
+		Kind:    "ConfigMap",
+	}, &corev1.ConfigMap{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "apps",
+		Version: "v1",
+		Kind:    "DeploymentList",
+	}, &appsv1.DeploymentList{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "apps",
+		Version: "v1",
+		Kind:    "Deployment",
+	}, &appsv1.Deployment{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "apps",
+		Version: "v1",
+		Kind:    "StatefulSetList",
+	}, &appsv1.StatefulSetList{})
+
+	s.AddKnownTypeWithName(schema.GroupVersionKind{
+		Group:   "apps",
+		Version: "v1",
+		Kind:    "StatefulSet",
+	}, &appsv1.StatefulSet{})
+
 	return s
 }
@@ -0,0 +1,29 @@
+package provider
+
+import (
+	"strings"
+)
+
+// For consumers that cannot use label selectors, the metrics for each agent type
+// can also be exposed with the agent type in the name, e.g. semaphore-s1-a-jobs_queued.
+const AgentTypeMetricPrefix = "semaphore-"
+
+func agentTypeMetricName(agentType, metricName string) string {
+	return AgentTypeMetricPrefix + agentType + "-" + metricName
+}
+
+// Metric names never have dashes, but agent type names can,
+// so the metric name is what comes after the last one.
+func parseAgentTypeMetricName(name string) (agentType, metricName string, ok bool) {
+	if !strings.HasPrefix(name, AgentTypeMetricPrefix) {
+		return "", "", false
+	}
+
+	rest := strings.TrimPrefix(name, AgentTypeMetricPrefix)
+	i := strings.LastIndex(rest, "-")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+
+	return rest[:i], rest[i+1:], true
+}
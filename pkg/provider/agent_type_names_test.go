@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__AgentTypeMetricNames(t *testing.T) {
+	t.Run("name with agent type", func(t *testing.T) {
+		assert.Equal(t, "semaphore-s1-a-jobs_queued", agentTypeMetricName("s1-a", "jobs_queued"))
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		agentType, metricName, ok := parseAgentTypeMetricName("semaphore-s1-a-jobs_queued")
+		assert.True(t, ok)
+		assert.Equal(t, "s1-a", agentType)
+		assert.Equal(t, "jobs_queued", metricName)
+
+		agentType, metricName, ok = parseAgentTypeMetricName("semaphore-s1.pool-b-jobs_total_forecast_5m")
+		assert.True(t, ok)
+		assert.Equal(t, "s1.pool-b", agentType)
+		assert.Equal(t, "jobs_total_forecast_5m", metricName)
+	})
+
+	t.Run("invalid names", func(t *testing.T) {
+		for _, name := range []string{
+			"jobs_queued",
+			"semaphore-jobs_queued",
+			"semaphore--jobs_queued",
+			"semaphore-s1-a-",
+			"other-s1-a-jobs_queued",
+		} {
+			_, _, ok := parseAgentTypeMetricName(name)
+			assert.False(t, ok, name)
+		}
+	})
+}
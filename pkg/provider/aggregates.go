@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Aggregated series have this label, with the name of the label
+// used to group agent types, e.g. aggregate=pool, or "all".
+const AggregateLabel = "aggregate"
+
+// Groups all agent types together, e.g. aggregate=all.
+const AggregateAll = "all"
+
+// Aggregator sums the metrics of agent types grouped by a label
+// on the agent type secrets, e.g. pool or team, or of all agent types,
+// and recalculates the ratios from the sums.
+type Aggregator struct {
+	groupBy []string
+}
+
+func NewAggregator(groupBy []string) (*Aggregator, error) {
+	for _, label := range groupBy {
+		if label == AggregateAll {
+			continue
+		}
+
+		if label == AggregateLabel || label == "agent_type" {
+			return nil, fmt.Errorf("invalid aggregate label '%s': reserved", label)
+		}
+
+		if errs := validation.IsQualifiedName(label); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid aggregate label '%s': %v", label, errs)
+		}
+	}
+
+	return &Aggregator{groupBy: groupBy}, nil
+}
+
+func (a *Aggregator) Generate(agentTypes []*common.AgentType, samples map[string]*common.Metrics) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	for _, label := range a.groupBy {
+		groups := map[string]*common.Metrics{}
+		seen := map[string]map[string]bool{}
+
+		for _, agentType := range agentTypes {
+			m, ok := samples[agentType.Name]
+			if !ok {
+				continue
+			}
+
+			group := AggregateAll
+			if label != AggregateAll {
+				v, ok := agentType.SecretLabels[label]
+				if !ok {
+					continue
+				}
+
+				group = v
+			}
+
+			// Secrets for the same agent type get the same metrics back,
+			// so they are only counted once.
+			if seen[group] == nil {
+				seen[group] = map[string]bool{}
+			}
+
+			source := sourceOf(agentType)
+			if seen[group][source] {
+				continue
+			}
+
+			seen[group][source] = true
+			groups[group] = sum(groups[group], m)
+		}
+
+		for _, group := range sortedGroups(groups) {
+			groupLabels := map[string]string{AggregateLabel: label}
+			if label != AggregateAll {
+				groupLabels[label] = group
+			}
+
+			values = append(values, groups[group].GenerateAll(groupLabels)...)
+		}
+	}
+
+	return values
+}
+
+func sum(total, m *common.Metrics) *common.Metrics {
+	if total == nil {
+		total = &common.Metrics{}
+	}
+
+	total.Agents.Idle += m.Agents.Idle
+	total.Agents.Occupied += m.Agents.Occupied
+	total.Jobs.Queued += m.Jobs.Queued
+	total.Jobs.Running += m.Jobs.Running
+	return total
+}
+
+func sortedGroups(groups map[string]*common.Metrics) []string {
+	keys := []string{}
+	for k := range groups {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Aggregated series are only returned when the selector asks for them,
+// so selectors that don't know about them, including an empty one,
+// don't count the same jobs twice.
+func selectsAggregates(metricSelector labels.Selector) bool {
+	requirements, _ := metricSelector.Requirements()
+	for _, requirement := range requirements {
+		if requirement.Key() == AggregateLabel {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAggregate(value external_metrics.ExternalMetricValue) bool {
+	_, ok := value.MetricLabels[AggregateLabel]
+	return ok
+}
@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func Test__Aggregator(t *testing.T) {
+	agentTypes := []*common.AgentType{
+		{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t1", SecretLabels: map[string]string{"pool": "arm64"}},
+		{Name: "s1-b", Endpoint: "a.semaphoreci.com", Token: "t2", SecretLabels: map[string]string{"pool": "arm64"}},
+		{Name: "s1-c", Endpoint: "a.semaphoreci.com", Token: "t3", SecretLabels: map[string]string{"pool": "amd64"}},
+		{Name: "s1-d", Endpoint: "a.semaphoreci.com", Token: "t4"},
+	}
+
+	samples := map[string]*common.Metrics{
+		"s1-a": {Agents: common.AgentMetrics{Idle: 1, Occupied: 1}, Jobs: common.JobMetrics{Queued: 2, Running: 1}},
+		"s1-b": {Agents: common.AgentMetrics{Idle: 0, Occupied: 3}, Jobs: common.JobMetrics{Queued: 4, Running: 3}},
+		"s1-c": {Agents: common.AgentMetrics{Idle: 5, Occupied: 0}},
+		"s1-d": {Agents: common.AgentMetrics{Idle: 0, Occupied: 1}, Jobs: common.JobMetrics{Running: 1}},
+	}
+
+	find := func(values []external_metrics.ExternalMetricValue, metricName string, l map[string]string) float64 {
+		snapshot := NewMetricSnapshot(filterByMetricName(values, metricName))
+		matches := snapshot.Select(labels.SelectorFromSet(l), true)
+		require.Len(t, matches, 1)
+		return matches[0].Value.AsApproximateFloat64()
+	}
+
+	t.Run("sums counts and recalculates ratios per group", func(t *testing.T) {
+		a, err := NewAggregator([]string{"pool"})
+		require.NoError(t, err)
+
+		values := a.Generate(agentTypes, samples)
+		arm64 := map[string]string{"aggregate": "pool", "pool": "arm64"}
+		assert.Equal(t, 6.0, find(values, common.MetricJobsQueued, arm64))
+		assert.Equal(t, 4.0, find(values, common.MetricAgentsOccupied, arm64))
+		assert.Equal(t, 0.8, find(values, common.MetricAgentsOccupiedRatio, arm64))
+		assert.Equal(t, 0.0, find(values, common.MetricAgentsOccupied, map[string]string{"aggregate": "pool", "pool": "amd64"}))
+
+		// agent types without the label are not part of any group
+		assert.Len(t, filterByMetricName(values, common.MetricJobsQueued), 2)
+		for _, v := range values {
+			assert.NotContains(t, v.MetricLabels, "agent_type")
+		}
+	})
+
+	t.Run("all agent types", func(t *testing.T) {
+		a, err := NewAggregator([]string{"all"})
+		require.NoError(t, err)
+
+		values := a.Generate(agentTypes, samples)
+		assert.Equal(t, 5.0, find(values, common.MetricJobsRunning, map[string]string{"aggregate": "all"}))
+		assert.Equal(t, 5.0, find(values, common.MetricAgentsOccupied, map[string]string{"aggregate": "all"}))
+	})
+
+	t.Run("agent types without samples are skipped", func(t *testing.T) {
+		a, err := NewAggregator([]string{"all"})
+		require.NoError(t, err)
+
+		values := a.Generate(agentTypes, map[string]*common.Metrics{"s1-c": samples["s1-c"]})
+		assert.Equal(t, 5.0, find(values, common.MetricAgentsIdle, map[string]string{"aggregate": "all"}))
+	})
+
+	t.Run("secrets for the same agent type are counted once", func(t *testing.T) {
+		a, err := NewAggregator([]string{"all"})
+		require.NoError(t, err)
+
+		duplicated := append(agentTypes, &common.AgentType{Name: "s1-a-copy", Endpoint: "a.semaphoreci.com", Token: "t1"})
+		withCopy := map[string]*common.Metrics{"s1-a-copy": samples["s1-a"]}
+		for k, v := range samples {
+			withCopy[k] = v
+		}
+
+		values := a.Generate(duplicated, withCopy)
+		assert.Equal(t, 6.0, find(values, common.MetricJobsQueued, map[string]string{"aggregate": "all"}))
+	})
+
+	t.Run("invalid labels -> error", func(t *testing.T) {
+		_, err := NewAggregator([]string{"agent_type"})
+		assert.ErrorContains(t, err, "reserved")
+		_, err = NewAggregator([]string{"aggregate"})
+		assert.ErrorContains(t, err, "reserved")
+		_, err = NewAggregator([]string{"not a label"})
+		assert.ErrorContains(t, err, "invalid aggregate label")
+	})
+}
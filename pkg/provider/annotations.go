@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Annotations on the agent type secrets used to configure how metrics are calculated.
+const (
+	AnnotationDesiredAgentsHeadroom = "semaphore-agent/desired-agents-headroom"
+	AnnotationDesiredAgentsMin      = "semaphore-agent/desired-agents-min"
+	AnnotationDesiredAgentsMax      = "semaphore-agent/desired-agents-max"
+	AnnotationSchedules             = "semaphore-agent/schedules"
+	AnnotationAllowedNamespaces     = "semaphore-agent/allowed-namespaces"
+)
+
+// Each annotation is parsed on its own, so an invalid one does not discard the valid ones.
+// Invalid headroom and minimum are left out, but without a valid maximum, the desired number
+// of agents is not calculated at all, since it could go over the limit the maximum is for.
+// The config is always returned, along with an error for the annotations left out.
+func parseDesiredAgentsConfig(annotations map[string]string) (*common.DesiredAgentsConfig, error) {
+	config := common.DesiredAgentsConfig{}
+	errs := []string{}
+
+	if headroom, ok := annotations[AnnotationDesiredAgentsHeadroom]; ok {
+		if strings.HasSuffix(headroom, "%") {
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(headroom, "%"), 64)
+			if err != nil || percent < 0 {
+				errs = append(errs, fmt.Sprintf("invalid %s annotation '%s': must be a non-negative number or percentage", AnnotationDesiredAgentsHeadroom, headroom))
+			} else {
+				config.HeadroomPercent = percent
+			}
+		} else {
+			count, err := strconv.Atoi(headroom)
+			if err != nil || count < 0 {
+				errs = append(errs, fmt.Sprintf("invalid %s annotation '%s': must be a non-negative number or percentage", AnnotationDesiredAgentsHeadroom, headroom))
+			} else {
+				config.HeadroomCount = count
+			}
+		}
+	}
+
+	min, err := parseNonNegativeIntAnnotation(annotations, AnnotationDesiredAgentsMin)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	max, err := parseNonNegativeIntAnnotation(annotations, AnnotationDesiredAgentsMax)
+	if err != nil {
+		errs = append(errs, err.Error())
+		config.Invalid = true
+	}
+
+	if max > 0 && max < min {
+		errs = append(errs, fmt.Sprintf("%s annotation (%d) must not be lower than %s annotation (%d)", AnnotationDesiredAgentsMax, max, AnnotationDesiredAgentsMin, min))
+		config.Invalid = true
+	}
+
+	config.Min = min
+	config.Max = max
+	if len(errs) > 0 {
+		return &config, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return &config, nil
+}
+
+func parseNonNegativeIntAnnotation(annotations map[string]string, annotation string) (int, error) {
+	v, ok := annotations[annotation]
+	if !ok {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s annotation '%s': must be a non-negative number", annotation, v)
+	}
+
+	return i, nil
+}
+
+func parseSchedules(annotations map[string]string) (common.Schedules, error) {
+	v, ok := annotations[AnnotationSchedules]
+	if !ok {
+		return common.Schedules{}, nil
+	}
+
+	schedules, err := common.ParseSchedules(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", AnnotationSchedules, err)
+	}
+
+	return schedules, nil
+}
+
+// The metrics for an agent type can be read from the namespace of its secret,
+// and from the namespaces listed in the annotation, comma-separated, or "*" for all of them.
+func parseNamespaces(namespace string, annotations map[string]string) ([]string, error) {
+	namespaces := []string{namespace}
+
+	v, ok := annotations[AnnotationAllowedNamespaces]
+	if !ok {
+		return namespaces, nil
+	}
+
+	for _, n := range strings.Split(v, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		if n != common.AllNamespaces {
+			if errs := validation.IsDNS1123Label(n); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid %s annotation: invalid namespace '%s': %v", AnnotationAllowedNamespaces, n, errs)
+			}
+		}
+
+		namespaces = append(namespaces, n)
+	}
+
+	return namespaces, nil
+}
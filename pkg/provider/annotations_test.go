@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__ParseDesiredAgentsConfig(t *testing.T) {
+	t.Run("no annotations -> defaults", func(t *testing.T) {
+		c, err := parseDesiredAgentsConfig(map[string]string{})
+		assert.NoError(t, err)
+		assert.Equal(t, &common.DesiredAgentsConfig{}, c)
+	})
+
+	t.Run("fixed headroom", func(t *testing.T) {
+		c, err := parseDesiredAgentsConfig(map[string]string{
+			AnnotationDesiredAgentsHeadroom: "3",
+			AnnotationDesiredAgentsMin:      "1",
+			AnnotationDesiredAgentsMax:      "20",
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, &common.DesiredAgentsConfig{HeadroomCount: 3, Min: 1, Max: 20}, c)
+	})
+
+	t.Run("percentage headroom", func(t *testing.T) {
+		c, err := parseDesiredAgentsConfig(map[string]string{AnnotationDesiredAgentsHeadroom: "12.5%"})
+		assert.NoError(t, err)
+		assert.Equal(t, &common.DesiredAgentsConfig{HeadroomPercent: 12.5}, c)
+	})
+
+	t.Run("invalid values -> error", func(t *testing.T) {
+		for _, annotations := range []map[string]string{
+			{AnnotationDesiredAgentsHeadroom: "a lot"},
+			{AnnotationDesiredAgentsHeadroom: "-1"},
+			{AnnotationDesiredAgentsHeadroom: "-10%"},
+			{AnnotationDesiredAgentsMin: "1.5"},
+			{AnnotationDesiredAgentsMax: "-2"},
+			{AnnotationDesiredAgentsMin: "10", AnnotationDesiredAgentsMax: "5"},
+		} {
+			_, err := parseDesiredAgentsConfig(annotations)
+			assert.Error(t, err, "%v", annotations)
+		}
+	})
+
+	t.Run("invalid headroom or min -> valid annotations are kept", func(t *testing.T) {
+		c, err := parseDesiredAgentsConfig(map[string]string{
+			AnnotationDesiredAgentsHeadroom: "a lot",
+			AnnotationDesiredAgentsMin:      "1.5",
+			AnnotationDesiredAgentsMax:      "20",
+		})
+
+		assert.ErrorContains(t, err, "invalid semaphore-agent/desired-agents-headroom annotation 'a lot'")
+		assert.ErrorContains(t, err, "invalid semaphore-agent/desired-agents-min annotation '1.5'")
+		assert.Equal(t, &common.DesiredAgentsConfig{Max: 20}, c)
+	})
+
+	t.Run("invalid max -> invalid config", func(t *testing.T) {
+		for _, annotations := range []map[string]string{
+			{AnnotationDesiredAgentsHeadroom: "3", AnnotationDesiredAgentsMax: "-2"},
+			{AnnotationDesiredAgentsHeadroom: "3", AnnotationDesiredAgentsMin: "10", AnnotationDesiredAgentsMax: "5"},
+		} {
+			c, err := parseDesiredAgentsConfig(annotations)
+			assert.Error(t, err, "%v", annotations)
+			assert.True(t, c.Invalid, "%v", annotations)
+			assert.Equal(t, 3, c.HeadroomCount, "%v", annotations)
+		}
+	})
+}
+
+func Test__ParseSchedules(t *testing.T) {
+	t.Run("no annotation -> no schedules", func(t *testing.T) {
+		schedules, err := parseSchedules(map[string]string{})
+		assert.NoError(t, err)
+		assert.Empty(t, schedules)
+	})
+
+	t.Run("schedules", func(t *testing.T) {
+		schedules, err := parseSchedules(map[string]string{AnnotationSchedules: "mon-fri 08:00-18:00 Europe/Berlin min=20"})
+		assert.NoError(t, err)
+		assert.Len(t, schedules, 1)
+	})
+
+	t.Run("invalid schedules -> error", func(t *testing.T) {
+		_, err := parseSchedules(map[string]string{AnnotationSchedules: "mon-fri 08:00-18:00 Nowhere min=20"})
+		assert.ErrorContains(t, err, "invalid semaphore-agent/schedules annotation")
+	})
+}
+
+func Test__ParseNamespaces(t *testing.T) {
+	t.Run("no annotation -> secret namespace", func(t *testing.T) {
+		namespaces, err := parseNamespaces("default", map[string]string{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"default"}, namespaces)
+	})
+
+	t.Run("extra namespaces", func(t *testing.T) {
+		namespaces, err := parseNamespaces("default", map[string]string{AnnotationAllowedNamespaces: "team-a, team-b,"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"default", "team-a", "team-b"}, namespaces)
+	})
+
+	t.Run("all namespaces", func(t *testing.T) {
+		namespaces, err := parseNamespaces("default", map[string]string{AnnotationAllowedNamespaces: "*"})
+		assert.NoError(t, err)
+
+		agentType := common.AgentType{Namespaces: namespaces}
+		assert.True(t, agentType.VisibleIn("anything"))
+	})
+
+	t.Run("invalid namespace -> error", func(t *testing.T) {
+		_, err := parseNamespaces("default", map[string]string{AnnotationAllowedNamespaces: "team_a"})
+		assert.ErrorContains(t, err, "invalid semaphore-agent/allowed-namespaces annotation")
+	})
+}
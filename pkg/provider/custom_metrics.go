@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// The Semaphore metrics are also attached to the workloads
+// annotated with an agent type, for Object metrics in HPAs.
+func (p *SemaphoreMetricsProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	list := []provider.CustomMetricInfo{}
+	if p.workloads == nil {
+		return list
+	}
+
+	for _, m := range p.currentRegistry().Names() {
+		for _, resource := range WorkloadResources {
+			list = append(list, provider.CustomMetricInfo{
+				GroupResource: resource,
+				Namespaced:    true,
+				Metric:        p.config.SemaphoreMetricPrefix + m,
+			})
+		}
+	}
+
+	return list
+}
+
+func (p *SemaphoreMetricsProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "SemaphoreMetricsProvider.GetMetricByName", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("metric", info.Metric),
+		attribute.String("resource", info.GroupResource.String()),
+		attribute.String("namespace", name.Namespace),
+		attribute.String("name", name.Name),
+		attribute.String("selector", metricSelector.String()),
+	)
+
+	if p.workloads == nil || !p.workloads.Supports(info.GroupResource) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	snapshot := p.currentSnapshot()
+	if snapshot == nil {
+		return nil, newNotCollectedYetError()
+	}
+
+	workload, err := p.workloads.Get(ctx, info.GroupResource, name)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if workload == nil {
+		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+	}
+
+	value, denied := p.customMetricValue(snapshot, workload, info.Metric, metricSelector)
+	if denied && p.config.DeniedNamespaceResponse == DeniedNamespaceForbidden {
+		return nil, newNamespaceForbiddenError(info.GroupResource, info.Metric, name.Namespace)
+	}
+
+	if value == nil {
+		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+	}
+
+	return value, nil
+}
+
+func (p *SemaphoreMetricsProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "SemaphoreMetricsProvider.GetMetricBySelector", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("metric", info.Metric),
+		attribute.String("resource", info.GroupResource.String()),
+		attribute.String("namespace", namespace),
+		attribute.String("selector", selector.String()),
+		attribute.String("metric_selector", metricSelector.String()),
+	)
+
+	if p.workloads == nil || !p.workloads.Supports(info.GroupResource) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	// All workloads get values from the same snapshot.
+	snapshot := p.currentSnapshot()
+	if snapshot == nil {
+		return nil, newNotCollectedYetError()
+	}
+
+	workloads, err := p.workloads.List(ctx, info.GroupResource, namespace, selector)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	items := []custom_metrics.MetricValue{}
+	denied := 0
+	for _, workload := range workloads {
+		value, d := p.customMetricValue(snapshot, workload, info.Metric, metricSelector)
+		if d {
+			denied++
+		}
+
+		if value != nil {
+			items = append(items, *value)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("denied", denied))
+	if len(items) == 0 && denied > 0 && p.config.DeniedNamespaceResponse == DeniedNamespaceForbidden {
+		return nil, newNamespaceForbiddenError(info.GroupResource, info.Metric, namespace)
+	}
+
+	span.SetAttributes(attribute.Int("items", len(items)))
+	return &custom_metrics.MetricValueList{Items: items}, nil
+}
+
+// The value of a metric for the agent type of a workload, or nil if there is none,
+// and whether it was left out because the agent type is not visible in the workload namespace.
+// For metrics with more than one value per agent type, e.g. jobs_queued_duration_seconds,
+// the metric selector picks one, and the first one is used if it doesn't.
+func (p *SemaphoreMetricsProvider) customMetricValue(snapshot *Snapshot, workload *Workload, name string, metricSelector labels.Selector) (*custom_metrics.MetricValue, bool) {
+	metricName, ok := p.semaphoreMetricName(name)
+	if !ok {
+		return nil, false
+	}
+
+	m, ok := snapshot.Metric(metricName)
+	if !ok {
+		return nil, false
+	}
+
+	values := m.SelectFor(workload.AgentType, metricSelector)
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	if !snapshot.visibility.Allows(values[0], workload.Object.Namespace) {
+		return nil, true
+	}
+
+	return toCustomMetricValue(workload, name, values[0]), false
+}
+
+func toCustomMetricValue(workload *Workload, name string, value metrics.ExternalMetricValue) *custom_metrics.MetricValue {
+	return &custom_metrics.MetricValue{
+		DescribedObject: workload.Object,
+		Metric:          custom_metrics.MetricIdentifier{Name: name},
+		Timestamp:       value.Timestamp,
+		WindowSeconds:   value.WindowSeconds,
+		Value:           value.Value,
+	}
+}
@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/expression"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Key in the ConfigMap holding the derived metric definitions.
+const DerivedMetricsKey = "metrics.yaml"
+
+var derivedMetricNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// DerivedMetricSpec is how a derived metric is defined in the ConfigMap, e.g.:
+//
+//   - name: spare_capacity
+//     expr: agents_idle - jobs_queued
+//     min: 0
+type DerivedMetricSpec struct {
+	Name        string   `json:"name"`
+	Expr        string   `json:"expr"`
+	Description string   `json:"description,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+}
+
+// DerivedMetric is a metric calculated from the other metrics for an agent type.
+type DerivedMetric struct {
+	spec       DerivedMetricSpec
+	expression *expression.Expression
+}
+
+func (d *DerivedMetric) Name() string {
+	return d.spec.Name
+}
+
+func (d *DerivedMetric) Definition() common.MetricDefinition {
+	description := d.spec.Description
+	if description == "" {
+		description = fmt.Sprintf("`%s`", d.spec.Expr)
+	}
+
+	return common.MetricDefinition{
+		Name:        d.spec.Name,
+		Description: description,
+		Unit:        d.spec.Unit,
+	}
+}
+
+// Missing returns the variables in the expression without a value.
+// Metrics like the moving averages and the forecast error only have values
+// after a few samples, so derived metrics using them are not available until then.
+func (d *DerivedMetric) Missing(variables map[string]float64) []string {
+	missing := []string{}
+	for _, name := range d.expression.Variables() {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// Evaluate calculates the value with the other metrics for an agent type,
+// clamped between the bounds, if any.
+func (d *DerivedMetric) Evaluate(variables map[string]float64) (float64, error) {
+	v, err := d.expression.Evaluate(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	if d.spec.Min != nil {
+		v = math.Max(v, *d.spec.Min)
+	}
+
+	if d.spec.Max != nil {
+		v = math.Min(v, *d.spec.Max)
+	}
+
+	return v, nil
+}
+
+// ParseDerivedMetrics parses and validates the derived metric definitions.
+// Expressions can only use the variables given, and names
+// cannot be the same as the ones for other metrics.
+func ParseDerivedMetrics(content string, variables, reserved map[string]bool) ([]*DerivedMetric, error) {
+	specs := []DerivedMetricSpec{}
+	if err := yaml.UnmarshalStrict([]byte(content), &specs); err != nil {
+		return nil, fmt.Errorf("error parsing derived metrics: %v", err)
+	}
+
+	metrics := []*DerivedMetric{}
+	names := map[string]bool{}
+	for _, spec := range specs {
+		if !derivedMetricNameRegex.MatchString(spec.Name) {
+			return nil, fmt.Errorf("invalid derived metric name '%s'", spec.Name)
+		}
+
+		if reserved[spec.Name] || names[spec.Name] {
+			return nil, fmt.Errorf("derived metric '%s' is already defined", spec.Name)
+		}
+
+		e, err := expression.Parse(spec.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression for derived metric '%s': %v", spec.Name, err)
+		}
+
+		for _, name := range e.Variables() {
+			if !variables[name] {
+				return nil, fmt.Errorf("invalid expression for derived metric '%s': unknown metric '%s'", spec.Name, name)
+			}
+		}
+
+		if spec.Min != nil && spec.Max != nil && *spec.Min > *spec.Max {
+			return nil, fmt.Errorf("invalid bounds for derived metric '%s': min is greater than max", spec.Name)
+		}
+
+		names[spec.Name] = true
+		metrics = append(metrics, &DerivedMetric{spec: spec, expression: e})
+	}
+
+	return metrics, nil
+}
+
+// DerivedMetricsLoader reads the derived metric definitions from a ConfigMap,
+// and reloads them when the ConfigMap changes.
+type DerivedMetricsLoader struct {
+	configMaps dynamic.ResourceInterface
+	name       string
+	variables  map[string]bool
+	reserved   map[string]bool
+
+	resourceVersion string
+	metrics         []*DerivedMetric
+}
+
+func NewDerivedMetricsLoader(client dynamic.Interface, namespace, name string, variables, reserved map[string]bool) *DerivedMetricsLoader {
+	configMaps := client.
+		Resource(schema.GroupVersionResource{
+			Group:    "",
+			Version:  "v1",
+			Resource: "configmaps",
+		}).
+		Namespace(namespace)
+
+	return &DerivedMetricsLoader{
+		configMaps: configMaps,
+		name:       name,
+		variables:  variables,
+		reserved:   reserved,
+		metrics:    []*DerivedMetric{},
+	}
+}
+
+// Load returns the current derived metrics, and whether they changed since the last load.
+// If the ConfigMap does not exist, there are no derived metrics.
+// If the new definitions are not valid, the previous ones are kept.
+func (l *DerivedMetricsLoader) Load(ctx context.Context) (metrics []*DerivedMetric, changed bool, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "DerivedMetricsLoader.Load")
+	span.SetAttributes(attribute.String("configmap", l.name))
+	defer func() { tracing.End(span, err) }()
+
+	o, err := l.configMaps.Get(ctx, l.name, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		changed = l.resourceVersion != ""
+		l.resourceVersion = ""
+		l.metrics = []*DerivedMetric{}
+		return l.metrics, changed, nil
+	}
+
+	if err != nil {
+		return l.metrics, false, fmt.Errorf("error describing configmap: %v", err)
+	}
+
+	if o.GetResourceVersion() == l.resourceVersion {
+		return l.metrics, false, nil
+	}
+
+	// Even if the new definitions are invalid, we don't need to look at them again until they change.
+	l.resourceVersion = o.GetResourceVersion()
+
+	content, _, err := unstructured.NestedString(o.Object, "data", DerivedMetricsKey)
+	if err != nil {
+		return l.metrics, false, fmt.Errorf("error reading configmap: %v", err)
+	}
+
+	metrics, err = ParseDerivedMetrics(content, l.variables, l.reserved)
+	if err != nil {
+		return l.metrics, false, err
+	}
+
+	klog.Infof("Loaded %d derived metrics from configmap %s", len(metrics), l.name)
+	l.metrics = metrics
+	return l.metrics, true, nil
+}
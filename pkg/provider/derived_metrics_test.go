@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func Test__ParseDerivedMetrics(t *testing.T) {
+	variables := map[string]bool{"agents_idle": true, "jobs_queued": true}
+	reserved := map[string]bool{"agents_idle": true, "jobs_queued": true, "agents_by_version": true}
+
+	t.Run("valid definitions", func(t *testing.T) {
+		metrics, err := ParseDerivedMetrics(`
+- name: spare_capacity
+  expr: agents_idle - jobs_queued
+  min: 0
+  max: 10
+- name: queued_per_idle
+  expr: jobs_queued / max(agents_idle, 1)
+  unit: ratio
+  description: Queued jobs per idle agent.
+`, variables, reserved)
+
+		require.NoError(t, err)
+		require.Len(t, metrics, 2)
+		assert.Equal(t, "spare_capacity", metrics[0].Name())
+		assert.Equal(t, "`agents_idle - jobs_queued`", metrics[0].Definition().Description)
+		assert.Equal(t, "Queued jobs per idle agent.", metrics[1].Definition().Description)
+		assert.Equal(t, "ratio", metrics[1].Definition().Unit)
+
+		v, err := metrics[0].Evaluate(map[string]float64{"agents_idle": 1, "jobs_queued": 5})
+		require.NoError(t, err)
+		assert.Equal(t, 0.0, v)
+
+		v, err = metrics[0].Evaluate(map[string]float64{"agents_idle": 20, "jobs_queued": 5})
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, v)
+
+		v, err = metrics[1].Evaluate(map[string]float64{"agents_idle": 0, "jobs_queued": 5})
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, v)
+	})
+
+	t.Run("empty -> no metrics", func(t *testing.T) {
+		metrics, err := ParseDerivedMetrics("", variables, reserved)
+		require.NoError(t, err)
+		assert.Empty(t, metrics)
+	})
+
+	testCases := map[string]string{
+		"- name: a\n  expr: 1\n  bogus: 1":                   "error parsing derived metrics",
+		"- name: Bad-Name\n  expr: 1":                        "invalid derived metric name 'Bad-Name'",
+		"- name: agents_idle\n  expr: 1":                     "derived metric 'agents_idle' is already defined",
+		"- name: a\n  expr: 1\n- name: a\n  expr: 2":         "derived metric 'a' is already defined",
+		"- name: a\n  expr: agents_idle +":                   "invalid expression for derived metric 'a'",
+		"- name: a\n  expr: agents_by_version":               "unknown metric 'agents_by_version'",
+		"- name: a\n  expr: does_not_exist":                  "unknown metric 'does_not_exist'",
+		"- name: a\n  expr: jobs_queued\n  min: 5\n  max: 1": "min is greater than max",
+	}
+
+	for content, expected := range testCases {
+		t.Run(expected+" -> error", func(t *testing.T) {
+			_, err := ParseDerivedMetrics(content, variables, reserved)
+			assert.ErrorContains(t, err, expected)
+		})
+	}
+}
+
+func Test__DerivedMetricsLoader(t *testing.T) {
+	variables := map[string]bool{"agents_idle": true, "jobs_queued": true}
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme())
+	loader := NewDerivedMetricsLoader(client, "default", "derived-metrics", variables, map[string]bool{})
+
+	t.Run("no configmap -> no metrics", func(t *testing.T) {
+		metrics, changed, err := loader.Load(context.Background())
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Empty(t, metrics)
+	})
+
+	t.Run("configmap created -> metrics loaded", func(t *testing.T) {
+		o := toUnstructured(t, newDerivedMetricsConfigMap("1", "- name: spare\n  expr: agents_idle - jobs_queued"))
+		_, err := client.Resource(gvr).Namespace("default").Create(context.Background(), o, v1.CreateOptions{})
+		require.NoError(t, err)
+
+		metrics, changed, err := loader.Load(context.Background())
+		require.NoError(t, err)
+		assert.True(t, changed)
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "spare", metrics[0].Name())
+	})
+
+	t.Run("configmap did not change -> not changed", func(t *testing.T) {
+		metrics, changed, err := loader.Load(context.Background())
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Len(t, metrics, 1)
+	})
+
+	t.Run("invalid definitions -> previous ones are kept", func(t *testing.T) {
+		o := toUnstructured(t, newDerivedMetricsConfigMap("2", "- name: spare\n  expr: does_not_exist"))
+		_, err := client.Resource(gvr).Namespace("default").Update(context.Background(), o, v1.UpdateOptions{})
+		require.NoError(t, err)
+
+		metrics, changed, err := loader.Load(context.Background())
+		assert.ErrorContains(t, err, "unknown metric 'does_not_exist'")
+		assert.False(t, changed)
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "spare", metrics[0].Name())
+	})
+
+	t.Run("configmap updated -> metrics reloaded", func(t *testing.T) {
+		o := toUnstructured(t, newDerivedMetricsConfigMap("3", "- name: other\n  expr: jobs_queued * 2"))
+		_, err := client.Resource(gvr).Namespace("default").Update(context.Background(), o, v1.UpdateOptions{})
+		require.NoError(t, err)
+
+		metrics, changed, err := loader.Load(context.Background())
+		require.NoError(t, err)
+		assert.True(t, changed)
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "other", metrics[0].Name())
+	})
+
+	t.Run("configmap deleted -> no metrics", func(t *testing.T) {
+		err := client.Resource(gvr).Namespace("default").Delete(context.Background(), "derived-metrics", v1.DeleteOptions{})
+		require.NoError(t, err)
+
+		metrics, changed, err := loader.Load(context.Background())
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Empty(t, metrics)
+	})
+}
+
+func newDerivedMetricsConfigMap(resourceVersion, content string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "derived-metrics",
+			Namespace:       "default",
+			ResourceVersion: resourceVersion,
+		},
+		Data: map[string]string{DerivedMetricsKey: content},
+	}
+}
+
+func toUnstructured(t *testing.T, o runtime.Object) *unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o)
+	require.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// Errors returned from the external metrics API end up in the HPA events and conditions,
+// so they should tell users what is wrong with their HPA or agent type secrets.
+
+func newNotFoundError(format string, args ...interface{}) error {
+	return &apierrors.StatusError{ErrStatus: v1.Status{
+		Status:  v1.StatusFailure,
+		Code:    http.StatusNotFound,
+		Reason:  v1.StatusReasonNotFound,
+		Message: fmt.Sprintf(format, args...),
+	}}
+}
+
+func newNotCollectedYetError() error {
+	return apierrors.NewServiceUnavailable(fmt.Sprintf("metrics have not been collected yet, try again in %v", CollectInterval))
+}
+
+// Semaphore metrics are in the registry without the prefix they are exposed with.
+func newUnknownMetricError(registry *common.Registry, prefix, metricName string) error {
+	if _, ok := registry.Get(strings.TrimPrefix(metricName, prefix)); ok && strings.HasPrefix(metricName, prefix) {
+		return newNotFoundError("metric %s is disabled with --disable-metrics", metricName)
+	}
+
+	return newNotFoundError("unknown metric %s, see the adapter documentation or --list-metrics for the available metrics", metricName)
+}
+
+// The labels the values for a Semaphore metric can have.
+func supportedLabels(registry *common.Registry, aggregateBy []string, metricName string) map[string]bool {
+	supported := map[string]bool{"agent_type": true}
+	if definition, ok := registry.Get(metricName); ok {
+		for _, label := range definition.Labels {
+			supported[label] = true
+		}
+	}
+
+	if len(aggregateBy) > 0 {
+		supported[AggregateLabel] = true
+		for _, label := range aggregateBy {
+			if label != AggregateAll {
+				supported[label] = true
+			}
+		}
+	}
+
+	return supported
+}
+
+// Selectors can only use the labels the values for a metric have.
+func validateSelector(supported map[string]bool, aggregateBy []string, metricName string, selector labels.Selector) error {
+	requirements, selectable := selector.Requirements()
+	if !selectable {
+		return apierrors.NewBadRequest(fmt.Sprintf("selector %s cannot be used to select values for metric %s", selector.String(), metricName))
+	}
+
+	for _, r := range requirements {
+		if !supported[r.Key()] {
+			return apierrors.NewBadRequest(fmt.Sprintf("label %s is not supported in selectors for metric %s, use one of: %s", r.Key(), metricName, strings.Join(sortedKeys(supported), ", ")))
+		}
+
+		if r.Key() == AggregateLabel && len(aggregateBy) > 0 {
+			for _, value := range r.Values().List() {
+				if !contains(aggregateBy, value) {
+					return apierrors.NewBadRequest(fmt.Sprintf("agent types are not aggregated by %s, use one of: %s", value, strings.Join(aggregateBy, ", ")))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// No values matched the selector, because the agent type it asks for does not exist,
+// there are no agent types at all, or the agent types have no values for the metric yet.
+func newNoValuesError(metricName string, selector labels.Selector, agentTypes []string) error {
+	if len(agentTypes) == 0 {
+		return newNotFoundError("no agent types found, agent type secrets need the semaphore-agent/autoscaled=true label")
+	}
+
+	if name, ok := selectedAgentType(selector); ok && !contains(agentTypes, name) {
+		return newNotFoundError("agent type %s not found, use one of: %s", name, strings.Join(agentTypes, ", "))
+	}
+
+	if selector.Empty() {
+		return newNotFoundError("no values for metric %s yet", metricName)
+	}
+
+	return newNotFoundError("no values for metric %s match selector %s", metricName, selector.String())
+}
+
+// The agent type a selector asks for with agent_type=<name>, if it does.
+func selectedAgentType(selector labels.Selector) (string, bool) {
+	requirements, _ := selector.Requirements()
+	for _, r := range requirements {
+		if r.Key() != "agent_type" || r.Values().Len() != 1 {
+			continue
+		}
+
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			return r.Values().List()[0], true
+		}
+	}
+
+	return "", false
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func Test__ValidateSelector(t *testing.T) {
+	registry, err := NewRegistry(Config{})
+	require.NoError(t, err)
+
+	validate := func(aggregateBy []string, metricName, selector string) error {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		return validateSelector(supportedLabels(registry, aggregateBy, metricName), aggregateBy, metricName, s)
+	}
+
+	t.Run("agent_type is always supported", func(t *testing.T) {
+		assert.NoError(t, validate([]string{}, common.MetricJobsQueued, ""))
+		assert.NoError(t, validate([]string{}, common.MetricJobsQueued, "agent_type=s1-a"))
+		assert.NoError(t, validate([]string{}, common.MetricJobsQueued, "agent_type notin (s1-a)"))
+	})
+
+	t.Run("labels of the metric are supported", func(t *testing.T) {
+		assert.NoError(t, validate([]string{}, MetricJobsQueuedDuration, "threshold=5"))
+		assert.True(t, apierrors.IsBadRequest(validate([]string{}, common.MetricJobsQueued, "threshold=5")))
+	})
+
+	t.Run("aggregate labels are supported if configured", func(t *testing.T) {
+		assert.NoError(t, validate([]string{"pool", "all"}, common.MetricJobsQueued, "aggregate=pool,pool=arm64"))
+		assert.NoError(t, validate([]string{"pool", "all"}, common.MetricJobsQueued, "aggregate=all"))
+		assert.True(t, apierrors.IsBadRequest(validate([]string{"pool"}, common.MetricJobsQueued, "aggregate=team")))
+		assert.True(t, apierrors.IsBadRequest(validate([]string{}, common.MetricJobsQueued, "pool=arm64")))
+	})
+}
+
+func Test__NoValuesError(t *testing.T) {
+	noValues := func(selector string, agentTypes []string) error {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		return newNoValuesError(common.MetricJobsQueued, s, agentTypes)
+	}
+
+	t.Run("no agent types", func(t *testing.T) {
+		err := noValues("", []string{})
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "semaphore-agent/autoscaled=true")
+	})
+
+	t.Run("unknown agent type", func(t *testing.T) {
+		assert.ErrorContains(t, noValues("agent_type=s1-c", []string{"s1-a", "s1-b"}), "agent type s1-c not found, use one of: s1-a, s1-b")
+		assert.ErrorContains(t, noValues("agent_type in (s1-c)", []string{"s1-a"}), "agent type s1-c not found")
+	})
+
+	t.Run("known agent types without values", func(t *testing.T) {
+		assert.ErrorContains(t, noValues("", []string{"s1-a"}), "no values for metric jobs_queued yet")
+		assert.ErrorContains(t, noValues("agent_type notin (s1-a)", []string{"s1-a"}), "no values for metric jobs_queued match selector agent_type notin (s1-a)")
+	})
+}
@@ -0,0 +1,197 @@
+package provider
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Metrics that are smoothed with exponentially weighted moving averages.
+var SmoothedMetrics = []string{
+	common.MetricJobsQueued,
+	common.MetricJobsRunning,
+	common.MetricJobsTotal,
+	common.MetricAgentsOccupied,
+}
+
+// EWMA is an exponentially weighted moving average over a time window.
+// Samples don't need to be evenly spaced: the weight of a new sample
+// depends on how much time passed since the previous one,
+// so a missed collection cycle doesn't skew the average.
+type EWMA struct {
+	window time.Duration
+	value  float64
+	last   time.Time
+}
+
+func NewEWMA(window time.Duration) *EWMA {
+	return &EWMA{window: window}
+}
+
+func (e *EWMA) Update(value float64, at time.Time) {
+	if e.last.IsZero() {
+		e.value = value
+		e.last = at
+		return
+	}
+
+	elapsed := at.Sub(e.last)
+	if elapsed <= 0 {
+		return
+	}
+
+	alpha := 1 - math.Exp(-elapsed.Seconds()/e.window.Seconds())
+	e.value += alpha * (value - e.value)
+	e.last = at
+}
+
+func (e *EWMA) Value() float64 {
+	return e.value
+}
+
+// Smoother keeps EWMAs for each agent type, for every smoothed metric and window.
+type Smoother struct {
+	windows  []time.Duration
+	averages map[string]map[string]*EWMA
+}
+
+func NewSmoother(windows []time.Duration) *Smoother {
+	return &Smoother{
+		windows:  windows,
+		averages: map[string]map[string]*EWMA{},
+	}
+}
+
+// MetricNames returns the names of all the smoothed metrics, e.g. jobs_queued_avg_5m.
+func (s *Smoother) MetricNames() []string {
+	names := []string{}
+	for _, metricName := range SmoothedMetrics {
+		for _, window := range s.windows {
+			names = append(names, smoothedMetricName(metricName, window))
+		}
+	}
+
+	return names
+}
+
+func (s *Smoother) Definitions() []common.MetricDefinition {
+	definitions := []common.MetricDefinition{}
+	for _, metricName := range SmoothedMetrics {
+		for _, window := range s.windows {
+			definitions = append(definitions, common.MetricDefinition{
+				Name:        smoothedMetricName(metricName, window),
+				Description: fmt.Sprintf("Exponentially weighted moving average of `%s` over %s.", metricName, formatWindow(window)),
+				Unit:        unitOf(metricName),
+			})
+		}
+	}
+
+	return definitions
+}
+
+// Record updates the averages for an agent type with a new sample.
+func (s *Smoother) Record(agentType string, m *common.Metrics, at time.Time) {
+	averages, ok := s.averages[agentType]
+	if !ok {
+		averages = map[string]*EWMA{}
+		s.averages[agentType] = averages
+	}
+
+	for _, metricName := range SmoothedMetrics {
+		for _, window := range s.windows {
+			name := smoothedMetricName(metricName, window)
+			average, ok := averages[name]
+			if !ok {
+				average = NewEWMA(window)
+				averages[name] = average
+			}
+
+			average.Update(m.Calc(metricName), at)
+		}
+	}
+}
+
+// Generate returns the current averages for an agent type.
+func (s *Smoother) Generate(agentType string, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	averages, ok := s.averages[agentType]
+	if !ok {
+		return values
+	}
+
+	for _, name := range s.MetricNames() {
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   name,
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(averages[name].Value()),
+			MetricLabels: labels,
+		})
+	}
+
+	return values
+}
+
+// Forget drops the averages for agent types that do not exist anymore.
+func (s *Smoother) Forget(existing map[string]bool) {
+	for agentType := range s.averages {
+		if !existing[agentType] {
+			delete(s.averages, agentType)
+		}
+	}
+}
+
+func smoothedMetricName(metricName string, window time.Duration) string {
+	return fmt.Sprintf("%s_avg_%s", metricName, formatWindow(window))
+}
+
+// Formats windows in the shortest way possible, e.g. 5m instead of 5m0s.
+// Windows are part of the metric names, which only have whole seconds, so windows
+// with fractions of a second, or used more than once, would have the same names.
+// Errors name the flag the windows are configured with.
+func validateWindows(kind, flag string, windows []time.Duration, min time.Duration) error {
+	seen := map[time.Duration]bool{}
+	for _, window := range windows {
+		if window < min {
+			return fmt.Errorf("invalid %s window %v in %s: must be at least %v", kind, window, flag, min)
+		}
+
+		if window%time.Second != 0 {
+			return fmt.Errorf("invalid %s window %v in %s: must be a whole number of seconds", kind, window, flag)
+		}
+
+		if seen[window] {
+			return fmt.Errorf("invalid %s window %v in %s: used more than once, as %s", kind, window, flag, formatWindow(window))
+		}
+
+		seen[window] = true
+	}
+
+	return nil
+}
+
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+}
+
+// Derived metrics are measured in the same unit as the metric they are derived from.
+func unitOf(metricName string) string {
+	for _, definition := range common.BaseMetrics {
+		if definition.Name == metricName {
+			return definition.Unit
+		}
+	}
+
+	return ""
+}
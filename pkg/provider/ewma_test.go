@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__EWMA(t *testing.T) {
+	start := time.Now()
+
+	t.Run("first sample is the average", func(t *testing.T) {
+		e := NewEWMA(time.Minute)
+		e.Update(10, start)
+		assert.Equal(t, 10.0, e.Value())
+	})
+
+	t.Run("moves towards new samples based on elapsed time", func(t *testing.T) {
+		e := NewEWMA(time.Minute)
+		e.Update(0, start)
+		e.Update(10, start.Add(time.Minute))
+
+		// after one window, the new sample has a weight of 1 - 1/e
+		assert.InDelta(t, 10*(1-math.Exp(-1)), e.Value(), 0.0001)
+	})
+
+	t.Run("longer windows move slower", func(t *testing.T) {
+		short := NewEWMA(time.Minute)
+		long := NewEWMA(5 * time.Minute)
+		for i := 0; i <= 6; i++ {
+			v := 0.0
+			if i > 0 {
+				v = 100
+			}
+
+			short.Update(v, start.Add(time.Duration(i)*10*time.Second))
+			long.Update(v, start.Add(time.Duration(i)*10*time.Second))
+		}
+
+		assert.Greater(t, short.Value(), long.Value())
+		assert.Less(t, short.Value(), 100.0)
+	})
+
+	t.Run("a missed sample does not skew the average", func(t *testing.T) {
+		regular := NewEWMA(time.Minute)
+		regular.Update(0, start)
+		regular.Update(10, start.Add(10*time.Second))
+		regular.Update(10, start.Add(20*time.Second))
+
+		missed := NewEWMA(time.Minute)
+		missed.Update(0, start)
+		missed.Update(10, start.Add(20*time.Second))
+
+		assert.InDelta(t, regular.Value(), missed.Value(), 0.0001)
+	})
+
+	t.Run("samples out of order are ignored", func(t *testing.T) {
+		e := NewEWMA(time.Minute)
+		e.Update(10, start)
+		e.Update(100, start.Add(-time.Second))
+		assert.Equal(t, 10.0, e.Value())
+	})
+}
+
+func Test__Smoother(t *testing.T) {
+	s := NewSmoother([]time.Duration{30 * time.Second, 5 * time.Minute, time.Hour})
+
+	assert.Contains(t, s.MetricNames(), "jobs_queued_avg_30s")
+	assert.Contains(t, s.MetricNames(), "jobs_queued_avg_5m")
+	assert.Contains(t, s.MetricNames(), "agents_occupied_avg_1h")
+
+	now := time.Now()
+	s.Record("s1-a", &common.Metrics{Jobs: common.JobMetrics{Queued: 4}}, now)
+	s.Record("s1-a", &common.Metrics{Jobs: common.JobMetrics{Queued: 8}}, now.Add(30*time.Second))
+
+	values := map[string]float64{}
+	for _, v := range s.Generate("s1-a", map[string]string{"agent_type": "s1-a"}, now) {
+		values[v.MetricName] = v.Value.AsApproximateFloat64()
+		assert.Equal(t, map[string]string{"agent_type": "s1-a"}, v.MetricLabels)
+	}
+
+	assert.Len(t, values, len(s.MetricNames()))
+	assert.InDelta(t, 4+4*(1-math.Exp(-1)), values["jobs_queued_avg_30s"], 0.001)
+	assert.Equal(t, 0.0, values["agents_occupied_avg_5m"])
+
+	s.Forget(map[string]bool{"s1-b": true})
+	assert.Empty(t, s.Generate("s1-a", map[string]string{}, now))
+}
+
+func Test__ValidateWindows(t *testing.T) {
+	t.Run("valid windows", func(t *testing.T) {
+		assert.NoError(t, validateWindows("EWMA", "--ewma-windows", []time.Duration{time.Second, 90 * time.Second, time.Hour}, time.Second))
+		assert.NoError(t, validateWindows("EWMA", "--ewma-windows", []time.Duration{}, time.Second))
+	})
+
+	testCases := map[string][]time.Duration{
+		"invalid EWMA window 500ms in --ewma-windows: must be at least 1s":              {500 * time.Millisecond},
+		"invalid EWMA window 1.5s in --ewma-windows: must be a whole number of seconds": {1500 * time.Millisecond},
+		"invalid EWMA window 1m0s in --ewma-windows: used more than once, as 1m":        {time.Minute, 60 * time.Second},
+		"invalid EWMA window 10m0s in --ewma-windows: used more than once, as 10m":      {10 * time.Minute, 5 * time.Minute, 600 * time.Second},
+	}
+
+	for expected, windows := range testCases {
+		t.Run(expected, func(t *testing.T) {
+			assert.EqualError(t, validateWindows("EWMA", "--ewma-windows", windows, time.Second), expected)
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package provider
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Agent pods take a few minutes to be ready, so that's how far ahead we look by default.
+const DefaultForecastHorizon = 5 * time.Minute
+
+// How quickly the level and trend of the forecasting model follow new samples.
+// Like the moving averages, the weight of a sample depends on the time since the previous one.
+const (
+	forecastLevelWindow = time.Minute
+	forecastTrendWindow = 5 * time.Minute
+)
+
+// The seasonal profile has one bucket for each half hour of the day, in UTC,
+// with how far above or below the daily baseline the number of jobs usually is.
+// Each bucket is only updated while the time of day is in it, so it takes
+// about a day to visit all of them, and a few days for them to settle.
+const (
+	seasonalBucket = 30 * time.Minute
+	seasonalWindow = time.Hour
+	baselineWindow = 24 * time.Hour
+)
+
+// How far back the forecast errors are averaged.
+const forecastErrorWindow = 30 * time.Minute
+
+// Forecaster forecasts jobs_total for each agent type, with Holt's linear trend method,
+// optionally with a time-of-day seasonal profile, and tracks how far off its past forecasts were.
+type Forecaster struct {
+	horizon  time.Duration
+	seasonal bool
+	maxGap   time.Duration
+	models   map[string]*forecastModel
+}
+
+func NewForecaster(horizon time.Duration, seasonal bool, maxGap time.Duration) *Forecaster {
+	return &Forecaster{
+		horizon:  horizon,
+		seasonal: seasonal,
+		maxGap:   maxGap,
+		models:   map[string]*forecastModel{},
+	}
+}
+
+func (f *Forecaster) MetricName() string {
+	return fmt.Sprintf("%s_forecast_%s", common.MetricJobsTotal, formatWindow(f.horizon))
+}
+
+func (f *Forecaster) ErrorMetricName() string {
+	return f.MetricName() + "_error"
+}
+
+func (f *Forecaster) Definitions() []common.MetricDefinition {
+	return []common.MetricDefinition{
+		{
+			Name:        f.MetricName(),
+			Description: fmt.Sprintf("Forecast of `%s` %s from now.", common.MetricJobsTotal, formatWindow(f.horizon)),
+			Unit:        "jobs",
+		},
+		{
+			Name:        f.ErrorMetricName(),
+			Description: fmt.Sprintf("Mean absolute error of the forecasts made %s ago, over the last %s.", formatWindow(f.horizon), formatWindow(forecastErrorWindow)),
+			Unit:        "jobs",
+		},
+	}
+}
+
+type forecastModel struct {
+	source string
+	level  float64
+	trend  float64
+	last   time.Time
+
+	// Nil if the seasonal profile is not used.
+	seasonal []float64
+	baseline *EWMA
+
+	// Forecasts not checked against the actual values yet, oldest first.
+	pending []pendingForecast
+
+	errors    *EWMA
+	evaluated bool
+}
+
+type pendingForecast struct {
+	at    time.Time
+	value float64
+}
+
+// Record updates the model for an agent type with a new sample.
+// After a gap in the collection, the level and trend start over, but the seasonal
+// profile is kept, since it describes the time of day, and not the recent samples.
+func (f *Forecaster) Record(agentType *common.AgentType, m *common.Metrics, at time.Time) {
+	value := float64(m.Jobs.Total())
+	s := sourceOf(agentType)
+
+	model, ok := f.models[agentType.Name]
+	if !ok || model.source != s {
+		model = &forecastModel{source: s, errors: NewEWMA(forecastErrorWindow)}
+		if f.seasonal {
+			model.seasonal = make([]float64, int(24*time.Hour/seasonalBucket))
+			model.baseline = NewEWMA(baselineWindow)
+		}
+
+		f.models[agentType.Name] = model
+	}
+
+	if !model.last.IsZero() && !at.After(model.last) {
+		return
+	}
+
+	f.checkForecasts(model, value, at)
+	f.updateSeasonal(model, value, at)
+
+	if model.last.IsZero() || at.Sub(model.last) > f.maxGap {
+		model.level = value
+		model.trend = 0
+		model.pending = []pendingForecast{}
+		model.last = at
+		f.addForecast(model, at)
+		return
+	}
+
+	elapsed := at.Sub(model.last)
+	alpha := 1 - math.Exp(-elapsed.Seconds()/forecastLevelWindow.Seconds())
+	beta := 1 - math.Exp(-elapsed.Seconds()/forecastTrendWindow.Seconds())
+
+	previousLevel := model.level
+	predicted := model.level + model.trend*elapsed.Minutes()
+	model.level = alpha*value + (1-alpha)*predicted
+	model.trend = beta*(model.level-previousLevel)/elapsed.Minutes() + (1-beta)*model.trend
+
+	model.last = at
+	f.addForecast(model, at)
+}
+
+// The seasonal profile is learned against a slow daily baseline, and not against the level,
+// since the level follows the samples closely enough to absorb the time-of-day changes.
+func (f *Forecaster) updateSeasonal(model *forecastModel, value float64, at time.Time) {
+	if model.seasonal == nil {
+		return
+	}
+
+	previous := model.baseline.last
+	model.baseline.Update(value, at)
+	if previous.IsZero() || at.Sub(previous) > f.maxGap {
+		return
+	}
+
+	gamma := 1 - math.Exp(-at.Sub(previous).Seconds()/seasonalWindow.Seconds())
+	b := seasonalBucketOf(at)
+	model.seasonal[b] += gamma * (value - model.baseline.Value() - model.seasonal[b])
+}
+
+func (f *Forecaster) addForecast(model *forecastModel, at time.Time) {
+	model.pending = append(model.pending, pendingForecast{at: at.Add(f.horizon), value: f.forecast(model, at)})
+}
+
+// Compares the forecasts made for this time, or before it, with the actual value.
+func (f *Forecaster) checkForecasts(model *forecastModel, value float64, at time.Time) {
+	i := 0
+	for i < len(model.pending) && !model.pending[i].at.After(at) {
+		// Forecasts that were due long before this sample were not checked in time,
+		// so they are dropped, instead of being compared with a value from a different time.
+		if at.Sub(model.pending[i].at) <= f.maxGap {
+			model.errors.Update(math.Abs(value-model.pending[i].value), at)
+			model.evaluated = true
+		}
+
+		i++
+	}
+
+	model.pending = model.pending[i:]
+}
+
+// The level and trend describe the recent samples, so the seasonal profile only adds
+// how much the number of jobs usually changes between now and the time of day forecast.
+func (f *Forecaster) forecast(model *forecastModel, now time.Time) float64 {
+	target := now.Add(f.horizon)
+	forecast := model.level + model.trend*f.horizon.Minutes() + model.seasonalAt(target) - model.seasonalAt(now)
+
+	// There's no such thing as a negative number of jobs.
+	return math.Max(0, forecast)
+}
+
+func (m *forecastModel) seasonalAt(t time.Time) float64 {
+	if m.seasonal == nil {
+		return 0
+	}
+
+	return m.seasonal[seasonalBucketOf(t)]
+}
+
+func seasonalBucketOf(t time.Time) int {
+	t = t.UTC()
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return int(sinceMidnight / seasonalBucket)
+}
+
+// Generate returns the current forecast for an agent type, and the error of
+// the past forecasts, once at least one of them could be checked.
+func (f *Forecaster) Generate(agentType string, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	// Restored models have no forecast until they get a sample.
+	model, ok := f.models[agentType]
+	if !ok || model.last.IsZero() {
+		return values
+	}
+
+	values = append(values, external_metrics.ExternalMetricValue{
+		MetricName:   f.MetricName(),
+		Timestamp:    v1.NewTime(now),
+		Value:        common.NewQuantity(f.forecast(model, model.last)),
+		MetricLabels: labels,
+	})
+
+	if model.evaluated {
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   f.ErrorMetricName(),
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(model.errors.Value()),
+			MetricLabels: labels,
+		})
+	}
+
+	return values
+}
+
+// PersistedSeasonal is what is persisted for an agent type's seasonal profile,
+// since it takes days to learn, unlike the rest of the model.
+type PersistedSeasonal struct {
+	Source     string    `json:"source"`
+	Buckets    []float64 `json:"buckets"`
+	Baseline   float64   `json:"baseline"`
+	BaselineAt time.Time `json:"baseline_at"`
+}
+
+// Persist adds the seasonal profiles to the persisted history.
+func (f *Forecaster) Persist(snapshot map[string]PersistedSeries) {
+	for agentType, model := range f.models {
+		if model.seasonal == nil {
+			continue
+		}
+
+		persisted := snapshot[agentType]
+		persisted.Seasonal = &PersistedSeasonal{
+			Source:     model.source,
+			Buckets:    append([]float64{}, model.seasonal...),
+			Baseline:   model.baseline.value,
+			BaselineAt: model.baseline.last,
+		}
+
+		snapshot[agentType] = persisted
+	}
+}
+
+// Restore starts the models with the persisted seasonal profiles. The level and trend
+// start over with the next sample, and profiles for a different source are dropped then.
+func (f *Forecaster) Restore(snapshot map[string]PersistedSeries) {
+	if !f.seasonal {
+		return
+	}
+
+	for agentType, persisted := range snapshot {
+		seasonal := persisted.Seasonal
+		if seasonal == nil || len(seasonal.Buckets) != int(24*time.Hour/seasonalBucket) {
+			continue
+		}
+
+		f.models[agentType] = &forecastModel{
+			source:   seasonal.Source,
+			errors:   NewEWMA(forecastErrorWindow),
+			seasonal: append([]float64{}, seasonal.Buckets...),
+			baseline: &EWMA{window: baselineWindow, value: seasonal.Baseline, last: seasonal.BaselineAt},
+		}
+	}
+}
+
+// Forget drops the models for agent types that do not exist anymore.
+func (f *Forecaster) Forget(existing map[string]bool) {
+	for agentType := range f.models {
+		if !existing[agentType] {
+			delete(f.models, agentType)
+		}
+	}
+}
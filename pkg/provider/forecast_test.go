@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Forecaster(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	agentType := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t1"}
+
+	jobs := func(n float64) *common.Metrics {
+		return &common.Metrics{Jobs: common.JobMetrics{Queued: int(n)}}
+	}
+
+	generate := func(f *Forecaster, now time.Time) map[string]float64 {
+		values := map[string]float64{}
+		for _, v := range f.Generate("s1-a", agentType.Labels(), now) {
+			values[v.MetricName] = v.Value.AsApproximateFloat64()
+		}
+
+		return values
+	}
+
+	t.Run("metric names follow the horizon", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		assert.Equal(t, "jobs_total_forecast_5m", f.MetricName())
+		assert.Equal(t, "jobs_total_forecast_5m_error", f.ErrorMetricName())
+		assert.Len(t, f.Definitions(), 2)
+	})
+
+	t.Run("unknown agent type -> no values", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		assert.Empty(t, f.Generate("s1-a", agentType.Labels(), start))
+	})
+
+	t.Run("constant demand -> same value, no error", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		now := start
+		for i := 0; i < 60; i++ {
+			now = start.Add(time.Duration(i) * 10 * time.Second)
+			f.Record(agentType, jobs(7), now)
+		}
+
+		values := generate(f, now)
+		assert.InDelta(t, 7.0, values["jobs_total_forecast_5m"], 0.001)
+		assert.InDelta(t, 0.0, values["jobs_total_forecast_5m_error"], 0.001)
+	})
+
+	t.Run("error is only exposed after the first forecast is due", func(t *testing.T) {
+		f := NewForecaster(time.Minute, false, 30*time.Second)
+		f.Record(agentType, jobs(1), start)
+		f.Record(agentType, jobs(1), start.Add(30*time.Second))
+		assert.NotContains(t, generate(f, start.Add(30*time.Second)), "jobs_total_forecast_1m_error")
+
+		f.Record(agentType, jobs(5), start.Add(time.Minute))
+		values := generate(f, start.Add(time.Minute))
+		assert.InDelta(t, 4.0, values["jobs_total_forecast_1m_error"], 0.001)
+	})
+
+	t.Run("growing demand -> forecast follows the trend", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		now := start
+		for i := 0; i <= 360; i++ {
+			now = start.Add(time.Duration(i) * 10 * time.Second)
+
+			// 2 jobs more every minute
+			f.Record(agentType, jobs(float64(i)/3), now)
+		}
+
+		values := generate(f, now)
+		assert.InDelta(t, 120.0+10.0, values["jobs_total_forecast_5m"], 2)
+		assert.Less(t, values["jobs_total_forecast_5m_error"], 3.0)
+	})
+
+	t.Run("shrinking demand -> forecast is never negative", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		now := start
+		for i := 0; i <= 60; i++ {
+			now = start.Add(time.Duration(i) * 10 * time.Second)
+			f.Record(agentType, jobs(float64(60-i)), now)
+		}
+
+		assert.Equal(t, 0.0, generate(f, now)["jobs_total_forecast_5m"])
+	})
+
+	t.Run("trend starts over after a gap", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		for i := 0; i <= 60; i++ {
+			f.Record(agentType, jobs(float64(i)), start.Add(time.Duration(i)*10*time.Second))
+		}
+
+		later := start.Add(time.Hour)
+		f.Record(agentType, jobs(3), later)
+		assert.Equal(t, 3.0, generate(f, later)["jobs_total_forecast_5m"])
+	})
+
+	t.Run("seasonal profile anticipates daily peaks", func(t *testing.T) {
+		withProfile := NewForecaster(5*time.Minute, true, 2*time.Minute)
+		withoutProfile := NewForecaster(5*time.Minute, false, 2*time.Minute)
+
+		// every day, 20 jobs between 12:00 and 13:00, and none otherwise
+		var now time.Time
+		for minute := 0; minute <= 3*24*60+11*60+55; minute++ {
+			now = start.Add(time.Duration(minute) * time.Minute)
+			n := 0.0
+			if now.Hour() == 12 {
+				n = 20
+			}
+
+			withProfile.Record(agentType, jobs(n), now)
+			withoutProfile.Record(agentType, jobs(n), now)
+		}
+
+		require.Equal(t, 11, now.Hour())
+		assert.Greater(t, generate(withProfile, now)["jobs_total_forecast_5m"], 10.0)
+		assert.Less(t, generate(withoutProfile, now)["jobs_total_forecast_5m"], 1.0)
+	})
+
+	t.Run("seasonal profile survives a restart", func(t *testing.T) {
+		daily := func(f *Forecaster, agentType *common.AgentType, from, to int) time.Time {
+			var now time.Time
+			for minute := from; minute <= to; minute++ {
+				now = start.Add(time.Duration(minute) * time.Minute)
+				n := 0.0
+				if now.Hour() == 12 {
+					n = 20
+				}
+
+				f.Record(agentType, jobs(n), now)
+			}
+
+			return now
+		}
+
+		f := NewForecaster(5*time.Minute, true, 2*time.Minute)
+		daily(f, agentType, 0, 3*24*60+11*60+50)
+
+		store := NewFileHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+		snapshot := map[string]PersistedSeries{}
+		f.Persist(snapshot)
+		require.NoError(t, store.Save(snapshot))
+
+		persisted, err := store.Load()
+		require.NoError(t, err)
+
+		restored := NewForecaster(5*time.Minute, true, 2*time.Minute)
+		restored.Restore(persisted)
+		assert.Empty(t, restored.Generate("s1-a", agentType.Labels(), start))
+
+		now := daily(restored, agentType, 3*24*60+11*60+51, 3*24*60+11*60+55)
+		assert.Greater(t, generate(restored, now)["jobs_total_forecast_5m"], 10.0)
+
+		// the profile is for the previous source of the agent type
+		changed := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t2"}
+		restored = NewForecaster(5*time.Minute, true, 2*time.Minute)
+		restored.Restore(persisted)
+		now = daily(restored, changed, 3*24*60+11*60+51, 3*24*60+11*60+55)
+		assert.Less(t, generate(restored, now)["jobs_total_forecast_5m"], 1.0)
+	})
+
+	t.Run("forgets agent types that are gone", func(t *testing.T) {
+		f := NewForecaster(5*time.Minute, false, 30*time.Second)
+		f.Record(agentType, jobs(1), start)
+		f.Forget(map[string]bool{})
+		assert.Empty(t, f.Generate("s1-a", agentType.Labels(), start))
+	})
+}
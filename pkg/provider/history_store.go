@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// HistoryStore persists the sample history, so metrics
+// calculated over trailing windows survive restarts.
+type HistoryStore interface {
+	Load() (map[string]PersistedSeries, error)
+	Save(map[string]PersistedSeries) error
+}
+
+// FileHistoryStore keeps the sample history in a JSON file,
+// e.g. in a volume mounted into the adapter pod.
+type FileHistoryStore struct {
+	path string
+}
+
+func NewFileHistoryStore(path string) *FileHistoryStore {
+	return &FileHistoryStore{path: path}
+}
+
+type historyFile struct {
+	Series map[string]PersistedSeries `json:"series"`
+}
+
+// Load returns an empty history if the file does not exist yet.
+func (s *FileHistoryStore) Load() (map[string]PersistedSeries, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return map[string]PersistedSeries{}, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading history file: %v", err)
+	}
+
+	file := historyFile{}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("error parsing history file: %v", err)
+	}
+
+	if file.Series == nil {
+		return map[string]PersistedSeries{}, nil
+	}
+
+	return file.Series, nil
+}
+
+// Save writes to a temporary file first, and then renames it,
+// so a crash in the middle of a write doesn't leave a corrupted file behind.
+func (s *FileHistoryStore) Save(series map[string]PersistedSeries) error {
+	content, err := json.Marshal(historyFile{Series: series})
+	if err != nil {
+		return fmt.Errorf("error serializing history: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary history file: %v", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing history file: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing history file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error replacing history file: %v", err)
+	}
+
+	return nil
+}
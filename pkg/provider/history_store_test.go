@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__FileHistoryStore(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("file does not exist -> empty history", func(t *testing.T) {
+		store := NewFileHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+		series, err := store.Load()
+		require.NoError(t, err)
+		assert.Empty(t, series)
+	})
+
+	t.Run("saved history is loaded back", func(t *testing.T) {
+		store := NewFileHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+		saved := map[string]PersistedSeries{
+			"s1-a": {Source: "abc", Samples: []Sample{sampleAt(start, 1), sampleAt(start.Add(10*time.Second), 2)}},
+		}
+
+		require.NoError(t, store.Save(saved))
+		loaded, err := store.Load()
+		require.NoError(t, err)
+		require.Contains(t, loaded, "s1-a")
+		assert.Equal(t, "abc", loaded["s1-a"].Source)
+		require.Len(t, loaded["s1-a"].Samples, 2)
+		assert.True(t, start.Equal(loaded["s1-a"].Samples[0].At))
+		assert.Equal(t, 2, loaded["s1-a"].Samples[1].Metrics.Jobs.Queued)
+	})
+
+	t.Run("bad file -> error", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte("not-json"), 0600))
+		_, err := NewFileHistoryStore(path).Load()
+		assert.ErrorContains(t, err, "error parsing history file")
+	})
+
+	t.Run("token is not persisted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "history.json")
+		h := NewHistory(time.Hour)
+		agentType := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "super-secret-token"}
+		h.Record(agentType, &common.Metrics{}, start)
+		require.NoError(t, NewFileHistoryStore(path).Save(h.Snapshot()))
+
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "super-secret-token")
+	})
+}
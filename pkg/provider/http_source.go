@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Responses bigger than this are not read.
+const maxHTTPSourceResponseSize = 4 * 1024 * 1024
+
+// HTTPSourceResponse is what HTTP sources respond with, e.g.:
+//
+//	{"metrics": [{"name": "builds_pending", "labels": {"team": "mobile"}, "value": 4}]}
+type HTTPSourceResponse struct {
+	Metrics []SourceMetricSpec `json:"metrics"`
+}
+
+// HTTPSource collects values from an HTTP endpoint responding with JSON.
+type HTTPSource struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSource(name, url string, client *http.Client) *HTTPSource {
+	return &HTTPSource{name: name, url: url, client: client}
+}
+
+func (s *HTTPSource) Name() string {
+	return s.name
+}
+
+func (s *HTTPSource) Collect(ctx context.Context) (values []metrics.ExternalMetricValue, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "HTTPSource: GET "+s.name, trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("url", s.url))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.StatusCode)...)
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("request to %s failed with %d", s.url, res.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPSourceResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	response := HTTPSourceResponse{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+
+	// One invalid value means the response cannot be trusted,
+	// so none of it is used, and the previous values are kept.
+	return toSourceValues(response.Metrics, time.Now())
+}
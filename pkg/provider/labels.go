@@ -11,20 +11,10 @@ type Labels struct {
 }
 
 func (l *Labels) Has(label string) (exists bool) {
-	for k := range l.metric.MetricLabels {
-		if k == label {
-			return true
-		}
-	}
-	return false
+	_, exists = l.metric.MetricLabels[label]
+	return exists
 }
 
 func (l *Labels) Get(label string) (value string) {
-	for k, v := range l.metric.MetricLabels {
-		if k == label {
-			return v
-		}
-	}
-
-	return ""
+	return l.metric.MetricLabels[label]
 }
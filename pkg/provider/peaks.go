@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Metrics for which the peak over a trailing window is exposed, e.g. agents_occupied_max_10m.
+var PeakMetrics = []string{
+	common.MetricJobsQueued,
+	common.MetricJobsRunning,
+	common.MetricJobsTotal,
+	common.MetricAgentsOccupied,
+}
+
+// Peaks calculates the maximum value of metrics over trailing windows.
+// Scale-down decisions can use them, so capacity is not removed
+// right after a short dip in the number of jobs.
+type Peaks struct {
+	windows []time.Duration
+}
+
+func NewPeaks(windows []time.Duration) *Peaks {
+	return &Peaks{windows: windows}
+}
+
+// Definitions returns the definitions of all the peak metrics, e.g. jobs_total_max_15m.
+func (p *Peaks) Definitions() []common.MetricDefinition {
+	definitions := []common.MetricDefinition{}
+	for _, metricName := range PeakMetrics {
+		for _, window := range p.windows {
+			definitions = append(definitions, common.MetricDefinition{
+				Name:        peakMetricName(metricName, window),
+				Description: fmt.Sprintf("Peak value of `%s` over the last %s.", metricName, formatWindow(window)),
+				Unit:        unitOf(metricName),
+			})
+		}
+	}
+
+	return definitions
+}
+
+// Retention returns how long samples need to be kept around to calculate the peaks.
+func (p *Peaks) Retention() time.Duration {
+	var retention time.Duration
+	for _, window := range p.windows {
+		if window > retention {
+			retention = window
+		}
+	}
+
+	return retention
+}
+
+func (p *Peaks) Generate(series *TimeSeries, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	for _, metricName := range PeakMetrics {
+		for _, window := range p.windows {
+			values = append(values, external_metrics.ExternalMetricValue{
+				MetricName:   peakMetricName(metricName, window),
+				Timestamp:    v1.NewTime(now),
+				Value:        common.NewQuantity(peak(series.Since(now.Add(-window)), metricName)),
+				MetricLabels: labels,
+			})
+		}
+	}
+
+	return values
+}
+
+// Unlike rates, peaks don't need contiguous samples:
+// a peak seen before a gap in the collection is still a peak.
+func peak(samples []Sample, metricName string) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	max := math.Inf(-1)
+	for _, sample := range samples {
+		max = math.Max(max, sample.Metrics.Calc(metricName))
+	}
+
+	return max
+}
+
+func peakMetricName(metricName string, window time.Duration) string {
+	return fmt.Sprintf("%s_max_%s", metricName, formatWindow(window))
+}
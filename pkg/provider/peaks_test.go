@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__Peaks(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPeaks([]time.Duration{time.Minute, 10 * time.Minute})
+
+	generate := func(ts *TimeSeries, now time.Time) map[string]float64 {
+		values := map[string]float64{}
+		for _, v := range p.Generate(ts, map[string]string{}, now) {
+			values[v.MetricName] = v.Value.AsApproximateFloat64()
+		}
+
+		return values
+	}
+
+	t.Run("definitions", func(t *testing.T) {
+		names := []string{}
+		for _, definition := range p.Definitions() {
+			names = append(names, definition.Name)
+			assert.NotEmpty(t, definition.Unit)
+		}
+
+		assert.Contains(t, names, "agents_occupied_max_10m")
+		assert.Contains(t, names, "jobs_total_max_1m")
+		assert.Len(t, names, len(PeakMetrics)*2)
+	})
+
+	t.Run("retention is the longest window", func(t *testing.T) {
+		assert.Equal(t, 10*time.Minute, p.Retention())
+		assert.Equal(t, time.Duration(0), NewPeaks(nil).Retention())
+	})
+
+	t.Run("no samples -> zero", func(t *testing.T) {
+		values := generate(NewTimeSeries(time.Hour), start)
+		assert.Equal(t, 0.0, values["jobs_queued_max_1m"])
+	})
+
+	t.Run("peak is taken from the samples in the window", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 20))
+		ts.Add(sampleAt(start.Add(4*time.Minute+30*time.Second), 8))
+		ts.Add(sampleAt(start.Add(5*time.Minute+30*time.Second), 3))
+		ts.Add(sampleAt(start.Add(6*time.Minute), 1))
+
+		values := generate(ts, start.Add(6*time.Minute))
+		assert.Equal(t, 3.0, values["jobs_queued_max_1m"])
+		assert.Equal(t, 20.0, values["jobs_queued_max_10m"])
+	})
+
+	t.Run("samples before a gap are still used", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 15))
+		ts.Add(sampleAt(start.Add(8*time.Minute), 2))
+		assert.Equal(t, 15.0, generate(ts, start.Add(8*time.Minute))["jobs_queued_max_10m"])
+	})
+}
@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// PodFinder finds the pods running in the namespace where the agents run,
+// so agents registered in Semaphore can be matched against existing pods.
+type PodFinder struct {
+	podsInterface dynamic.ResourceInterface
+}
+
+func NewPodFinder(client dynamic.Interface, namespace string) *PodFinder {
+	// The provider needs list access to pods for this.
+	podsInterface := client.
+		Resource(schema.GroupVersionResource{
+			Group:    "",
+			Version:  "v1",
+			Resource: "pods",
+		}).
+		Namespace(namespace)
+
+	return &PodFinder{podsInterface: podsInterface}
+}
+
+// Names returns the names of all the pods in the namespace.
+// An agent's hostname is the name of the pod it runs in.
+func (f *PodFinder) Names(ctx context.Context) (names map[string]bool, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "PodFinder.Names")
+	defer func() {
+		span.SetAttributes(attribute.Int("pods", len(names)))
+		tracing.End(span, err)
+	}()
+
+	list, err := f.podsInterface.List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+
+	names = map[string]bool{}
+	for _, pod := range list.Items {
+		names[pod.GetName()] = true
+	}
+
+	return names, nil
+}
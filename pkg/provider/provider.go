@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/klog/v2"
@@ -16,18 +19,115 @@ import (
 
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/semaphore"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// How long a single collection cycle can take.
+// Requests waiting on the rate limiter for longer than this are abandoned.
+var CollectTimeout = 10 * time.Second
+
+// How often metrics are collected.
+var CollectInterval = 10 * time.Second
+
+// How long we can go without samples for an agent type,
+// before we consider its samples not contiguous anymore.
+var MaxSampleGap = 3 * CollectInterval
+
 type SemaphoreMetricsProvider struct {
-	config Config
-	finder *AgentTypeFinder
-	data   sync.Map
+	config    Config
+	finder    *AgentTypeFinder
+	podFinder *PodFinder
+	workloads *WorkloadFinder
+	smoother  *Smoother
+	history   *History
+	rates     *Rates
+	peaks     *Peaks
+	queue     *QueueDurations
+	forecast  *Forecaster
+	activate  *Activation
+	aggregate *Aggregator
+	derived   *DerivedMetricsLoader
+
+	// The Semaphore source first, then the configured ones.
+	runners []*sourceRunner
+
+	// The snapshot from the last collection, and its generation number.
+	// Collections from all sources are published one at a time.
+	snapshot   atomic.Value
+	generation uint64
+	publishMu  sync.Mutex
+
+	// The registry changes when the derived metrics are reloaded.
+	registry       *common.Registry
+	derivedMetrics []*DerivedMetric
+	registryMu     sync.RWMutex
 }
 
 type Config struct {
 	Client          dynamic.Interface
-	Mapper          apimeta.RESTMapper
 	SemaphoreClient *semaphore.Client
+
+	// Used to find the workloads custom metrics are attached to.
+	// If nil, only external metrics are exposed.
+	Mapper apimeta.RESTMapper
+
+	// Also list the agents for each agent type,
+	// and expose metrics about their versions, platforms and connection ages.
+	CollectAgentDetails bool
+
+	// Windows for the exponentially weighted moving averages
+	// exposed alongside the raw values, e.g. jobs_queued_avg_5m.
+	EWMAWindows []time.Duration
+
+	// Trailing window used to calculate rates of change, e.g. jobs_queued_rate_per_minute.
+	RateWindow time.Duration
+
+	// Trailing windows for the peak values, e.g. agents_occupied_max_10m.
+	MaxWindows []time.Duration
+
+	// Thresholds for jobs_queued_duration_seconds, in addition to 0.
+	QueueDurationThresholds []int
+
+	// How far ahead jobs_total is forecast, e.g. jobs_total_forecast_5m,
+	// and whether the forecast uses a time-of-day seasonal profile.
+	ForecastHorizon     time.Duration
+	ForecastSeasonality bool
+
+	// How long the activation metric stays at 1 after the last queued or running job.
+	// Defaults to DefaultActivationGracePeriod if nil, and 0 turns the grace period off.
+	ActivationGracePeriod *time.Duration
+
+	// Labels on the agent type secrets to aggregate agent types by, e.g. pool,
+	// or "all", to aggregate all agent types together.
+	AggregateBy []string
+
+	// Metrics that are not exposed.
+	DisabledMetrics []string
+
+	// Name of the ConfigMap with the derived metric definitions, in the adapter namespace.
+	// If empty, there are no derived metrics.
+	DerivedMetricsConfigMap string
+
+	// What reads from namespaces where the requested metrics are not visible get back:
+	// an empty list, or a Forbidden error. Defaults to an empty list.
+	DeniedNamespaceResponse string
+
+	// Added to the names of the Semaphore metrics, e.g. semaphore_jobs_queued.
+	// Not added to the names with the agent type, which already start with semaphore-.
+	SemaphoreMetricPrefix string
+
+	// Other sources to collect metrics from, exposed alongside the Semaphore metrics.
+	Sources []Source
+
+	// Also expose the metrics for each agent type with the agent type in the name,
+	// e.g. semaphore-s1-a-jobs_queued, for consumers that cannot use label selectors.
+	AgentTypeMetricNames bool
+
+	// Where the sample history is persisted, so the trailing windows survive restarts.
+	// If nil, the history is kept only in memory.
+	HistoryStore HistoryStore
 }
 
 func New(config Config) (*SemaphoreMetricsProvider, error) {
@@ -42,79 +142,563 @@ func New(config Config) (*SemaphoreMetricsProvider, error) {
 		return nil, fmt.Errorf("error creating agent type finder")
 	}
 
-	return &SemaphoreMetricsProvider{
-		finder: finder,
-		config: config,
-		data:   sync.Map{},
-	}, nil
+	if err := validateWindows("EWMA", "--ewma-windows", config.EWMAWindows, time.Second); err != nil {
+		return nil, err
+	}
+
+	if config.RateWindow == 0 {
+		config.RateWindow = DefaultRateWindow
+	}
+
+	if config.RateWindow < 2*CollectInterval {
+		return nil, fmt.Errorf("invalid rate window %v: must be at least %v", config.RateWindow, 2*CollectInterval)
+	}
+
+	if err := validateWindows("max", "--max-windows", config.MaxWindows, CollectInterval); err != nil {
+		return nil, err
+	}
+
+	for _, threshold := range config.QueueDurationThresholds {
+		if threshold < 0 {
+			return nil, fmt.Errorf("invalid queue duration threshold %d: must not be negative", threshold)
+		}
+	}
+
+	if config.ForecastHorizon == 0 {
+		config.ForecastHorizon = DefaultForecastHorizon
+	}
+
+	if config.ForecastHorizon < CollectInterval {
+		return nil, fmt.Errorf("invalid forecast horizon %v: must be at least %v", config.ForecastHorizon, CollectInterval)
+	}
+
+	gracePeriod := activationGracePeriod(config)
+	if gracePeriod < 0 {
+		return nil, fmt.Errorf("invalid activation grace period %v: must not be negative", gracePeriod)
+	}
+
+	if config.DeniedNamespaceResponse == "" {
+		config.DeniedNamespaceResponse = DeniedNamespaceEmpty
+	}
+
+	if err := validateDeniedNamespaceResponse(config.DeniedNamespaceResponse); err != nil {
+		return nil, err
+	}
+
+	if err := validatePrefix(config.SemaphoreMetricPrefix); err != nil {
+		return nil, err
+	}
+
+	sources, err := validateSources(config.Sources)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregator, err := NewAggregator(config.AggregateBy)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := NewRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+
+	peaks := NewPeaks(config.MaxWindows)
+	retention := config.RateWindow
+	if peaks.Retention() > retention {
+		retention = peaks.Retention()
+	}
+
+	p := &SemaphoreMetricsProvider{
+		finder:    finder,
+		podFinder: NewPodFinder(config.Client, namespace),
+		smoother:  NewSmoother(config.EWMAWindows),
+		history:   NewHistory(retention),
+		rates:     NewRates(config.RateWindow, MaxSampleGap),
+		peaks:     peaks,
+		queue:     NewQueueDurations(config.QueueDurationThresholds, MaxSampleGap),
+		forecast:  NewForecaster(config.ForecastHorizon, config.ForecastSeasonality, MaxSampleGap),
+		activate:  NewActivation(gracePeriod),
+		aggregate: aggregator,
+		registry:  registry,
+		config:    config,
+	}
+
+	if config.DerivedMetricsConfigMap != "" {
+		variables, reserved := derivedMetricNames(registry)
+		p.derived = NewDerivedMetricsLoader(config.Client, namespace, config.DerivedMetricsConfigMap, variables, reserved)
+	}
+
+	if config.Mapper != nil {
+		p.workloads = NewWorkloadFinder(config.Client, config.Mapper)
+	}
+
+	p.runners = []*sourceRunner{{
+		Source: Source{
+			Source:   &semaphoreSource{p: p},
+			Interval: CollectInterval,
+			Timeout:  CollectTimeout,
+		},
+	}}
+
+	for _, source := range sources {
+		p.runners = append(p.runners, &sourceRunner{Source: source})
+	}
+
+	p.restoreHistory()
+	return p, nil
+}
+
+// A history that cannot be restored is not a reason to not start:
+// the trailing windows will just be filled again as new samples are collected.
+func (p *SemaphoreMetricsProvider) restoreHistory() {
+	if p.config.HistoryStore == nil {
+		return
+	}
+
+	snapshot, err := p.config.HistoryStore.Load()
+	if err != nil {
+		klog.Errorf("Error restoring sample history: %v", err)
+		return
+	}
+
+	p.history.Restore(snapshot, time.Now())
+	p.forecast.Restore(snapshot)
+	klog.Infof("Restored sample history for %d agent types", len(snapshot))
+}
+
+func (p *SemaphoreMetricsProvider) persistHistory() {
+	if p.config.HistoryStore == nil {
+		return
+	}
+
+	snapshot := p.history.Snapshot()
+	p.forecast.Persist(snapshot)
+	if err := p.config.HistoryStore.Save(snapshot); err != nil {
+		klog.Errorf("Error persisting sample history: %v", err)
+	}
 }
 
-// Return all metrics in semaphore.AllMetrics
+// Return all the metrics in the registry, except for the disabled ones,
+// the metrics from other sources, and, if enabled, the names with the agent type
+// for the agent types found in the last collection.
 func (p *SemaphoreMetricsProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
 	list := []provider.ExternalMetricInfo{}
 
-	for _, m := range common.AllMetrics {
+	names := p.currentRegistry().Names()
+	for _, m := range names {
+		list = append(list, provider.ExternalMetricInfo{Metric: p.config.SemaphoreMetricPrefix + m})
+	}
+
+	snapshot := p.currentSnapshot()
+	if snapshot == nil {
+		return list
+	}
+
+	for _, m := range snapshot.SourceMetricNames() {
 		list = append(list, provider.ExternalMetricInfo{Metric: m})
 	}
 
+	if !p.config.AgentTypeMetricNames {
+		return list
+	}
+
+	// The list is not for a namespace, so it only has the
+	// names for the agent types visible in all of them.
+	for _, agentType := range snapshot.visibility.AgentTypesIn(common.AllNamespaces) {
+		for _, m := range names {
+			if _, ok := snapshot.Metric(m); ok {
+				list = append(list, provider.ExternalMetricInfo{Metric: agentTypeMetricName(agentType, m)})
+			}
+		}
+	}
+
 	return list
 }
 
 func (p *SemaphoreMetricsProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*metrics.ExternalMetricValueList, error) {
-	v, ok := p.data.Load(info.Metric)
+	snapshot := p.currentSnapshot()
+
+	// The span is linked to the collection that produced the values being served.
+	spanOptions := []trace.SpanOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if snapshot != nil {
+		spanOptions = append(spanOptions, trace.WithLinks(trace.Link{SpanContext: snapshot.collection}))
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "SemaphoreMetricsProvider.GetExternalMetric", spanOptions...)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("metric", info.Metric),
+		attribute.String("namespace", namespace),
+		attribute.String("selector", metricSelector.String()),
+	)
+
+	if snapshot == nil {
+		return nil, p.readError(span, newNotCollectedYetError())
+	}
+
+	span.SetAttributes(attribute.Int64("generation", int64(snapshot.Generation)))
+	klog.V(4).Infof("Serving %s for namespace %s from snapshot generation %d", info.Metric, namespace, snapshot.Generation)
+
+	if m, ok := snapshot.SourceMetric(info.Metric); ok {
+		return p.getSourceMetric(span, m, namespace, metricSelector, info.Metric)
+	}
+
+	registry := p.currentRegistry()
+	agentType, metricName, withAgentType := p.resolveMetricName(snapshot, info.Metric, namespace)
+	m, ok := snapshot.Metric(metricName)
 	if !ok {
-		return &metrics.ExternalMetricValueList{}, nil
+		return nil, p.readError(span, p.unknownMetricError(registry, info.Metric, snapshot.visibility.AgentTypesIn(namespace)))
+	}
+
+	supported := supportedLabels(registry, p.config.AggregateBy, metricName)
+	if err := validateSelector(supported, p.config.AggregateBy, info.Metric, metricSelector); err != nil {
+		return nil, p.readError(span, err)
+	}
+
+	// If no selector is used, we return metrics for all the agent types.
+	// Otherwise we return only the values that match the label selector.
+	var values []metrics.ExternalMetricValue
+	if withAgentType {
+		values = m.SelectFor(agentType, metricSelector)
+	} else {
+		values = m.Select(metricSelector, selectsAggregates(metricSelector))
+	}
+
+	// Values that are not visible are left out before checking if there are any,
+	// so agent types from other namespaces get the same errors as the ones that do not exist.
+	values, denied := snapshot.visibility.Filter(values, namespace)
+	span.SetAttributes(attribute.Int("denied", denied))
+	if len(values) == 0 && denied > 0 && p.config.DeniedNamespaceResponse == DeniedNamespaceForbidden {
+		return nil, p.readError(span, newNamespaceForbiddenError(externalMetricsResource, info.Metric, namespace))
 	}
 
-	values := v.([]metrics.ExternalMetricValue)
+	if len(values) == 0 {
+		return nil, p.readError(span, newNoValuesError(info.Metric, metricSelector, snapshot.visibility.AgentTypesIn(namespace)))
+	}
+
+	// Values are named as requested, with the prefix or the agent type.
+	for i := range values {
+		values[i].MetricName = info.Metric
+	}
+
+	span.SetAttributes(attribute.Int("items", len(values)))
+	return &metrics.ExternalMetricValueList{
+		Items: values,
+	}, nil
+}
+
+// Reads the values for a metric from another source. They are only visible
+// in the namespaces configured for the source, and selectors can use any of their labels.
+func (p *SemaphoreMetricsProvider) getSourceMetric(span trace.Span, m *SourceMetric, namespace string, metricSelector labels.Selector, metricName string) (*metrics.ExternalMetricValueList, error) {
+	span.SetAttributes(attribute.String("source", m.Source))
+	if err := validateSelector(m.Labels(), nil, metricName, metricSelector); err != nil {
+		return nil, p.readError(span, err)
+	}
+
+	// Like for agent types, values that are not visible get the same errors as missing ones.
+	values := m.Select(metricSelector, true)
+	if !m.VisibleIn(namespace) {
+		span.SetAttributes(attribute.Int("denied", len(values)))
+		if len(values) > 0 && p.config.DeniedNamespaceResponse == DeniedNamespaceForbidden {
+			return nil, p.readError(span, newNamespaceForbiddenError(externalMetricsResource, metricName, namespace))
+		}
+
+		values = []metrics.ExternalMetricValue{}
+	}
 
-	// If no selector is used, we return metrics for all the agent types
-	if metricSelector.Empty() {
-		return &metrics.ExternalMetricValueList{
-			Items: values,
-		}, nil
+	if len(values) == 0 {
+		if metricSelector.Empty() {
+			return nil, p.readError(span, newNotFoundError("no values for metric %s from source %s yet", metricName, m.Source))
+		}
+
+		return nil, p.readError(span, newNotFoundError("no values for metric %s from source %s match selector %s", metricName, m.Source, metricSelector.String()))
 	}
 
-	// Otherwise we return only the values that match the label selector
+	span.SetAttributes(attribute.Int("items", len(values)))
 	return &metrics.ExternalMetricValueList{
-		Items: filterByMetricSelector(values, metricSelector),
+		Items: values,
 	}, nil
 }
 
+// Names of Semaphore metrics are resolved to the names in the registry, without the prefix.
+// Names with the agent type, e.g. semaphore-s1-a-jobs_queued, are resolved
+// to the metric and the agent type, if the agent type was found in the snapshot
+// and is visible in the namespace. Names that cannot be resolved are returned empty.
+func (p *SemaphoreMetricsProvider) resolveMetricName(snapshot *Snapshot, name, namespace string) (agentType, metricName string, withAgentType bool) {
+	if metricName, ok := p.semaphoreMetricName(name); ok {
+		if _, found := snapshot.Metric(metricName); found {
+			return "", metricName, false
+		}
+	}
+
+	if !p.config.AgentTypeMetricNames {
+		return "", "", false
+	}
+
+	agentType, metricName, ok := parseAgentTypeMetricName(name)
+	if !ok || !contains(snapshot.visibility.AgentTypesIn(namespace), agentType) {
+		return "", "", false
+	}
+
+	return agentType, metricName, true
+}
+
+// The name in the registry for an exposed Semaphore metric name, if it has the prefix.
+func (p *SemaphoreMetricsProvider) semaphoreMetricName(name string) (string, bool) {
+	if !strings.HasPrefix(name, p.config.SemaphoreMetricPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(name, p.config.SemaphoreMetricPrefix), true
+}
+
+// Names with an agent type that does not exist anymore are reported as such.
+func (p *SemaphoreMetricsProvider) unknownMetricError(registry *common.Registry, name string, agentTypes []string) error {
+	if p.config.AgentTypeMetricNames {
+		agentType, metricName, ok := parseAgentTypeMetricName(name)
+		if ok && registry.Enabled(metricName) {
+			return newNotFoundError("agent type %s not found, use one of: %s", agentType, strings.Join(agentTypes, ", "))
+		}
+	}
+
+	return newUnknownMetricError(registry, p.config.SemaphoreMetricPrefix, name)
+}
+
+// Errors from reads are logged, since they usually mean an HPA is misconfigured.
+func (p *SemaphoreMetricsProvider) readError(span trace.Span, err error) error {
+	klog.V(2).Infof("Error reading external metric: %v", err)
+	tracing.RecordError(span, err)
+	return err
+}
+
+// Collects each source on its own schedule.
 func (p *SemaphoreMetricsProvider) Collect() {
-	for {
-		agentTypes, err := p.finder.Find()
-		if err != nil {
-			klog.Errorf("Error finding agent types: %v", err)
-		} else {
-			klog.Infof("Found %d agent types", len(agentTypes))
-			values := p.config.SemaphoreClient.GetMetrics(agentTypes)
-			for _, metricName := range common.AllMetrics {
-				p.data.Store(metricName, filterByMetricName(values, metricName))
+	for _, r := range p.runners[1:] {
+		go p.run(r)
+	}
+
+	p.run(p.runners[0])
+}
+
+// Publishes the last values from all the sources as a new snapshot, replacing the previous one all at once.
+// Nothing is published until the Semaphore metrics were collected, so reads are unavailable until then,
+// but other sources are published as soon as they are collected, without waiting for each other.
+// Metrics from other sources with the same name as a metric already published are left out.
+// Must be called with the publish lock held.
+func (p *SemaphoreMetricsProvider) publish(span trace.Span) {
+	semaphore := p.runners[0]
+	if !semaphore.collected {
+		klog.V(2).Infof("Not publishing until source %s is collected", semaphore.Name())
+		return
+	}
+
+	names := p.currentRegistry().Names()
+	exposed := map[string]string{}
+	for _, name := range names {
+		exposed[p.config.SemaphoreMetricPrefix+name] = SemaphoreSourceName
+	}
+
+	p.generation++
+	generation := p.generation
+	snapshot := NewSnapshot(
+		generation,
+		time.Now(),
+		names,
+		semaphore.values,
+		span.SpanContext(),
+		NewVisibility(semaphore.agentTypes),
+	)
+
+	count := len(semaphore.values)
+	for _, r := range p.runners[1:] {
+		for _, name := range r.names {
+			if source, ok := exposed[name]; ok {
+				klog.Errorf("Metric %s from source %s is already exposed by source %s, ignoring it", name, r.Name(), source)
+				continue
 			}
+
+			values := filterByMetricName(r.values, name)
+			snapshot.addSourceMetric(name, r.Name(), r.Namespaces, values)
+			exposed[name] = r.Name()
+			count += len(values)
 		}
+	}
+
+	p.snapshot.Store(snapshot)
+	span.SetAttributes(attribute.Int64("generation", int64(generation)))
+	klog.Infof("Published snapshot generation %d with %d values", generation, count)
+}
+
+// The snapshot from the last collection, or nil if nothing was collected yet.
+func (p *SemaphoreMetricsProvider) currentSnapshot() *Snapshot {
+	snapshot, _ := p.snapshot.Load().(*Snapshot)
+	return snapshot
+}
+
+func (p *SemaphoreMetricsProvider) currentRegistry() *common.Registry {
+	p.registryMu.RLock()
+	defer p.registryMu.RUnlock()
+	return p.registry
+}
+
+// Reloads the derived metrics, if their definitions changed,
+// and adds them to the registry. If the definitions are not valid, the previous ones are kept.
+func (p *SemaphoreMetricsProvider) reloadDerivedMetrics(ctx context.Context) {
+	if p.derived == nil {
+		return
+	}
 
-		// TODO: use noise in intervals
-		time.Sleep(10 * time.Second)
+	derivedMetrics, changed, err := p.derived.Load(ctx)
+	if err != nil {
+		klog.Errorf("Error loading derived metrics: %v", err)
 	}
+
+	if !changed {
+		return
+	}
+
+	registry, err := NewRegistry(p.config)
+	if err != nil {
+		klog.Errorf("Error creating metric registry: %v", err)
+		return
+	}
+
+	for _, derived := range derivedMetrics {
+		if err := registry.Register(derived.Definition()); err != nil {
+			klog.Errorf("Error registering derived metric: %v", err)
+			return
+		}
+	}
+
+	p.registryMu.Lock()
+	defer p.registryMu.Unlock()
+	p.registry = registry
+	p.derivedMetrics = derivedMetrics
 }
 
-func filterByMetricName(values []metrics.ExternalMetricValue, metricName string) []metrics.ExternalMetricValue {
-	filtered := []metrics.ExternalMetricValue{}
+// Evaluates the derived metrics for an agent type,
+// using the values already generated for it as variables.
+func (p *SemaphoreMetricsProvider) generateDerived(agentType *common.AgentType, values []metrics.ExternalMetricValue, now time.Time) []metrics.ExternalMetricValue {
+	derived := []metrics.ExternalMetricValue{}
+	if len(p.derivedMetrics) == 0 {
+		return derived
+	}
 
+	variables := map[string]float64{}
 	for _, v := range values {
-		if v.MetricName == metricName {
-			filtered = append(filtered, v)
+		if len(v.MetricLabels) == 1 {
+			variables[v.MetricName] = v.Value.AsApproximateFloat64()
 		}
 	}
 
-	return filtered
+	for _, derivedMetric := range p.derivedMetrics {
+		if missing := derivedMetric.Missing(variables); len(missing) > 0 {
+			klog.V(2).Infof("Not evaluating derived metric %s for %s yet: no values for %s", derivedMetric.Name(), agentType.Name, strings.Join(missing, ", "))
+			continue
+		}
+
+		value, err := derivedMetric.Evaluate(variables)
+		if err != nil {
+			klog.Errorf("Error evaluating derived metric %s for %s: %v", derivedMetric.Name(), agentType.Name, err)
+			continue
+		}
+
+		derived = append(derived, metrics.ExternalMetricValue{
+			MetricName:   derivedMetric.Name(),
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(value),
+			MetricLabels: agentType.Labels(),
+		})
+	}
+
+	return derived
 }
 
-func filterByMetricSelector(values []metrics.ExternalMetricValue, metricSelector labels.Selector) []metrics.ExternalMetricValue {
+// Generates the values for all agent types, from the metrics just collected,
+// and updates the metrics derived from the previous samples.
+// The active schedules are added as events to the collection span.
+func (p *SemaphoreMetricsProvider) generate(ctx context.Context, agentTypes []*common.AgentType, samples map[string]*common.Metrics, now time.Time) []metrics.ExternalMetricValue {
+	values := []metrics.ExternalMetricValue{}
+	existing := map[string]bool{}
+	span := trace.SpanFromContext(ctx)
+
+	for _, agentType := range agentTypes {
+		existing[agentType.Name] = true
+
+		m, ok := samples[agentType.Name]
+		if !ok {
+			continue
+		}
+
+		p.smoother.Record(agentType.Name, m, now)
+		p.history.Record(agentType, m, now)
+		p.queue.Record(agentType, m, now)
+		p.forecast.Record(agentType, m, now)
+		p.activate.Record(agentType, m, now)
+
+		if schedule := agentType.Schedules.Active(now); schedule != nil {
+			span.AddEvent("schedule active", trace.WithAttributes(
+				attribute.String("agent_type", agentType.Name),
+				attribute.String("schedule", schedule.String()),
+				attribute.Int("min_agents", schedule.MinAgents),
+			))
+		}
+
+		labels := agentType.Labels()
+		agentTypeValues := common.GenerateForAgentType(agentType, m, now)
+		agentTypeValues = append(agentTypeValues, p.smoother.Generate(agentType.Name, labels, now)...)
+		agentTypeValues = append(agentTypeValues, p.rates.Generate(p.history.Series(agentType.Name), labels, now)...)
+		agentTypeValues = append(agentTypeValues, p.peaks.Generate(p.history.Series(agentType.Name), labels, now)...)
+		agentTypeValues = append(agentTypeValues, p.queue.Generate(agentType.Name, labels, now)...)
+		agentTypeValues = append(agentTypeValues, p.forecast.Generate(agentType.Name, labels, now)...)
+		agentTypeValues = append(agentTypeValues, p.activate.Generate(agentType.Name, labels, now)...)
+
+		values = append(values, agentTypeValues...)
+		values = append(values, p.generateDerived(agentType, agentTypeValues, now)...)
+	}
+
+	values = append(values, p.aggregate.Generate(agentTypes, samples)...)
+
+	p.smoother.Forget(existing)
+	p.history.Forget(existing)
+	p.queue.Forget(existing)
+	p.forecast.Forget(existing)
+	p.activate.Forget(existing)
+	return values
+}
+
+func (p *SemaphoreMetricsProvider) collectAgentDetails(ctx context.Context, agentTypes []*common.AgentType) []metrics.ExternalMetricValue {
+	// Without the pods, only agents_without_pod cannot be calculated.
+	pods, err := p.podFinder.Names(ctx)
+	if err != nil {
+		klog.Errorf("Error finding pods: %v", err)
+	}
+
+	agents := p.config.SemaphoreClient.ListAgents(ctx, agentTypes)
+	values := []metrics.ExternalMetricValue{}
+	now := time.Now()
+
+	for _, agentType := range agentTypes {
+		list, ok := agents[agentType.Name]
+		if !ok {
+			continue
+		}
+
+		details := common.AgentDetails{Agents: list, Pods: pods}
+		values = append(values, details.GenerateAll(agentType.Labels(), now)...)
+	}
+
+	return values
+}
+
+func filterByMetricName(values []metrics.ExternalMetricValue, metricName string) []metrics.ExternalMetricValue {
 	filtered := []metrics.ExternalMetricValue{}
+
 	for _, v := range values {
-		if metricSelector.Matches(&Labels{metric: v}) {
+		if v.MetricName == metricName {
 			filtered = append(filtered, v)
 		}
 	}
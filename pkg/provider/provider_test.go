@@ -0,0 +1,1132 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/semaphore"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	testsupport "github.com/semaphoreci/k8s-metrics-apiserver/test/support"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func Test__Provider(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{
+		Agents: common.AgentMetrics{Idle: 1, Occupied: 2},
+		Jobs:   common.JobMetrics{Running: 2, Queued: 3},
+	})
+
+	apiMock.RegisterAgentType("token-2", common.Metrics{
+		Agents: common.AgentMetrics{Idle: 4, Occupied: 0},
+		Jobs:   common.JobMetrics{Running: 0, Queued: 0},
+	})
+
+	p := newTestProvider(t, apiMock,
+		newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"),
+		newAgentTypeSecret("agent-type-2", apiMock.Host(), "token-2"),
+	)
+
+	t.Run("nothing collected -> service unavailable", func(t *testing.T) {
+		_, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		assert.True(t, apierrors.IsServiceUnavailable(err))
+	})
+
+	p.collectFrom(p.runners[0])
+
+	t.Run("no selector -> all agent types", func(t *testing.T) {
+		list, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		assert.Equal(t, int64(3), list.Items[0].Value.Value())
+		assert.Equal(t, int64(0), list.Items[1].Value.Value())
+	})
+
+	t.Run("selector -> only matching agent types", func(t *testing.T) {
+		selector := labels.SelectorFromSet(labels.Set{"agent_type": "agent-type-2"})
+		list, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricAgentsIdle})
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "agent-type-2", list.Items[0].MetricLabels["agent_type"])
+		assert.Equal(t, int64(4), list.Items[0].Value.Value())
+	})
+
+	t.Run("unknown metric -> not found", func(t *testing.T) {
+		_, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "does-not-exist"})
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "unknown metric does-not-exist")
+	})
+
+	t.Run("unknown agent type -> not found", func(t *testing.T) {
+		selector := labels.SelectorFromSet(labels.Set{"agent_type": "agent-type-3"})
+		_, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "agent type agent-type-3 not found, use one of: agent-type-1, agent-type-2")
+	})
+
+	t.Run("unsupported label in selector -> bad request", func(t *testing.T) {
+		selector := labels.SelectorFromSet(labels.Set{"agent-type": "agent-type-1"})
+		_, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		assert.True(t, apierrors.IsBadRequest(err))
+		assert.ErrorContains(t, err, "label agent-type is not supported in selectors for metric jobs_queued, use one of: agent_type")
+	})
+
+	t.Run("aggregates not configured -> bad request", func(t *testing.T) {
+		selector := labels.SelectorFromSet(labels.Set{"aggregate": "all"})
+		_, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		assert.True(t, apierrors.IsBadRequest(err))
+	})
+
+	t.Run("label for metric -> supported", func(t *testing.T) {
+		selector := labels.SelectorFromSet(labels.Set{"threshold": "0"})
+		list, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: MetricJobsQueuedDuration})
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 2)
+	})
+}
+
+func Test__ProviderWithoutAgentTypes(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	p := newTestProvider(t, apiMock)
+	p.collectFrom(p.runners[0])
+
+	_, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.ErrorContains(t, err, "no agent types found")
+}
+
+func Test__ProviderPublishesSnapshots(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 3}})
+	p := newTestProvider(t, apiMock, newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"))
+	assert.Nil(t, p.currentSnapshot())
+
+	p.collectFrom(p.runners[0])
+	first := p.currentSnapshot()
+	require.NotNil(t, first)
+	assert.Equal(t, uint64(1), first.Generation)
+
+	p.collectFrom(p.runners[0])
+	second := p.currentSnapshot()
+	assert.Equal(t, uint64(2), second.Generation)
+
+	// previous snapshots are not changed by new collections
+	m, ok := first.Metric(common.MetricJobsQueued)
+	require.True(t, ok)
+	assert.Len(t, m.Select(labels.Everything(), false), 1)
+
+	t.Run("reads during collections see whole snapshots", func(t *testing.T) {
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 20; i++ {
+				p.collectFrom(p.runners[0])
+			}
+
+			close(done)
+		}()
+
+		generation := uint64(0)
+		for {
+			select {
+			case <-done:
+				assert.Equal(t, uint64(22), p.currentSnapshot().Generation)
+				return
+			default:
+				snapshot := p.currentSnapshot()
+				assert.GreaterOrEqual(t, snapshot.Generation, generation)
+				generation = snapshot.Generation
+
+				for _, name := range []string{common.MetricJobsQueued, common.MetricAgentsIdle} {
+					m, ok := snapshot.Metric(name)
+					require.True(t, ok)
+					values := m.Select(labels.Everything(), false)
+					require.Len(t, values, 1)
+					assert.False(t, values[0].Timestamp.Time.After(snapshot.CollectedAt))
+				}
+			}
+		}
+	})
+}
+
+func Test__ProviderWithAgentTypeMetricNames(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 2}})
+	apiMock.RegisterAgentType("token-2", common.Metrics{Jobs: common.JobMetrics{Queued: 5}})
+
+	secret1 := newAgentTypeSecret("s1-a", apiMock.Host(), "token-1")
+	secret1.Annotations = map[string]string{AnnotationAllowedNamespaces: common.AllNamespaces}
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+		secret1,
+		newAgentTypeSecret("s1-b", apiMock.Host(), "token-2"),
+	)
+
+	p, err := New(Config{
+		Client:                  client,
+		SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+		QueueDurationThresholds: []int{3},
+		AgentTypeMetricNames:    true,
+	})
+
+	require.NoError(t, err)
+
+	metricNames := func() []string {
+		names := []string{}
+		for _, m := range p.ListAllExternalMetrics() {
+			names = append(names, m.Metric)
+		}
+
+		return names
+	}
+
+	getIn := func(namespace, metricName, selector string) ([]external_metrics.ExternalMetricValue, error) {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		list, err := p.GetExternalMetric(context.Background(), namespace, s, provider.ExternalMetricInfo{Metric: metricName})
+		if err != nil {
+			return nil, err
+		}
+
+		return list.Items, nil
+	}
+
+	get := func(metricName, selector string) ([]external_metrics.ExternalMetricValue, error) {
+		return getIn("default", metricName, selector)
+	}
+
+	t.Run("nothing collected -> only metric names", func(t *testing.T) {
+		assert.NotContains(t, metricNames(), "semaphore-s1-a-jobs_queued")
+	})
+
+	p.collectFrom(p.runners[0])
+
+	t.Run("names for agent types visible in all namespaces are listed", func(t *testing.T) {
+		names := metricNames()
+		assert.Contains(t, names, common.MetricJobsQueued)
+		assert.Contains(t, names, "semaphore-s1-a-jobs_queued")
+		assert.Contains(t, names, "semaphore-s1-a-jobs_queued_duration_seconds")
+		assert.NotContains(t, names, "semaphore-s1-b-jobs_queued")
+	})
+
+	t.Run("names are only resolved where the agent type is visible", func(t *testing.T) {
+		items, err := getIn("team-a", "semaphore-s1-a-jobs_queued", "")
+		require.NoError(t, err)
+		assert.Len(t, items, 1)
+
+		_, err = getIn("team-a", "semaphore-s1-b-jobs_queued", "")
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "agent type s1-b not found, use one of: s1-a")
+	})
+
+	t.Run("name with agent type -> only values for it", func(t *testing.T) {
+		items, err := get("semaphore-s1-b-jobs_queued", "")
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "semaphore-s1-b-jobs_queued", items[0].MetricName)
+		assert.Equal(t, int64(5), items[0].Value.Value())
+	})
+
+	t.Run("name with agent type and selector", func(t *testing.T) {
+		items, err := get("semaphore-s1-a-jobs_queued_duration_seconds", "threshold=3")
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "3", items[0].MetricLabels["threshold"])
+	})
+
+	t.Run("names are updated as agent types disappear", func(t *testing.T) {
+		gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+		require.NoError(t, client.Resource(gvr).Namespace("default").Delete(context.Background(), "s1-a", v1.DeleteOptions{}))
+		p.collectFrom(p.runners[0])
+
+		assert.NotContains(t, metricNames(), "semaphore-s1-a-jobs_queued")
+
+		_, err := get("semaphore-s1-a-jobs_queued", "")
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "agent type s1-a not found, use one of: s1-b")
+	})
+
+	t.Run("disabled -> names are not resolved", func(t *testing.T) {
+		p := newTestProvider(t, apiMock, newAgentTypeSecret("s1-a", apiMock.Host(), "token-1"))
+		p.collectFrom(p.runners[0])
+
+		assert.NotContains(t, p.ListAllExternalMetrics(), provider.ExternalMetricInfo{Metric: "semaphore-s1-a-jobs_queued"})
+		_, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: "semaphore-s1-a-jobs_queued"})
+		assert.ErrorContains(t, err, "unknown metric")
+	})
+}
+
+func Test__ProviderWithMovingAverages(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	p, err := New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme(), newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		EWMAWindows:     []time.Duration{time.Minute},
+	})
+
+	require.NoError(t, err)
+
+	agentTypes, err := p.finder.Find(context.Background())
+	require.NoError(t, err)
+
+	now := time.Now()
+	p.generate(context.Background(), agentTypes, map[string]*common.Metrics{"agent-type-1": {Jobs: common.JobMetrics{Queued: 0}}}, now)
+	values := p.generate(context.Background(), agentTypes, map[string]*common.Metrics{"agent-type-1": {Jobs: common.JobMetrics{Queued: 10}}}, now.Add(time.Minute))
+
+	raw := filterByMetricName(values, common.MetricJobsQueued)
+	smoothed := filterByMetricName(values, "jobs_queued_avg_1m")
+	require.Len(t, raw, 1)
+	require.Len(t, smoothed, 1)
+	assert.Equal(t, 10.0, raw[0].Value.AsApproximateFloat64())
+	assert.InDelta(t, 6.321, smoothed[0].Value.AsApproximateFloat64(), 0.001)
+
+	metricNames := []string{}
+	for _, m := range p.ListAllExternalMetrics() {
+		metricNames = append(metricNames, m.Metric)
+	}
+
+	assert.Contains(t, metricNames, "jobs_queued_avg_1m")
+	assert.NotContains(t, metricNames, "jobs_queued_avg_5m")
+
+	_, err = New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme()),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		EWMAWindows:     []time.Duration{time.Millisecond},
+	})
+
+	assert.ErrorContains(t, err, "invalid EWMA window")
+}
+
+func Test__ProviderWithPeaks(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme(), newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"))
+	store := NewFileHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+	config := Config{
+		Client:          client,
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		MaxWindows:      []time.Duration{10 * time.Minute},
+		HistoryStore:    store,
+	}
+
+	p, err := New(config)
+	require.NoError(t, err)
+
+	agentTypes, err := p.finder.Find(context.Background())
+	require.NoError(t, err)
+
+	now := time.Now()
+	p.generate(context.Background(), agentTypes, map[string]*common.Metrics{"agent-type-1": {Agents: common.AgentMetrics{Occupied: 8}}}, now.Add(-2*time.Minute))
+	p.persistHistory()
+
+	// peak survives a restart
+	restarted, err := New(config)
+	require.NoError(t, err)
+
+	values := restarted.generate(context.Background(), agentTypes, map[string]*common.Metrics{"agent-type-1": {Agents: common.AgentMetrics{Occupied: 2}}}, now)
+	peak := filterByMetricName(values, "agents_occupied_max_10m")
+	require.Len(t, peak, 1)
+	assert.Equal(t, 8.0, peak[0].Value.AsApproximateFloat64())
+
+	_, err = New(Config{
+		Client:          client,
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		MaxWindows:      []time.Duration{time.Second},
+	})
+
+	assert.ErrorContains(t, err, "invalid max window")
+}
+
+func Test__ProviderWithDisabledMetrics(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 2}})
+
+	p, err := New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme(), newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		DisabledMetrics: []string{common.MetricAgentsOccupiedPercentage},
+	})
+
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	metricNames := []string{}
+	for _, m := range p.ListAllExternalMetrics() {
+		metricNames = append(metricNames, m.Metric)
+	}
+
+	assert.Contains(t, metricNames, common.MetricJobsQueued)
+	assert.NotContains(t, metricNames, common.MetricAgentsOccupiedPercentage)
+
+	_, err = p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricAgentsOccupiedPercentage})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.ErrorContains(t, err, "disabled")
+
+	_, err = New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme()),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		DisabledMetrics: []string{"does-not-exist"},
+	})
+
+	assert.ErrorContains(t, err, "unknown metric 'does-not-exist'")
+}
+
+func Test__ProviderWithDerivedMetrics(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{
+		Agents: common.AgentMetrics{Idle: 5},
+		Jobs:   common.JobMetrics{Queued: 2},
+	})
+
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+		newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"),
+		newDerivedMetricsConfigMap("1", "- name: spare_capacity\n  expr: agents_idle - jobs_queued"),
+	)
+
+	p, err := New(Config{
+		Client:                  client,
+		SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+		DerivedMetricsConfigMap: "derived-metrics",
+	})
+
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	metricNames := func() []string {
+		names := []string{}
+		for _, m := range p.ListAllExternalMetrics() {
+			names = append(names, m.Metric)
+		}
+
+		return names
+	}
+
+	get := func(metricName string) []external_metrics.ExternalMetricValue {
+		list, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: metricName})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		require.NoError(t, err)
+		return list.Items
+	}
+
+	assert.Contains(t, metricNames(), "spare_capacity")
+	items := get("spare_capacity")
+	require.Len(t, items, 1)
+	assert.Equal(t, int64(3), items[0].Value.Value())
+	assert.Equal(t, "agent-type-1", items[0].MetricLabels["agent_type"])
+
+	// definitions are reloaded when the configmap changes
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	o := toUnstructured(t, newDerivedMetricsConfigMap("2", "- name: double_queue\n  expr: jobs_queued * 2"))
+	_, err = client.Resource(gvr).Namespace("default").Update(context.Background(), o, v1.UpdateOptions{})
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	assert.NotContains(t, metricNames(), "spare_capacity")
+	assert.Contains(t, metricNames(), "double_queue")
+	assert.Empty(t, get("spare_capacity"))
+	items = get("double_queue")
+	require.Len(t, items, 1)
+	assert.Equal(t, int64(4), items[0].Value.Value())
+
+	// metrics that need a few samples are only used once they have values
+	o = toUnstructured(t, newDerivedMetricsConfigMap("3", "- name: forecast_margin\n  expr: jobs_total_forecast_5m + jobs_total_forecast_5m_error"))
+	_, err = client.Resource(gvr).Namespace("default").Update(context.Background(), o, v1.UpdateOptions{})
+	require.NoError(t, err)
+
+	restarted, err := New(Config{
+		Client:                  client,
+		SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+		DerivedMetricsConfigMap: "derived-metrics",
+	})
+
+	require.NoError(t, err)
+	agentTypes, err := restarted.finder.Find(context.Background())
+	require.NoError(t, err)
+
+	now := time.Now()
+	restarted.reloadDerivedMetrics(context.Background())
+	samples := map[string]*common.Metrics{"agent-type-1": {Jobs: common.JobMetrics{Queued: 2}}}
+	values := restarted.generate(context.Background(), agentTypes, samples, now)
+	assert.Empty(t, filterByMetricName(values, "forecast_margin"))
+
+	// the forecast error is only there once the first forecast is due
+	for i := 1; i <= 30; i++ {
+		values = restarted.generate(context.Background(), agentTypes, samples, now.Add(time.Duration(i)*CollectInterval))
+	}
+
+	margin := filterByMetricName(values, "forecast_margin")
+	require.Len(t, margin, 1)
+	assert.InDelta(t, 2.0, margin[0].Value.AsApproximateFloat64(), 0.01)
+}
+
+func Test__ProviderWithAggregates(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 2}})
+	apiMock.RegisterAgentType("token-2", common.Metrics{Jobs: common.JobMetrics{Queued: 3}})
+	apiMock.RegisterAgentType("token-3", common.Metrics{Jobs: common.JobMetrics{Queued: 7}})
+
+	secret1 := newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")
+	secret1.Labels["pool"] = "arm64"
+	secret2 := newAgentTypeSecret("agent-type-2", apiMock.Host(), "token-2")
+	secret2.Labels["pool"] = "arm64"
+	secret3 := newAgentTypeSecret("agent-type-3", apiMock.Host(), "token-3")
+	secret3.Labels["pool"] = "amd64"
+
+	p, err := New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme(), secret1, secret2, secret3),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+		AggregateBy:     []string{"pool", "all"},
+	})
+
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	get := func(selector string) []external_metrics.ExternalMetricValue {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		list, err := p.GetExternalMetric(context.Background(), "default", s, provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		require.NoError(t, err)
+		return list.Items
+	}
+
+	t.Run("no selector -> only agent types", func(t *testing.T) {
+		assert.Len(t, get(""), 3)
+	})
+
+	t.Run("aggregate by pool", func(t *testing.T) {
+		items := get("aggregate=pool,pool=arm64")
+		require.Len(t, items, 1)
+		assert.Equal(t, int64(5), items[0].Value.Value())
+	})
+
+	t.Run("all pools", func(t *testing.T) {
+		assert.Len(t, get("aggregate=pool"), 2)
+	})
+
+	t.Run("all agent types", func(t *testing.T) {
+		items := get("aggregate=all")
+		require.Len(t, items, 1)
+		assert.Equal(t, int64(12), items[0].Value.Value())
+	})
+}
+
+func Test__ProviderWithCustomMetrics(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 2}})
+	apiMock.RegisterAgentType("token-2", common.Metrics{Jobs: common.JobMetrics{Queued: 5}})
+
+	secret1 := newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")
+	secret1.Annotations = map[string]string{AnnotationAllowedNamespaces: "ci"}
+	secret2 := newAgentTypeSecret("agent-type-2", apiMock.Host(), "token-2")
+	secret2.Annotations = map[string]string{AnnotationAllowedNamespaces: "ci"}
+
+	p, err := New(Config{
+		Client: dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+			secret1,
+			secret2,
+			newDeployment("ci", "agents-1", map[string]string{"app": "agents"}, "agent-type-1"),
+			newDeployment("ci", "agents-2", map[string]string{"app": "agents"}, "agent-type-2"),
+			newDeployment("ci", "agents-3", map[string]string{"app": "agents"}, "does-not-exist"),
+			newDeployment("ci", "web", map[string]string{"app": "web"}, ""),
+		),
+		Mapper:                  newTestMapper(),
+		SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+		QueueDurationThresholds: []int{3},
+	})
+
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	info := provider.CustomMetricInfo{GroupResource: deployments, Namespaced: true, Metric: common.MetricJobsQueued}
+
+	t.Run("metrics are listed for workload resources", func(t *testing.T) {
+		assert.Contains(t, p.ListAllMetrics(), info)
+	})
+
+	t.Run("annotated workload -> value for its agent type", func(t *testing.T) {
+		v, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "agents-2"}, info, labels.Everything())
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), v.Value.Value())
+		assert.Equal(t, common.MetricJobsQueued, v.Metric.Name)
+		assert.Equal(t, "Deployment", v.DescribedObject.Kind)
+		assert.Equal(t, "agents-2", v.DescribedObject.Name)
+	})
+
+	t.Run("metric selector picks value", func(t *testing.T) {
+		info := provider.CustomMetricInfo{GroupResource: deployments, Namespaced: true, Metric: MetricJobsQueuedDuration}
+		selector := labels.SelectorFromSet(labels.Set{"threshold": "3"})
+		v, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "agents-1"}, info, selector)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), v.Value.Value())
+	})
+
+	t.Run("workload without annotation -> not found", func(t *testing.T) {
+		_, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "web"}, info, labels.Everything())
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("unknown agent type -> not found", func(t *testing.T) {
+		_, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "agents-3"}, info, labels.Everything())
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("unsupported resource -> not found", func(t *testing.T) {
+		info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: common.MetricJobsQueued}
+		_, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ci", Name: "agents-1"}, info, labels.Everything())
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("selector -> values for matching annotated workloads", func(t *testing.T) {
+		list, err := p.GetMetricBySelector(context.Background(), "ci", labels.Everything(), info, labels.Everything())
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		assert.Equal(t, "agents-1", list.Items[0].DescribedObject.Name)
+		assert.Equal(t, int64(2), list.Items[0].Value.Value())
+		assert.Equal(t, "agents-2", list.Items[1].DescribedObject.Name)
+		assert.Equal(t, int64(5), list.Items[1].Value.Value())
+	})
+
+	t.Run("no mapper -> no custom metrics", func(t *testing.T) {
+		assert.Empty(t, newTestProvider(t, apiMock).ListAllMetrics())
+	})
+}
+
+func Test__ProviderWithNamespaceVisibility(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 2}})
+	apiMock.RegisterAgentType("token-2", common.Metrics{Jobs: common.JobMetrics{Queued: 5}})
+
+	secret1 := newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")
+	secret1.Labels["pool"] = "shared"
+	secret1.Annotations = map[string]string{AnnotationAllowedNamespaces: "team-a, team-b"}
+	secret2 := newAgentTypeSecret("agent-type-2", apiMock.Host(), "token-2")
+	secret2.Labels["pool"] = "shared"
+	secret2.Annotations = map[string]string{AnnotationAllowedNamespaces: "team-b"}
+
+	newProvider := func(response string) *SemaphoreMetricsProvider {
+		p, err := New(Config{
+			Client: dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+				secret1,
+				secret2,
+				newDeployment("team-a", "agents-1", map[string]string{}, "agent-type-1"),
+				newDeployment("team-a", "agents-2", map[string]string{}, "agent-type-2"),
+			),
+			Mapper:                  newTestMapper(),
+			SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+			AggregateBy:             []string{"pool"},
+			DeniedNamespaceResponse: response,
+		})
+
+		require.NoError(t, err)
+		p.collectFrom(p.runners[0])
+		return p
+	}
+
+	get := func(p *SemaphoreMetricsProvider, namespace, selector string) ([]external_metrics.ExternalMetricValue, error) {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		list, err := p.GetExternalMetric(context.Background(), namespace, s, provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+		if err != nil {
+			return nil, err
+		}
+
+		return list.Items, nil
+	}
+
+	info := provider.CustomMetricInfo{GroupResource: deployments, Namespaced: true, Metric: common.MetricJobsQueued}
+
+	t.Run("invalid response -> error", func(t *testing.T) {
+		_, err := New(Config{
+			Client:                  dynamicfake.NewSimpleDynamicClient(newTestScheme()),
+			SemaphoreClient:         semaphore.NewClient(http.DefaultClient, true),
+			DeniedNamespaceResponse: "nope",
+		})
+
+		assert.Error(t, err)
+	})
+
+	t.Run("only agent types visible in namespace are returned", func(t *testing.T) {
+		p := newProvider("")
+
+		items, err := get(p, "default", "")
+		require.NoError(t, err)
+		assert.Len(t, items, 2)
+
+		items, err = get(p, "team-a", "")
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "agent-type-1", items[0].MetricLabels["agent_type"])
+
+		items, err = get(p, "team-b", "")
+		require.NoError(t, err)
+		assert.Len(t, items, 2)
+
+		_, err = get(p, "team-c", "")
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("hidden agent type -> same response as missing one", func(t *testing.T) {
+		p := newProvider(DeniedNamespaceEmpty)
+
+		_, hiddenErr := get(p, "team-a", "agent_type=agent-type-2")
+		_, missingErr := get(p, "team-a", "agent_type=agent-type-3")
+		assert.True(t, apierrors.IsNotFound(hiddenErr))
+		assert.True(t, apierrors.IsNotFound(missingErr))
+		assert.Equal(t, "agent type agent-type-2 not found, use one of: agent-type-1", hiddenErr.Error())
+		assert.Equal(t, "agent type agent-type-3 not found, use one of: agent-type-1", missingErr.Error())
+
+		_, hiddenErr = get(p, "team-a", "aggregate=pool,pool=shared")
+		_, missingErr = get(p, "team-a", "aggregate=pool,pool=other")
+		assert.True(t, apierrors.IsNotFound(hiddenErr))
+		assert.True(t, apierrors.IsNotFound(missingErr))
+		assert.Equal(t, "no values for metric jobs_queued match selector aggregate=pool,pool=shared", hiddenErr.Error())
+		assert.Equal(t, "no values for metric jobs_queued match selector aggregate=pool,pool=other", missingErr.Error())
+	})
+
+	t.Run("aggregates are visible only where all agent types are", func(t *testing.T) {
+		p := newProvider(DeniedNamespaceEmpty)
+
+		items, err := get(p, "team-b", "aggregate=pool")
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, int64(7), items[0].Value.Value())
+
+		_, err = get(p, "team-a", "aggregate=pool")
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("forbidden response", func(t *testing.T) {
+		p := newProvider(DeniedNamespaceForbidden)
+
+		_, err := get(p, "team-c", "")
+		assert.True(t, apierrors.IsForbidden(err))
+
+		_, err = get(p, "team-a", "agent_type=agent-type-2")
+		assert.True(t, apierrors.IsForbidden(err))
+
+		// some values are visible, so only those are returned
+		items, err := get(p, "team-a", "")
+		require.NoError(t, err)
+		assert.Len(t, items, 1)
+	})
+
+	t.Run("custom metrics for workloads in namespaces where agent type is not visible", func(t *testing.T) {
+		p := newProvider(DeniedNamespaceEmpty)
+
+		v, err := p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "agents-1"}, info, labels.Everything())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), v.Value.Value())
+
+		_, err = p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "agents-2"}, info, labels.Everything())
+		assert.True(t, apierrors.IsNotFound(err))
+
+		list, err := p.GetMetricBySelector(context.Background(), "team-a", labels.Everything(), info, labels.Everything())
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+
+		p = newProvider(DeniedNamespaceForbidden)
+		_, err = p.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "agents-2"}, info, labels.Everything())
+		assert.True(t, apierrors.IsForbidden(err))
+	})
+}
+
+func Test__ProviderWithSources(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{Jobs: common.JobMetrics{Queued: 3}})
+
+	teams, err := NewStaticSource("teams", []SourceMetricSpec{
+		{Name: "min_agents", Labels: map[string]string{"team": "mobile"}, Value: 2},
+		{Name: "min_agents", Labels: map[string]string{"team": "web"}, Value: 1},
+	})
+
+	require.NoError(t, err)
+
+	builds := &fakeSource{name: "builds", values: []external_metrics.ExternalMetricValue{
+		{MetricName: "builds_pending", Value: common.NewQuantity(4), MetricLabels: map[string]string{}},
+	}}
+
+	failSecrets := true
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme(), newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"))
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failSecrets {
+			return true, nil, fmt.Errorf("forbidden")
+		}
+
+		return false, nil, nil
+	})
+
+	p, err := New(Config{
+		Client:                client,
+		SemaphoreClient:       semaphore.NewClient(http.DefaultClient, true),
+		SemaphoreMetricPrefix: "semaphore_",
+		Sources: []Source{
+			{Source: teams, Prefix: "team_", Namespaces: []string{"ci"}},
+			{Source: builds, Namespaces: []string{common.AllNamespaces}},
+		},
+	})
+
+	require.NoError(t, err)
+
+	get := func(namespace, selector, metric string) (*external_metrics.ExternalMetricValueList, error) {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+		return p.GetExternalMetric(context.Background(), namespace, s, provider.ExternalMetricInfo{Metric: metric})
+	}
+
+	t.Run("nothing published until semaphore metrics are collected", func(t *testing.T) {
+		p.collectFrom(p.runners[1])
+		assert.Nil(t, p.currentSnapshot())
+
+		p.collectFrom(p.runners[0])
+		assert.Nil(t, p.currentSnapshot())
+
+		_, err := get("default", "", "team_min_agents")
+		assert.True(t, apierrors.IsServiceUnavailable(err))
+	})
+
+	t.Run("sources are published without waiting for each other", func(t *testing.T) {
+		failSecrets = false
+		p.collectFrom(p.runners[0])
+		require.NotNil(t, p.currentSnapshot())
+		assert.Equal(t, uint64(1), p.currentSnapshot().Generation)
+
+		list, err := get("ci", "", "team_min_agents")
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 2)
+
+		_, err = get("default", "", "builds_pending")
+		assert.True(t, apierrors.IsNotFound(err))
+
+		p.collectFrom(p.runners[2])
+		assert.Equal(t, uint64(2), p.currentSnapshot().Generation)
+	})
+
+	t.Run("metrics from all sources are listed", func(t *testing.T) {
+		names := []string{}
+		for _, info := range p.ListAllExternalMetrics() {
+			names = append(names, info.Metric)
+		}
+
+		assert.Contains(t, names, "semaphore_jobs_queued")
+		assert.Contains(t, names, "team_min_agents")
+		assert.Contains(t, names, "builds_pending")
+		assert.NotContains(t, names, common.MetricJobsQueued)
+	})
+
+	t.Run("semaphore metrics have the prefix", func(t *testing.T) {
+		list, err := get("default", "", "semaphore_jobs_queued")
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "semaphore_jobs_queued", list.Items[0].MetricName)
+		assert.Equal(t, int64(3), list.Items[0].Value.Value())
+
+		_, err = get("default", "", common.MetricJobsQueued)
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "unknown metric jobs_queued")
+	})
+
+	t.Run("source metric with selector", func(t *testing.T) {
+		list, err := get("ci", "team=mobile", "team_min_agents")
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "team_min_agents", list.Items[0].MetricName)
+		assert.Equal(t, int64(2), list.Items[0].Value.Value())
+
+		_, err = get("ci", "team=ios", "team_min_agents")
+		assert.True(t, apierrors.IsNotFound(err))
+		assert.ErrorContains(t, err, "no values for metric team_min_agents from source teams match selector team=ios")
+	})
+
+	t.Run("unsupported label for source metric -> bad request", func(t *testing.T) {
+		_, err := get("ci", "agent_type=agent-type-1", "team_min_agents")
+		assert.True(t, apierrors.IsBadRequest(err))
+		assert.ErrorContains(t, err, "use one of: team")
+	})
+
+	t.Run("source metric not visible in namespace -> same response as missing values", func(t *testing.T) {
+		_, hiddenErr := get("default", "team=mobile", "team_min_agents")
+		_, missingErr := get("default", "team=ios", "team_min_agents")
+		assert.True(t, apierrors.IsNotFound(hiddenErr))
+		assert.True(t, apierrors.IsNotFound(missingErr))
+		assert.Equal(t, "no values for metric team_min_agents from source teams match selector team=mobile", hiddenErr.Error())
+
+		list, err := get("default", "", "builds_pending")
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+	})
+
+	t.Run("failing source keeps its previous values", func(t *testing.T) {
+		builds.err = fmt.Errorf("connection refused")
+		defer func() { builds.err = nil }()
+
+		generation := p.currentSnapshot().Generation
+		p.collectFrom(p.runners[2])
+		assert.Equal(t, generation+1, p.currentSnapshot().Generation)
+
+		list, err := get("default", "", "builds_pending")
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+	})
+
+	t.Run("panicking source does not affect other sources", func(t *testing.T) {
+		builds.panics = true
+		defer func() { builds.panics = false }()
+
+		assert.NotPanics(t, func() { p.collectFrom(p.runners[2]) })
+		p.collectFrom(p.runners[0])
+
+		list, err := get("default", "", "semaphore_jobs_queued")
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+
+		list, err = get("default", "", "builds_pending")
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+	})
+
+	t.Run("names already exposed by another source are ignored", func(t *testing.T) {
+		builds.values = append(builds.values, external_metrics.ExternalMetricValue{
+			MetricName:   "semaphore_jobs_queued",
+			Value:        common.NewQuantity(100),
+			MetricLabels: map[string]string{},
+		})
+
+		p.collectFrom(p.runners[2])
+
+		list, err := get("default", "", "semaphore_jobs_queued")
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, "agent-type-1", list.Items[0].MetricLabels["agent_type"])
+		assert.Equal(t, int64(3), list.Items[0].Value.Value())
+	})
+
+	t.Run("sources are collected concurrently", func(t *testing.T) {
+		generation := p.currentSnapshot().Generation
+
+		var wg sync.WaitGroup
+		for _, r := range p.runners {
+			wg.Add(1)
+			go func(r *sourceRunner) {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					p.collectFrom(r)
+				}
+			}(r)
+		}
+
+		wg.Wait()
+		assert.Equal(t, generation+15, p.currentSnapshot().Generation)
+	})
+
+	t.Run("invalid prefix -> error", func(t *testing.T) {
+		_, err := New(Config{
+			Client:                dynamicfake.NewSimpleDynamicClient(newTestScheme()),
+			SemaphoreMetricPrefix: "semaphore-",
+		})
+
+		assert.ErrorContains(t, err, "invalid metric prefix 'semaphore-'")
+	})
+}
+
+func Test__ProviderWithAgentDetails(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{})
+	apiMock.RegisterAgents("token-1", []common.Agent{
+		{Name: "a", Version: "v2.2.0", Hostname: "pod-a", ConnectedAt: time.Now()},
+		{Name: "b", Version: "v2.2.0", Hostname: "pod-b", ConnectedAt: time.Now()},
+	})
+
+	p, err := New(Config{
+		Client: dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+			newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"),
+			&corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "pod-a", Namespace: "default"}},
+		),
+		SemaphoreClient:     semaphore.NewClient(http.DefaultClient, true),
+		CollectAgentDetails: true,
+	})
+
+	require.NoError(t, err)
+	p.collectFrom(p.runners[0])
+
+	metricNames := []string{}
+	for _, m := range p.ListAllExternalMetrics() {
+		metricNames = append(metricNames, m.Metric)
+	}
+
+	for _, definition := range common.AgentDetailMetrics {
+		assert.Contains(t, metricNames, definition.Name)
+	}
+
+	list, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricAgentsWithoutPod})
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, int64(1), list.Items[0].Value.Value())
+
+	selector := labels.SelectorFromSet(labels.Set{"agent_type": "agent-type-1", "version": "v2.2.0"})
+	list, err = p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricAgentsByVersion})
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, int64(2), list.Items[0].Value.Value())
+
+	t.Run("pods cannot be listed -> only agents_without_pod is missing", func(t *testing.T) {
+		client := dynamicfake.NewSimpleDynamicClient(newTestScheme(), newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1"))
+		client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, fmt.Errorf("forbidden")
+		})
+
+		p, err := New(Config{
+			Client:              client,
+			SemaphoreClient:     semaphore.NewClient(http.DefaultClient, true),
+			CollectAgentDetails: true,
+		})
+
+		require.NoError(t, err)
+		p.collectFrom(p.runners[0])
+
+		_, err = p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricAgentsWithoutPod})
+		assert.True(t, apierrors.IsNotFound(err))
+
+		list, err := p.GetExternalMetric(context.Background(), "default", selector, provider.ExternalMetricInfo{Metric: common.MetricAgentsByVersion})
+		require.NoError(t, err)
+		require.Len(t, list.Items, 1)
+		assert.Equal(t, int64(2), list.Items[0].Value.Value())
+	})
+}
+
+func Test__ProviderIsTraced(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(tracing.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	apiMock.RegisterAgentType("token-1", common.Metrics{})
+	secret := newAgentTypeSecret("agent-type-1", apiMock.Host(), "token-1")
+	secret.Annotations = map[string]string{AnnotationSchedules: "daily 00:00-24:00 UTC min=3"}
+	p := newTestProvider(t, apiMock, secret)
+	p.collectFrom(p.runners[0])
+
+	_, err := p.GetExternalMetric(context.Background(), "default", labels.Everything(), provider.ExternalMetricInfo{Metric: common.MetricJobsQueued})
+	require.NoError(t, err)
+
+	spans := map[string]*sdktrace.SpanSnapshot{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	collect := spans["SemaphoreMetricsProvider.Collect"]
+	require.NotNil(t, collect)
+
+	// discovery and requests are part of the collection trace
+	for _, name := range []string{"AgentTypeFinder.Find", "AgentTypeFinder.findAgentType", "Semaphore API: GET self_hosted_agents/metrics"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, collect.SpanContext.TraceID(), spans[name].SpanContext.TraceID())
+		}
+	}
+
+	// the active schedules are on the collection span
+	if assert.Len(t, collect.MessageEvents, 1) {
+		event := collect.MessageEvents[0]
+		assert.Equal(t, "schedule active", event.Name)
+		assert.Contains(t, event.Attributes, attribute.String("agent_type", "agent-type-1"))
+		assert.Contains(t, event.Attributes, attribute.String("schedule", "daily 00:00-24:00 UTC min=3"))
+		assert.Contains(t, event.Attributes, attribute.Int("min_agents", 3))
+	}
+
+	// reads are linked to the collection that produced the data
+	read := spans["SemaphoreMetricsProvider.GetExternalMetric"]
+	require.NotNil(t, read)
+	if assert.Len(t, read.Links, 1) {
+		assert.Equal(t, collect.SpanContext.SpanID(), read.Links[0].SpanID())
+	}
+}
+
+func newTestProvider(t *testing.T, apiMock *testsupport.APIMockServer, objects ...runtime.Object) *SemaphoreMetricsProvider {
+	p, err := New(Config{
+		Client:          dynamicfake.NewSimpleDynamicClient(newTestScheme(), objects...),
+		SemaphoreClient: semaphore.NewClient(http.DefaultClient, true),
+	})
+
+	require.NoError(t, err)
+	return p
+}
+
+func newAgentTypeSecret(name, endpoint, token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"semaphore-agent/autoscaled": "true"},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"endpoint": []byte(endpoint),
+			"token":    []byte(token),
+		},
+	}
+}
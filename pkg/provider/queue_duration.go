@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// How long jobs_queued has been continuously above a threshold, for each agent type.
+// The threshold is exposed as a label, e.g. threshold=10, and a threshold of 0 is always present.
+const MetricJobsQueuedDuration = "jobs_queued_duration_seconds"
+
+var QueueDurationDefinition = common.MetricDefinition{
+	Name:        MetricJobsQueuedDuration,
+	Description: "How long `jobs_queued` has been continuously above the threshold.",
+	Unit:        "seconds",
+	Labels:      []string{"threshold"},
+}
+
+// QueueDurations tracks, for each agent type and threshold,
+// since when the number of queued jobs has been above the threshold.
+type QueueDurations struct {
+	thresholds []int
+	maxGap     time.Duration
+	streaks    map[string]*queueStreaks
+}
+
+type queueStreaks struct {
+	source string
+	last   time.Time
+
+	// When the current streak above each threshold started.
+	// Zero if the number of queued jobs is not above the threshold.
+	since map[int]time.Time
+}
+
+func NewQueueDurations(thresholds []int, maxGap time.Duration) *QueueDurations {
+	unique := map[int]bool{0: true}
+	for _, threshold := range thresholds {
+		unique[threshold] = true
+	}
+
+	sorted := []int{}
+	for threshold := range unique {
+		sorted = append(sorted, threshold)
+	}
+
+	sort.Ints(sorted)
+	return &QueueDurations{
+		thresholds: sorted,
+		maxGap:     maxGap,
+		streaks:    map[string]*queueStreaks{},
+	}
+}
+
+// Record updates the streaks for an agent type with a new sample.
+// After a gap in the collection, or if the agent type now points somewhere else,
+// we don't know what happened in between, so the streaks start over at this sample.
+func (q *QueueDurations) Record(agentType *common.AgentType, m *common.Metrics, at time.Time) {
+	s := sourceOf(agentType)
+	streaks, ok := q.streaks[agentType.Name]
+	if !ok || streaks.source != s || at.Sub(streaks.last) > q.maxGap {
+		streaks = &queueStreaks{source: s, since: map[int]time.Time{}}
+		q.streaks[agentType.Name] = streaks
+	}
+
+	if !at.After(streaks.last) {
+		return
+	}
+
+	streaks.last = at
+	for _, threshold := range q.thresholds {
+		if m.Jobs.Queued <= threshold {
+			streaks.since[threshold] = time.Time{}
+			continue
+		}
+
+		if streaks.since[threshold].IsZero() {
+			streaks.since[threshold] = at
+		}
+	}
+}
+
+// Generate returns how long the queue has been above each threshold for an agent type.
+func (q *QueueDurations) Generate(agentType string, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+
+	streaks, ok := q.streaks[agentType]
+	if !ok {
+		return values
+	}
+
+	for _, threshold := range q.thresholds {
+		duration := 0.0
+		if since := streaks.since[threshold]; !since.IsZero() {
+			duration = now.Sub(since).Seconds()
+		}
+
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   MetricJobsQueuedDuration,
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(duration),
+			MetricLabels: common.WithLabels(labels, "threshold", strconv.Itoa(threshold)),
+		})
+	}
+
+	return values
+}
+
+// Forget drops the streaks for agent types that do not exist anymore.
+func (q *QueueDurations) Forget(existing map[string]bool) {
+	for agentType := range q.streaks {
+		if !existing[agentType] {
+			delete(q.streaks, agentType)
+		}
+	}
+}
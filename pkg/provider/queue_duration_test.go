@@ -0,0 +1,88 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__QueueDurations(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	agentType := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t1"}
+
+	durations := func(q *QueueDurations, now time.Time) map[string]float64 {
+		values := map[string]float64{}
+		for _, v := range q.Generate("s1-a", agentType.Labels(), now) {
+			assert.Equal(t, MetricJobsQueuedDuration, v.MetricName)
+			assert.Equal(t, "s1-a", v.MetricLabels["agent_type"])
+			values[v.MetricLabels["threshold"]] = v.Value.AsApproximateFloat64()
+		}
+
+		return values
+	}
+
+	queued := func(n int) *common.Metrics {
+		return &common.Metrics{Jobs: common.JobMetrics{Queued: n}}
+	}
+
+	t.Run("unknown agent type -> no values", func(t *testing.T) {
+		q := NewQueueDurations([]int{}, 30*time.Second)
+		assert.Empty(t, q.Generate("s1-a", agentType.Labels(), start))
+	})
+
+	t.Run("threshold 0 is always present, and thresholds are deduplicated", func(t *testing.T) {
+		q := NewQueueDurations([]int{10, 5, 10}, 30*time.Second)
+		q.Record(agentType, queued(0), start)
+		assert.Equal(t, map[string]float64{"0": 0, "5": 0, "10": 0}, durations(q, start))
+	})
+
+	t.Run("duration grows while queue stays above threshold", func(t *testing.T) {
+		q := NewQueueDurations([]int{5}, 30*time.Second)
+		q.Record(agentType, queued(3), start)
+		q.Record(agentType, queued(8), start.Add(10*time.Second))
+		q.Record(agentType, queued(2), start.Add(20*time.Second))
+		q.Record(agentType, queued(9), start.Add(30*time.Second))
+
+		values := durations(q, start.Add(30*time.Second))
+		assert.Equal(t, 30.0, values["0"])
+		assert.Equal(t, 0.0, values["5"])
+
+		q.Record(agentType, queued(7), start.Add(40*time.Second))
+		values = durations(q, start.Add(40*time.Second))
+		assert.Equal(t, 40.0, values["0"])
+		assert.Equal(t, 10.0, values["5"])
+	})
+
+	t.Run("empty queue -> zero", func(t *testing.T) {
+		q := NewQueueDurations([]int{}, 30*time.Second)
+		q.Record(agentType, queued(3), start)
+		q.Record(agentType, queued(0), start.Add(10*time.Second))
+		assert.Equal(t, 0.0, durations(q, start.Add(10*time.Second))["0"])
+	})
+
+	t.Run("streak starts over after a gap", func(t *testing.T) {
+		q := NewQueueDurations([]int{}, 30*time.Second)
+		q.Record(agentType, queued(3), start)
+		q.Record(agentType, queued(3), start.Add(5*time.Minute))
+		assert.Equal(t, 0.0, durations(q, start.Add(5*time.Minute))["0"])
+	})
+
+	t.Run("streak starts over when source changes", func(t *testing.T) {
+		q := NewQueueDurations([]int{}, 30*time.Second)
+		q.Record(agentType, queued(3), start)
+
+		rotated := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t2"}
+		q.Record(rotated, queued(3), start.Add(10*time.Second))
+		assert.Equal(t, 0.0, durations(q, start.Add(10*time.Second))["0"])
+	})
+
+	t.Run("forgets agent types that are gone", func(t *testing.T) {
+		q := NewQueueDurations([]int{}, 30*time.Second)
+		q.Record(agentType, queued(3), start)
+		q.Forget(map[string]bool{})
+		require.Empty(t, q.Generate("s1-a", agentType.Labels(), start))
+	})
+}
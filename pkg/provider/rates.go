@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Metrics for which the rate of change is exposed, e.g. jobs_queued_rate_per_minute.
+var RateMetrics = []string{
+	common.MetricJobsQueued,
+	common.MetricJobsTotal,
+}
+
+// Two minutes is long enough to smooth out a single noisy sample,
+// while still reacting quickly to a growing queue.
+const DefaultRateWindow = 2 * time.Minute
+
+func RateDefinitions() []common.MetricDefinition {
+	definitions := []common.MetricDefinition{}
+	for _, metricName := range RateMetrics {
+		definitions = append(definitions, common.MetricDefinition{
+			Name:        rateMetricName(metricName),
+			Description: fmt.Sprintf("How fast `%s` is changing, from the samples in the rate window. Negative when decreasing.", metricName),
+			Unit:        unitOf(metricName) + "/minute",
+		})
+	}
+
+	return definitions
+}
+
+func rateMetricName(metricName string) string {
+	return metricName + "_rate_per_minute"
+}
+
+// Rates calculates how fast metrics change, per minute,
+// from the contiguous samples in a trailing window.
+type Rates struct {
+	window time.Duration
+	maxGap time.Duration
+}
+
+func NewRates(window, maxGap time.Duration) *Rates {
+	return &Rates{window: window, maxGap: maxGap}
+}
+
+func (r *Rates) Generate(series *TimeSeries, labels map[string]string, now time.Time) []external_metrics.ExternalMetricValue {
+	values := []external_metrics.ExternalMetricValue{}
+	samples := series.Contiguous(now.Add(-r.window), r.maxGap)
+
+	for _, metricName := range RateMetrics {
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   rateMetricName(metricName),
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(ratePerMinute(samples, metricName)),
+			MetricLabels: labels,
+		})
+	}
+
+	return values
+}
+
+// Uses the least squares slope of the samples, so a single noisy
+// sample at either end of the window does not dominate the rate.
+// With less than two samples, there is no change to measure, so the rate is zero.
+func ratePerMinute(samples []Sample, metricName string) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	start := samples[0].At
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range samples {
+		x := sample.At.Sub(start).Minutes()
+		y := sample.Metrics.Calc(metricName)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator
+}
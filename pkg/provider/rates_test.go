@@ -0,0 +1,75 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__Rates(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewRates(2*time.Minute, 30*time.Second)
+
+	generate := func(ts *TimeSeries, now time.Time) map[string]float64 {
+		values := map[string]float64{}
+		for _, v := range r.Generate(ts, map[string]string{}, now) {
+			values[v.MetricName] = v.Value.AsApproximateFloat64()
+		}
+
+		return values
+	}
+
+	t.Run("no samples -> zero", func(t *testing.T) {
+		values := generate(NewTimeSeries(time.Hour), start)
+		assert.Equal(t, 0.0, values["jobs_queued_rate_per_minute"])
+		assert.Equal(t, 0.0, values["jobs_total_rate_per_minute"])
+	})
+
+	t.Run("single sample -> zero", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 10))
+		assert.Equal(t, 0.0, generate(ts, start)["jobs_queued_rate_per_minute"])
+	})
+
+	t.Run("growing queue -> positive rate", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		for i := 0; i <= 6; i++ {
+			ts.Add(Sample{
+				At: start.Add(time.Duration(i) * 10 * time.Second),
+				Metrics: common.Metrics{
+					Jobs: common.JobMetrics{Queued: 2 * i, Running: 5},
+				},
+			})
+		}
+
+		values := generate(ts, start.Add(time.Minute))
+		assert.InDelta(t, 12.0, values["jobs_queued_rate_per_minute"], 0.001)
+		assert.InDelta(t, 12.0, values["jobs_total_rate_per_minute"], 0.001)
+	})
+
+	t.Run("shrinking queue -> negative rate", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 10))
+		ts.Add(sampleAt(start.Add(30*time.Second), 5))
+		assert.InDelta(t, -10.0, generate(ts, start.Add(30*time.Second))["jobs_queued_rate_per_minute"], 0.001)
+	})
+
+	t.Run("samples outside of the window are not used", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 100))
+		ts.Add(sampleAt(start.Add(3*time.Minute), 0))
+		ts.Add(sampleAt(start.Add(3*time.Minute+20*time.Second), 0))
+		assert.Equal(t, 0.0, generate(ts, start.Add(3*time.Minute+20*time.Second))["jobs_queued_rate_per_minute"])
+	})
+
+	t.Run("samples before a gap are not used", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 0))
+		ts.Add(sampleAt(start.Add(10*time.Second), 0))
+		ts.Add(sampleAt(start.Add(90*time.Second), 50))
+		ts.Add(sampleAt(start.Add(100*time.Second), 50))
+		assert.Equal(t, 0.0, generate(ts, start.Add(100*time.Second))["jobs_queued_rate_per_minute"])
+	})
+}
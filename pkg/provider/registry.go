@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+)
+
+// NewRegistry returns the definitions for all the metrics
+// exposed with the given configuration, without the disabled ones.
+func NewRegistry(config Config) (*common.Registry, error) {
+	registry := common.NewRegistry()
+	definitions := [][]common.MetricDefinition{
+		common.BaseMetrics,
+		common.AgentTypeMetrics,
+		NewSmoother(config.EWMAWindows).Definitions(),
+		RateDefinitions(),
+		NewPeaks(config.MaxWindows).Definitions(),
+		{QueueDurationDefinition},
+		NewForecaster(forecastHorizon(config), config.ForecastSeasonality, MaxSampleGap).Definitions(),
+		{NewActivation(activationGracePeriod(config)).Definition()},
+	}
+
+	if config.CollectAgentDetails {
+		definitions = append(definitions, common.AgentDetailMetrics)
+	}
+
+	for _, d := range definitions {
+		if err := registry.Register(d...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := registry.Disable(config.DisabledMetrics...); err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+func forecastHorizon(config Config) time.Duration {
+	if config.ForecastHorizon == 0 {
+		return DefaultForecastHorizon
+	}
+
+	return config.ForecastHorizon
+}
+
+func activationGracePeriod(config Config) time.Duration {
+	if config.ActivationGracePeriod == nil {
+		return DefaultActivationGracePeriod
+	}
+
+	return *config.ActivationGracePeriod
+}
+
+// Derived metrics can use the metrics generated for an agent type without extra labels,
+// and cannot use the same name as any other metric, even a disabled one.
+func derivedMetricNames(registry *common.Registry) (variables, reserved map[string]bool) {
+	variables = map[string]bool{}
+	reserved = map[string]bool{}
+
+	agentDetails := map[string]bool{}
+	for _, definition := range common.AgentDetailMetrics {
+		agentDetails[definition.Name] = true
+	}
+
+	for _, definition := range registry.Registered() {
+		reserved[definition.Name] = true
+		if len(definition.Labels) == 0 && !agentDetails[definition.Name] {
+			variables[definition.Name] = true
+		}
+	}
+
+	return variables, reserved
+}
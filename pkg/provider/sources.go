@@ -0,0 +1,303 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Name of the source for the Semaphore metrics.
+const SemaphoreSourceName = "semaphore"
+
+// MetricsSource is a backend the provider collects metrics from.
+// Semaphore is always one of them, and others can be configured,
+// with their metrics exposed alongside the Semaphore ones.
+type MetricsSource interface {
+	// Name identifies the source in logs, traces and errors.
+	Name() string
+
+	// Collect returns the current values for the source metrics, without the prefix.
+	Collect(ctx context.Context) ([]metrics.ExternalMetricValue, error)
+}
+
+// Sources whose values are for agent types, which are only visible in their namespaces,
+// tell which agent types they found in the last collection.
+type agentTypeSource interface {
+	AgentTypes() []*common.AgentType
+}
+
+// Source is a metrics source other than Semaphore, and how it is collected.
+type Source struct {
+	Source MetricsSource
+
+	// Added to the names of the source metrics, e.g. queue_.
+	Prefix string
+
+	// How often the source is collected, and how long a collection can take.
+	// Default to CollectInterval and CollectTimeout.
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Namespaces where the source metrics can be read, or "*" for all of them.
+	Namespaces []string
+}
+
+func (s *Source) Name() string {
+	return s.Source.Name()
+}
+
+// Prefixes become part of metric names, so they follow the same rules.
+// Dashes are not allowed, since they separate agent types from metric names.
+var metricPrefixRegex = regexp.MustCompile(`^([a-z][a-z0-9_]*)?$`)
+
+func validatePrefix(prefix string) error {
+	if !metricPrefixRegex.MatchString(prefix) {
+		return fmt.Errorf("invalid metric prefix '%s': must match %s", prefix, metricPrefixRegex.String())
+	}
+
+	return nil
+}
+
+func (s *Source) validate() error {
+	if s.Source == nil || s.Source.Name() == "" {
+		return fmt.Errorf("source must have a name")
+	}
+
+	name := s.Name()
+	if err := validatePrefix(s.Prefix); err != nil {
+		return fmt.Errorf("source %s: %v", name, err)
+	}
+
+	if s.Interval <= 0 {
+		return fmt.Errorf("source %s: invalid interval %v: must be positive", name, s.Interval)
+	}
+
+	if s.Timeout <= 0 || s.Timeout > s.Interval {
+		return fmt.Errorf("source %s: invalid timeout %v: must be positive, and at most the interval", name, s.Timeout)
+	}
+
+	if len(s.Namespaces) == 0 {
+		return fmt.Errorf("source %s: no namespaces, use %s for all namespaces", name, common.AllNamespaces)
+	}
+
+	return nil
+}
+
+// Validates the sources, and sets the defaults for their schedules.
+func validateSources(sources []Source) ([]Source, error) {
+	names := map[string]bool{SemaphoreSourceName: true}
+	validated := []Source{}
+	for _, source := range sources {
+		if source.Interval == 0 {
+			source.Interval = CollectInterval
+		}
+
+		if source.Timeout == 0 {
+			source.Timeout = CollectTimeout
+		}
+
+		if err := source.validate(); err != nil {
+			return nil, err
+		}
+
+		if names[source.Name()] {
+			return nil, fmt.Errorf("source %s is already defined", source.Name())
+		}
+
+		names[source.Name()] = true
+		validated = append(validated, source)
+	}
+
+	return validated, nil
+}
+
+// SourceMetricSpec is a value for a source metric,
+// as configured for static sources, and as returned by HTTP sources.
+type SourceMetricSpec struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// Labels are used in selectors, so they follow the Kubernetes rules for labels.
+func (s *SourceMetricSpec) validate() error {
+	if !derivedMetricNameRegex.MatchString(s.Name) {
+		return fmt.Errorf("invalid metric name '%s'", s.Name)
+	}
+
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return fmt.Errorf("invalid value for metric '%s': %v", s.Name, s.Value)
+	}
+
+	for label, value := range s.Labels {
+		if errs := validation.IsQualifiedName(label); len(errs) > 0 {
+			return fmt.Errorf("invalid label '%s' for metric '%s': %v", label, s.Name, errs)
+		}
+
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value '%s' for label '%s' of metric '%s': %v", value, label, s.Name, errs)
+		}
+	}
+
+	return nil
+}
+
+func toSourceValues(specs []SourceMetricSpec, now time.Time) ([]metrics.ExternalMetricValue, error) {
+	values := []metrics.ExternalMetricValue{}
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return nil, err
+		}
+
+		labels := map[string]string{}
+		for k, v := range spec.Labels {
+			labels[k] = v
+		}
+
+		values = append(values, metrics.ExternalMetricValue{
+			MetricName:   spec.Name,
+			Timestamp:    v1.NewTime(now),
+			Value:        common.NewQuantity(spec.Value),
+			MetricLabels: labels,
+		})
+	}
+
+	return values, nil
+}
+
+// sourceRunner keeps the values from the last successful collection of a source.
+// It is only read and written with the provider publish lock held.
+type sourceRunner struct {
+	Source
+
+	// Whether the source was collected successfully at least once.
+	collected bool
+
+	// The values from the last successful collection, with the prefix. They are kept
+	// when a collection fails, so a failing source does not take down what it already exposed.
+	values     []metrics.ExternalMetricValue
+	names      []string
+	agentTypes []*common.AgentType
+}
+
+func (r *sourceRunner) update(values []metrics.ExternalMetricValue) {
+	names := []string{}
+	seen := map[string]bool{}
+	for i := range values {
+		values[i].MetricName = r.Prefix + values[i].MetricName
+		if !seen[values[i].MetricName] {
+			seen[values[i].MetricName] = true
+			names = append(names, values[i].MetricName)
+		}
+	}
+
+	r.values = values
+	r.names = names
+	if s, ok := r.Source.Source.(agentTypeSource); ok {
+		r.agentTypes = s.AgentTypes()
+	}
+}
+
+// Collects the values from a source, and publishes them with the last values from the other sources.
+// Errors and panics only affect the source they come from.
+func (p *SemaphoreMetricsProvider) collectFrom(r *sourceRunner) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	ctx, span := tracing.Tracer().Start(ctx, "SemaphoreMetricsProvider.Collect")
+	defer span.End()
+	span.SetAttributes(attribute.String("source", r.Name()))
+
+	values, err := safeCollect(ctx, r.Source.Source)
+
+	p.publishMu.Lock()
+	defer p.publishMu.Unlock()
+
+	if err != nil {
+		klog.Errorf("Error collecting metrics from source %s: %v", r.Name(), err)
+		tracing.RecordError(span, err)
+	} else {
+		r.collected = true
+		r.update(values)
+		span.SetAttributes(attribute.Int("values", len(values)))
+	}
+
+	p.publish(span)
+}
+
+func safeCollect(ctx context.Context, source MetricsSource) (values []metrics.ExternalMetricValue, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return source.Collect(ctx)
+}
+
+// Collects a source on its own schedule, forever.
+func (p *SemaphoreMetricsProvider) run(r *sourceRunner) {
+	for {
+		p.collectFrom(r)
+
+		// TODO: use noise in intervals
+		time.Sleep(r.Interval)
+	}
+}
+
+// semaphoreSource collects the metrics for the agent types found in the cluster.
+// Its values use the registry names, since derived metrics and names with the agent type
+// depend on them. The Semaphore prefix is added when the metrics are exposed.
+type semaphoreSource struct {
+	p *SemaphoreMetricsProvider
+
+	// The agent types found in the last successful collection.
+	// Only used by the goroutine collecting the source.
+	agentTypes []*common.AgentType
+}
+
+func (s *semaphoreSource) Name() string {
+	return SemaphoreSourceName
+}
+
+func (s *semaphoreSource) AgentTypes() []*common.AgentType {
+	return s.agentTypes
+}
+
+func (s *semaphoreSource) Collect(ctx context.Context) ([]metrics.ExternalMetricValue, error) {
+	p := s.p
+	agentTypes, err := p.finder.Find(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error finding agent types: %v", err)
+	}
+
+	klog.Infof("Found %d agent types", len(agentTypes))
+
+	// Each agent type group needs a request for its metrics, and at least one for its agents.
+	requests := 1
+	if p.config.CollectAgentDetails {
+		requests++
+	}
+
+	p.config.SemaphoreClient.CheckRateLimit(agentTypes, requests, CollectInterval)
+	p.reloadDerivedMetrics(ctx)
+
+	values := p.generate(ctx, agentTypes, p.config.SemaphoreClient.FetchMetrics(ctx, agentTypes), time.Now())
+	p.persistHistory()
+	if p.config.CollectAgentDetails {
+		values = append(values, p.collectAgentDetails(ctx, agentTypes)...)
+	}
+
+	s.agentTypes = agentTypes
+	return values, nil
+}
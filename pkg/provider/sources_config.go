@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Types of metrics sources that can be configured.
+const (
+	SourceTypeStatic = "static"
+	SourceTypeHTTP   = "http"
+)
+
+// SourceSpec is how a metrics source is defined in the sources file, e.g.:
+//
+//   - name: builds
+//     type: http
+//     prefix: builds_
+//     url: http://build-exporter.ci.svc/metrics.json
+//     interval: 30s
+//     namespaces: [ci]
+type SourceSpec struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Interval   string   `json:"interval,omitempty"`
+	Timeout    string   `json:"timeout,omitempty"`
+	Namespaces []string `json:"namespaces"`
+
+	// For http sources
+	URL string `json:"url,omitempty"`
+
+	// For static sources
+	Metrics []SourceMetricSpec `json:"metrics,omitempty"`
+}
+
+// LoadSources reads the metrics sources from a file.
+func LoadSources(path string, client *http.Client) ([]Source, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metrics sources: %v", err)
+	}
+
+	return ParseSources(string(content), client)
+}
+
+// ParseSources parses the metrics sources, using the client for the http ones.
+// Sources are validated further when the provider is created.
+func ParseSources(content string, client *http.Client) ([]Source, error) {
+	specs := []SourceSpec{}
+	if err := yaml.UnmarshalStrict([]byte(content), &specs); err != nil {
+		return nil, fmt.Errorf("error parsing metrics sources: %v", err)
+	}
+
+	sources := []Source{}
+	for _, spec := range specs {
+		source, err := spec.toSource(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics source '%s': %v", spec.Name, err)
+		}
+
+		sources = append(sources, *source)
+	}
+
+	return sources, nil
+}
+
+func (s *SourceSpec) toSource(client *http.Client) (*Source, error) {
+	if errs := validation.IsDNS1123Label(s.Name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid name: %v", errs)
+	}
+
+	var metricsSource MetricsSource
+	switch s.Type {
+	case SourceTypeStatic:
+		if s.URL != "" {
+			return nil, fmt.Errorf("url is only used by %s sources", SourceTypeHTTP)
+		}
+
+		static, err := NewStaticSource(s.Name, s.Metrics)
+		if err != nil {
+			return nil, err
+		}
+
+		metricsSource = static
+	case SourceTypeHTTP:
+		if len(s.Metrics) > 0 {
+			return nil, fmt.Errorf("metrics are only used by %s sources", SourceTypeStatic)
+		}
+
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid url '%s'", s.URL)
+		}
+
+		metricsSource = NewHTTPSource(s.Name, s.URL, client)
+	default:
+		return nil, fmt.Errorf("invalid type '%s': must be '%s' or '%s'", s.Type, SourceTypeStatic, SourceTypeHTTP)
+	}
+
+	interval, err := parseOptionalDuration(s.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval: %v", err)
+	}
+
+	timeout, err := parseOptionalDuration(s.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %v", err)
+	}
+
+	for _, n := range s.Namespaces {
+		if n == common.AllNamespaces {
+			continue
+		}
+
+		if errs := validation.IsDNS1123Label(n); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace '%s': %v", n, errs)
+		}
+	}
+
+	return &Source{
+		Source:     metricsSource,
+		Prefix:     s.Prefix,
+		Interval:   interval,
+		Timeout:    timeout,
+		Namespaces: s.Namespaces,
+	}, nil
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
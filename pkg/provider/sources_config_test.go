@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__ParseSources(t *testing.T) {
+	t.Run("static and http sources", func(t *testing.T) {
+		sources, err := ParseSources(`
+- name: teams
+  type: static
+  prefix: team_
+  namespaces: ["*"]
+  metrics:
+    - name: min_agents
+      labels: {team: mobile}
+      value: 2
+- name: builds
+  type: http
+  url: http://build-exporter.ci.svc/metrics.json
+  interval: 30s
+  timeout: 5s
+  namespaces: [ci]
+`, http.DefaultClient)
+
+		require.NoError(t, err)
+		require.Len(t, sources, 2)
+
+		assert.IsType(t, &StaticSource{}, sources[0].Source)
+		assert.Equal(t, "teams", sources[0].Source.Name())
+		assert.Equal(t, "team_", sources[0].Prefix)
+		assert.Equal(t, []string{"*"}, sources[0].Namespaces)
+
+		assert.IsType(t, &HTTPSource{}, sources[1].Source)
+		assert.Equal(t, "builds", sources[1].Source.Name())
+		assert.Equal(t, 30*time.Second, sources[1].Interval)
+		assert.Equal(t, 5*time.Second, sources[1].Timeout)
+		assert.Equal(t, []string{"ci"}, sources[1].Namespaces)
+	})
+
+	t.Run("empty -> no sources", func(t *testing.T) {
+		sources, err := ParseSources("", http.DefaultClient)
+		require.NoError(t, err)
+		assert.Empty(t, sources)
+	})
+
+	t.Run("unknown field -> error", func(t *testing.T) {
+		_, err := ParseSources("- name: teams\n  type: static\n  namespaces: [ci]\n  prefx: team_\n", http.DefaultClient)
+		assert.ErrorContains(t, err, "error parsing metrics sources")
+	})
+
+	t.Run("invalid source -> error", func(t *testing.T) {
+		for content, message := range map[string]string{
+			"- name: Teams\n  type: static\n":                         "invalid name",
+			"- name: teams\n  type: prometheus\n":                     "invalid type 'prometheus'",
+			"- name: builds\n  type: http\n  url: /metrics.json\n":    "invalid url '/metrics.json'",
+			"- name: teams\n  type: static\n  url: http://a.b/\n":     "url is only used by http sources",
+			"- name: teams\n  type: static\n  interval: soon\n":       "invalid interval",
+			"- name: teams\n  type: static\n  namespaces: [CI]\n":     "invalid namespace 'CI'",
+			"- name: teams\n  type: static\n  metrics: [{name: A}]\n": "invalid metric name 'A'",
+		} {
+			_, err := ParseSources(content, http.DefaultClient)
+			assert.ErrorContains(t, err, message)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func Test__ValidateSources(t *testing.T) {
+	static, err := NewStaticSource("teams", []SourceMetricSpec{})
+	require.NoError(t, err)
+
+	t.Run("defaults -> collect interval and timeout", func(t *testing.T) {
+		sources, err := validateSources([]Source{{Source: static, Namespaces: []string{"*"}}})
+		require.NoError(t, err)
+		require.Len(t, sources, 1)
+		assert.Equal(t, CollectInterval, sources[0].Interval)
+		assert.Equal(t, CollectTimeout, sources[0].Timeout)
+	})
+
+	t.Run("invalid prefix -> error", func(t *testing.T) {
+		for _, prefix := range []string{"Team_", "team-", "1_"} {
+			_, err := validateSources([]Source{{Source: static, Prefix: prefix, Namespaces: []string{"*"}}})
+			assert.ErrorContains(t, err, "invalid metric prefix")
+		}
+	})
+
+	t.Run("timeout longer than interval -> error", func(t *testing.T) {
+		_, err := validateSources([]Source{{Source: static, Interval: time.Minute, Timeout: 2 * time.Minute, Namespaces: []string{"*"}}})
+		assert.ErrorContains(t, err, "invalid timeout")
+	})
+
+	t.Run("no namespaces -> error", func(t *testing.T) {
+		_, err := validateSources([]Source{{Source: static}})
+		assert.ErrorContains(t, err, "no namespaces")
+	})
+
+	t.Run("same name twice -> error", func(t *testing.T) {
+		_, err := validateSources([]Source{
+			{Source: static, Namespaces: []string{"*"}},
+			{Source: static, Namespaces: []string{"*"}},
+		})
+
+		assert.ErrorContains(t, err, "source teams is already defined")
+	})
+
+	t.Run("semaphore name -> error", func(t *testing.T) {
+		_, err := validateSources([]Source{{Source: &fakeSource{name: SemaphoreSourceName}, Namespaces: []string{"*"}}})
+		assert.ErrorContains(t, err, "source semaphore is already defined")
+	})
+}
+
+func Test__StaticSource(t *testing.T) {
+	t.Run("values are returned as configured", func(t *testing.T) {
+		s, err := NewStaticSource("teams", []SourceMetricSpec{
+			{Name: "min_agents", Labels: map[string]string{"team": "mobile"}, Value: 2},
+			{Name: "min_agents", Labels: map[string]string{"team": "web"}, Value: 0.5},
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, "teams", s.Name())
+
+		values, err := s.Collect(context.Background())
+		require.NoError(t, err)
+		require.Len(t, values, 2)
+		assert.Equal(t, "min_agents", values[0].MetricName)
+		assert.Equal(t, map[string]string{"team": "mobile"}, values[0].MetricLabels)
+		assert.Equal(t, int64(2), values[0].Value.Value())
+		assert.Equal(t, int64(500), values[1].Value.MilliValue())
+	})
+
+	t.Run("invalid name -> error", func(t *testing.T) {
+		_, err := NewStaticSource("teams", []SourceMetricSpec{{Name: "min-agents"}})
+		assert.ErrorContains(t, err, "invalid metric name 'min-agents'")
+	})
+
+	t.Run("invalid label -> error", func(t *testing.T) {
+		_, err := NewStaticSource("teams", []SourceMetricSpec{{Name: "min_agents", Labels: map[string]string{"team name": "mobile"}}})
+		assert.ErrorContains(t, err, "invalid label 'team name'")
+	})
+
+	t.Run("invalid value -> error", func(t *testing.T) {
+		_, err := NewStaticSource("teams", []SourceMetricSpec{{Name: "min_agents", Value: math.Inf(1)}})
+		assert.ErrorContains(t, err, "invalid value for metric 'min_agents'")
+	})
+}
+
+func Test__HTTPSource(t *testing.T) {
+	status := http.StatusOK
+	body := `{"metrics": [{"name": "builds_pending", "labels": {"team": "mobile"}, "value": 4}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+
+	defer server.Close()
+
+	s := NewHTTPSource("builds", server.URL, http.DefaultClient)
+
+	t.Run("values are returned from response", func(t *testing.T) {
+		values, err := s.Collect(context.Background())
+		require.NoError(t, err)
+		require.Len(t, values, 1)
+		assert.Equal(t, "builds_pending", values[0].MetricName)
+		assert.Equal(t, map[string]string{"team": "mobile"}, values[0].MetricLabels)
+		assert.Equal(t, int64(4), values[0].Value.Value())
+	})
+
+	t.Run("request fails -> error", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		defer func() { status = http.StatusOK }()
+
+		_, err := s.Collect(context.Background())
+		assert.ErrorContains(t, err, "failed with 500")
+	})
+
+	t.Run("invalid JSON -> error", func(t *testing.T) {
+		body = `{"metrics": [`
+		_, err := s.Collect(context.Background())
+		assert.ErrorContains(t, err, "error parsing response")
+	})
+
+	t.Run("invalid value in response -> error", func(t *testing.T) {
+		body = `{"metrics": [{"name": "builds_pending", "value": 4}, {"name": "Builds", "value": 1}]}`
+		_, err := s.Collect(context.Background())
+		assert.ErrorContains(t, err, "invalid metric name 'Builds'")
+	})
+}
+
+// Returns the values or the error set, or panics, if asked to.
+type fakeSource struct {
+	name   string
+	values []metrics.ExternalMetricValue
+	err    error
+	panics bool
+}
+
+func (s *fakeSource) Name() string {
+	return s.name
+}
+
+func (s *fakeSource) Collect(ctx context.Context) ([]metrics.ExternalMetricValue, error) {
+	if s.panics {
+		panic(fmt.Sprintf("source %s panicked", s.name))
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	values := []metrics.ExternalMetricValue{}
+	for _, v := range s.values {
+		values = append(values, *v.DeepCopy())
+	}
+
+	return values, nil
+}
@@ -0,0 +1,32 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// StaticSource exposes values set by hand in its configuration,
+// e.g. a minimum number of agents for a team, to use in HPA metrics.
+type StaticSource struct {
+	name  string
+	specs []SourceMetricSpec
+}
+
+// NewStaticSource validates the values, so configuration errors are found on startup.
+func NewStaticSource(name string, specs []SourceMetricSpec) (*StaticSource, error) {
+	if _, err := toSourceValues(specs, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &StaticSource{name: name, specs: specs}, nil
+}
+
+func (s *StaticSource) Name() string {
+	return s.name
+}
+
+func (s *StaticSource) Collect(ctx context.Context) ([]metrics.ExternalMetricValue, error) {
+	return toSourceValues(s.specs, time.Now())
+}
@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"sort"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// Snapshot holds the values from the last collection of each source.
+// Each collection publishes a new one, with the next generation number,
+// so reads never mix values from different collections.
+// It is not changed after it is created, so it can be read concurrently.
+type Snapshot struct {
+	Generation  uint64
+	CollectedAt time.Time
+
+	metrics    map[string]*MetricSnapshot
+	sources    map[string]*SourceMetric
+	collection trace.SpanContext
+	visibility *Visibility
+}
+
+// NewSnapshot groups the values by metric name.
+// Only the metrics named are included, even if they have no values.
+func NewSnapshot(generation uint64, collectedAt time.Time, names []string, values []metrics.ExternalMetricValue, collection trace.SpanContext, visibility *Visibility) *Snapshot {
+	byName := map[string][]metrics.ExternalMetricValue{}
+	for _, name := range names {
+		byName[name] = []metrics.ExternalMetricValue{}
+	}
+
+	for _, v := range values {
+		if _, ok := byName[v.MetricName]; ok {
+			byName[v.MetricName] = append(byName[v.MetricName], v)
+		}
+	}
+
+	snapshotMetrics := map[string]*MetricSnapshot{}
+	for name, v := range byName {
+		snapshotMetrics[name] = NewMetricSnapshot(v)
+	}
+
+	return &Snapshot{
+		Generation:  generation,
+		CollectedAt: collectedAt,
+		metrics:     snapshotMetrics,
+		sources:     map[string]*SourceMetric{},
+		collection:  collection,
+		visibility:  visibility,
+	}
+}
+
+// Metric returns the values for a metric, if it was collected.
+func (s *Snapshot) Metric(name string) (*MetricSnapshot, bool) {
+	m, ok := s.metrics[name]
+	return m, ok
+}
+
+// SourceMetric holds the values for a metric from a source other than Semaphore,
+// which can only be read from the namespaces configured for the source.
+type SourceMetric struct {
+	*MetricSnapshot
+	Source     string
+	Namespaces []string
+}
+
+// VisibleIn tells whether the values for the metric can be read from a namespace.
+func (m *SourceMetric) VisibleIn(namespace string) bool {
+	for _, n := range m.Namespaces {
+		if n == common.AllNamespaces || n == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds the values for a metric from another source. Only used while the snapshot is published.
+func (s *Snapshot) addSourceMetric(name, source string, namespaces []string, values []metrics.ExternalMetricValue) {
+	s.sources[name] = &SourceMetric{
+		MetricSnapshot: NewMetricSnapshot(values),
+		Source:         source,
+		Namespaces:     namespaces,
+	}
+}
+
+// SourceMetric returns the values for a metric from another source, if it was collected.
+func (s *Snapshot) SourceMetric(name string) (*SourceMetric, bool) {
+	m, ok := s.sources[name]
+	return m, ok
+}
+
+// SourceMetricNames returns the names of the metrics from other sources, sorted.
+func (s *Snapshot) SourceMetricNames() []string {
+	names := []string{}
+	for name := range s.sources {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// MetricSnapshot holds the values for a metric from one collection,
+// indexed by label, so selectors with equality requirements,
+// like agent_type=s1-a, do not need to go through all the values.
+type MetricSnapshot struct {
+	values []metrics.ExternalMetricValue
+	index  map[string]map[string][]int
+}
+
+func NewMetricSnapshot(values []metrics.ExternalMetricValue) *MetricSnapshot {
+	index := map[string]map[string][]int{}
+	for i, v := range values {
+		for label, value := range v.MetricLabels {
+			if index[label] == nil {
+				index[label] = map[string][]int{}
+			}
+
+			index[label][value] = append(index[label][value], i)
+		}
+	}
+
+	return &MetricSnapshot{values: values, index: index}
+}
+
+// Select returns a copy of the values matching the selector.
+// Aggregated values are only included if asked for.
+func (s *MetricSnapshot) Select(selector labels.Selector, includeAggregates bool) []metrics.ExternalMetricValue {
+	selected := []metrics.ExternalMetricValue{}
+	matchAll := selector.Empty()
+	for _, i := range s.candidates(selector) {
+		v := s.values[i]
+		if !includeAggregates && isAggregate(v) {
+			continue
+		}
+
+		if matchAll || selector.Matches(&Labels{metric: v}) {
+			selected = append(selected, *v.DeepCopy())
+		}
+	}
+
+	return selected
+}
+
+// Labels returns the labels the values have.
+func (s *MetricSnapshot) Labels() map[string]bool {
+	labels := map[string]bool{}
+	for label := range s.index {
+		labels[label] = true
+	}
+
+	return labels
+}
+
+// Lookup returns a copy of the values with a label set to a value.
+func (s *MetricSnapshot) Lookup(label, value string) []metrics.ExternalMetricValue {
+	selected := []metrics.ExternalMetricValue{}
+	for _, i := range s.index[label][value] {
+		selected = append(selected, *s.values[i].DeepCopy())
+	}
+
+	return selected
+}
+
+// SelectFor returns a copy of the values for an agent type matching the selector.
+func (s *MetricSnapshot) SelectFor(agentType string, selector labels.Selector) []metrics.ExternalMetricValue {
+	selected := []metrics.ExternalMetricValue{}
+	for _, v := range s.Lookup("agent_type", agentType) {
+		if !isAggregate(v) && selector.Matches(&Labels{metric: v}) {
+			selected = append(selected, v)
+		}
+	}
+
+	return selected
+}
+
+// The positions of the values that can match the selector, in order.
+// If the selector has equality requirements, only the values in the index
+// for the most selective one are candidates. Otherwise, all values are.
+func (s *MetricSnapshot) candidates(selector labels.Selector) []int {
+	var best []int
+	found := false
+
+	requirements, _ := selector.Requirements()
+	for _, r := range requirements {
+		positions, ok := s.lookupRequirement(r)
+		if !ok {
+			continue
+		}
+
+		if !found || len(positions) < len(best) {
+			best = positions
+			found = true
+		}
+	}
+
+	if found {
+		return best
+	}
+
+	all := make([]int, len(s.values))
+	for i := range all {
+		all[i] = i
+	}
+
+	return all
+}
+
+func (s *MetricSnapshot) lookupRequirement(r labels.Requirement) ([]int, bool) {
+	switch r.Operator() {
+	case selection.Equals, selection.DoubleEquals:
+		return s.index[r.Key()][r.Values().List()[0]], true
+	case selection.In:
+		positions := []int{}
+		for _, value := range r.Values().List() {
+			positions = append(positions, s.index[r.Key()][value]...)
+		}
+
+		sort.Ints(positions)
+		return positions, true
+	default:
+		return nil, false
+	}
+}
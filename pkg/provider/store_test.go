@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/labels"
+	metrics "k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+func Test__MetricSnapshot(t *testing.T) {
+	values := []metrics.ExternalMetricValue{
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{"agent_type": "s1-a"}},
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{"agent_type": "s1-b"}},
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{"agent_type": "s1-c"}},
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{AggregateLabel: "pool", "pool": "arm64"}},
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{AggregateLabel: "pool", "pool": "amd64"}},
+	}
+
+	snapshot := NewMetricSnapshot(values)
+
+	selected := func(selector string, includeAggregates bool) []map[string]string {
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+
+		l := []map[string]string{}
+		for _, v := range snapshot.Select(s, includeAggregates) {
+			l = append(l, v.MetricLabels)
+		}
+
+		return l
+	}
+
+	t.Run("empty selector -> all values, in order", func(t *testing.T) {
+		assert.Equal(t, []map[string]string{values[0].MetricLabels, values[1].MetricLabels, values[2].MetricLabels}, selected("", false))
+		assert.Len(t, selected("", true), 5)
+	})
+
+	t.Run("equality", func(t *testing.T) {
+		assert.Equal(t, []map[string]string{values[1].MetricLabels}, selected("agent_type=s1-b", false))
+		assert.Equal(t, []map[string]string{values[1].MetricLabels}, selected("agent_type==s1-b", false))
+		assert.Empty(t, selected("agent_type=s1-z", false))
+	})
+
+	t.Run("set-based", func(t *testing.T) {
+		assert.Equal(t, []map[string]string{values[0].MetricLabels, values[2].MetricLabels}, selected("agent_type in (s1-c, s1-a)", false))
+		assert.Equal(t, []map[string]string{values[0].MetricLabels, values[2].MetricLabels}, selected("agent_type notin (s1-b)", false))
+		assert.Equal(t, []map[string]string{values[3].MetricLabels, values[4].MetricLabels}, selected("pool", true))
+	})
+
+	t.Run("equality combined with other requirements", func(t *testing.T) {
+		assert.Equal(t, []map[string]string{values[3].MetricLabels}, selected("aggregate=pool,pool!=amd64", true))
+		assert.Empty(t, selected("agent_type=s1-a,pool=arm64", true))
+	})
+
+	t.Run("aggregates only when asked for", func(t *testing.T) {
+		assert.Empty(t, selected("pool=arm64", false))
+		assert.Len(t, selected("pool=arm64", true), 1)
+	})
+
+	t.Run("returned values are a copy", func(t *testing.T) {
+		s := snapshot.Select(labels.Everything(), false)
+		s[0].MetricName = "changed"
+		assert.Equal(t, common.MetricJobsQueued, snapshot.Select(labels.Everything(), false)[0].MetricName)
+
+		l := snapshot.Lookup("agent_type", "s1-a")
+		require.Len(t, l, 1)
+		l[0].MetricName = "changed"
+		assert.Equal(t, common.MetricJobsQueued, snapshot.Lookup("agent_type", "s1-a")[0].MetricName)
+	})
+}
+
+func Test__Snapshot(t *testing.T) {
+	values := []metrics.ExternalMetricValue{
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{"agent_type": "s1-a"}},
+		{MetricName: common.MetricAgentsIdle, MetricLabels: map[string]string{"agent_type": "s1-a"}},
+		{MetricName: common.MetricJobsQueued, MetricLabels: map[string]string{"agent_type": "s1-b"}},
+		{MetricName: "not-in-registry", MetricLabels: map[string]string{"agent_type": "s1-a"}},
+	}
+
+	names := []string{common.MetricJobsQueued, common.MetricAgentsIdle, common.MetricJobsRunning}
+	snapshot := NewSnapshot(3, time.Now(), names, values, trace.SpanContext{}, NewVisibility(nil))
+	assert.Equal(t, uint64(3), snapshot.Generation)
+
+	t.Run("values are grouped by metric", func(t *testing.T) {
+		m, ok := snapshot.Metric(common.MetricJobsQueued)
+		require.True(t, ok)
+		assert.Len(t, m.Select(labels.Everything(), false), 2)
+
+		m, ok = snapshot.Metric(common.MetricAgentsIdle)
+		require.True(t, ok)
+		assert.Len(t, m.Select(labels.Everything(), false), 1)
+	})
+
+	t.Run("metrics named without values -> empty", func(t *testing.T) {
+		m, ok := snapshot.Metric(common.MetricJobsRunning)
+		require.True(t, ok)
+		assert.Empty(t, m.Select(labels.Everything(), false))
+	})
+
+	t.Run("metrics not named are left out", func(t *testing.T) {
+		_, ok := snapshot.Metric("not-in-registry")
+		assert.False(t, ok)
+	})
+
+	t.Run("returned labels are a copy", func(t *testing.T) {
+		m, _ := snapshot.Metric(common.MetricJobsQueued)
+		m.Select(labels.Everything(), false)[0].MetricLabels["agent_type"] = "changed"
+		assert.Equal(t, "s1-a", m.Select(labels.Everything(), false)[0].MetricLabels["agent_type"])
+	})
+}
+
+// The values for one metric, for many agent types.
+func benchmarkValues(agentTypes int) []metrics.ExternalMetricValue {
+	values := []metrics.ExternalMetricValue{}
+	for i := 0; i < agentTypes; i++ {
+		values = append(values, metrics.ExternalMetricValue{
+			MetricName:   common.MetricJobsQueued,
+			MetricLabels: map[string]string{"agent_type": fmt.Sprintf("s1-agent-type-%d", i)},
+		})
+	}
+
+	return values
+}
+
+// How values were selected before the index, as a baseline.
+func linearSelect(values []metrics.ExternalMetricValue, selector labels.Selector) []metrics.ExternalMetricValue {
+	selected := []metrics.ExternalMetricValue{}
+	for _, v := range values {
+		if !isAggregate(v) && selector.Matches(&Labels{metric: v}) {
+			selected = append(selected, v)
+		}
+	}
+
+	return selected
+}
+
+func Benchmark__SelectByAgentType(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		values := benchmarkValues(n)
+		snapshot := NewMetricSnapshot(values)
+		selector := labels.SelectorFromSet(labels.Set{"agent_type": fmt.Sprintf("s1-agent-type-%d", n/2)})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearSelect(values, selector)
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				snapshot.Select(selector, false)
+			}
+		})
+	}
+}
+
+func Benchmark__SelectAll(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		values := benchmarkValues(n)
+		snapshot := NewMetricSnapshot(values)
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearSelect(values, labels.Everything())
+			}
+		})
+
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				snapshot.Select(labels.Everything(), false)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+)
+
+// Sample is the metrics collected for an agent type at a point in time.
+type Sample struct {
+	At      time.Time      `json:"at"`
+	Metrics common.Metrics `json:"metrics"`
+}
+
+// TimeSeries keeps the samples for an agent type, oldest first,
+// dropping the ones older than the retention period.
+type TimeSeries struct {
+	retention time.Duration
+	samples   []Sample
+}
+
+func NewTimeSeries(retention time.Duration) *TimeSeries {
+	return &TimeSeries{retention: retention, samples: []Sample{}}
+}
+
+// Add appends a sample to the series.
+// Samples older than the latest one are ignored.
+func (ts *TimeSeries) Add(sample Sample) {
+	if latest, ok := ts.Latest(); ok && !sample.At.After(latest.At) {
+		return
+	}
+
+	ts.samples = append(ts.samples, sample)
+
+	cutoff := sample.At.Add(-ts.retention)
+	i := 0
+	for i < len(ts.samples) && ts.samples[i].At.Before(cutoff) {
+		i++
+	}
+
+	ts.samples = ts.samples[i:]
+}
+
+func (ts *TimeSeries) Latest() (Sample, bool) {
+	if len(ts.samples) == 0 {
+		return Sample{}, false
+	}
+
+	return ts.samples[len(ts.samples)-1], true
+}
+
+// Since returns the samples taken at or after the given time.
+func (ts *TimeSeries) Since(t time.Time) []Sample {
+	for i, sample := range ts.samples {
+		if !sample.At.Before(t) {
+			return ts.samples[i:]
+		}
+	}
+
+	return []Sample{}
+}
+
+// Contiguous returns the latest samples taken at or after the given time,
+// with no more than maxGap between consecutive samples.
+// Samples before a gap are not returned, since they cannot be
+// trusted to describe what happened while no samples were collected.
+func (ts *TimeSeries) Contiguous(since time.Time, maxGap time.Duration) []Sample {
+	samples := ts.Since(since)
+	for i := len(samples) - 1; i > 0; i-- {
+		if samples[i].At.Sub(samples[i-1].At) > maxGap {
+			return samples[i:]
+		}
+	}
+
+	return samples
+}
+
+// History keeps a time series for each agent type.
+type History struct {
+	retention time.Duration
+	series    map[string]*TimeSeries
+
+	// Where the samples for each agent type come from.
+	// If that changes, the previous samples are not comparable
+	// with the new ones anymore, so the series starts over.
+	sources map[string]string
+}
+
+// Fingerprints where the samples for an agent type come from.
+// The token is hashed, so the fingerprint can be persisted safely.
+func sourceOf(agentType *common.AgentType) string {
+	sum := sha256.Sum256([]byte(agentType.Endpoint + "\x00" + agentType.Token + "\x00" + agentType.APIVersion))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewHistory(retention time.Duration) *History {
+	return &History{
+		retention: retention,
+		series:    map[string]*TimeSeries{},
+		sources:   map[string]string{},
+	}
+}
+
+func (h *History) Record(agentType *common.AgentType, m *common.Metrics, at time.Time) {
+	s := sourceOf(agentType)
+	series, ok := h.series[agentType.Name]
+	if !ok || h.sources[agentType.Name] != s {
+		series = NewTimeSeries(h.retention)
+		h.series[agentType.Name] = series
+		h.sources[agentType.Name] = s
+	}
+
+	series.Add(Sample{At: at, Metrics: *m})
+}
+
+// Series returns the time series for an agent type, or an empty one if there are no samples for it.
+func (h *History) Series(agentType string) *TimeSeries {
+	if series, ok := h.series[agentType]; ok {
+		return series
+	}
+
+	return NewTimeSeries(h.retention)
+}
+
+// Forget drops the series for agent types that do not exist anymore.
+func (h *History) Forget(existing map[string]bool) {
+	for agentType := range h.series {
+		if !existing[agentType] {
+			delete(h.series, agentType)
+			delete(h.sources, agentType)
+		}
+	}
+}
+
+// PersistedSeries is what is persisted for an agent type's time series.
+type PersistedSeries struct {
+	Source  string   `json:"source"`
+	Samples []Sample `json:"samples"`
+
+	// The seasonal forecast profile, if it is used.
+	Seasonal *PersistedSeasonal `json:"seasonal,omitempty"`
+}
+
+// Snapshot returns the samples for all agent types, so they can be persisted.
+func (h *History) Snapshot() map[string]PersistedSeries {
+	snapshot := map[string]PersistedSeries{}
+	for agentType, series := range h.series {
+		snapshot[agentType] = PersistedSeries{
+			Source:  h.sources[agentType],
+			Samples: series.Since(time.Time{}),
+		}
+	}
+
+	return snapshot
+}
+
+// Restore replaces the samples with previously persisted ones.
+// Samples older than the retention period are dropped.
+func (h *History) Restore(snapshot map[string]PersistedSeries, now time.Time) {
+	h.series = map[string]*TimeSeries{}
+	h.sources = map[string]string{}
+
+	cutoff := now.Add(-h.retention)
+	for agentType, persisted := range snapshot {
+		series := NewTimeSeries(h.retention)
+		for _, sample := range persisted.Samples {
+			if !sample.At.Before(cutoff) && !sample.At.After(now) {
+				series.Add(sample)
+			}
+		}
+
+		h.series[agentType] = series
+		h.sources[agentType] = persisted.Source
+	}
+}
@@ -0,0 +1,107 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__TimeSeries(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("drops samples older than retention", func(t *testing.T) {
+		ts := NewTimeSeries(time.Minute)
+		for i := 0; i < 10; i++ {
+			ts.Add(sampleAt(start.Add(time.Duration(i)*20*time.Second), i))
+		}
+
+		samples := ts.Since(time.Time{})
+		assert.Len(t, samples, 4)
+		assert.Equal(t, start.Add(120*time.Second), samples[0].At)
+	})
+
+	t.Run("ignores out of order samples", func(t *testing.T) {
+		ts := NewTimeSeries(time.Minute)
+		ts.Add(sampleAt(start, 1))
+		ts.Add(sampleAt(start.Add(-time.Second), 2))
+		ts.Add(sampleAt(start, 3))
+
+		latest, ok := ts.Latest()
+		assert.True(t, ok)
+		assert.Equal(t, 1, latest.Metrics.Jobs.Queued)
+		assert.Len(t, ts.Since(time.Time{}), 1)
+	})
+
+	t.Run("contiguous samples stop at the latest gap", func(t *testing.T) {
+		ts := NewTimeSeries(time.Hour)
+		ts.Add(sampleAt(start, 1))
+		ts.Add(sampleAt(start.Add(10*time.Second), 2))
+		ts.Add(sampleAt(start.Add(2*time.Minute), 3))
+		ts.Add(sampleAt(start.Add(2*time.Minute+10*time.Second), 4))
+
+		samples := ts.Contiguous(start, 30*time.Second)
+		if assert.Len(t, samples, 2) {
+			assert.Equal(t, 3, samples[0].Metrics.Jobs.Queued)
+		}
+
+		assert.Len(t, ts.Contiguous(start, time.Hour), 4)
+	})
+}
+
+func Test__History(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	agentType := &common.AgentType{Name: "s1-a", Endpoint: "a.semaphoreci.com", Token: "t1"}
+
+	t.Run("unknown agent type -> empty series", func(t *testing.T) {
+		h := NewHistory(time.Minute)
+		_, ok := h.Series("s1-a").Latest()
+		assert.False(t, ok)
+	})
+
+	t.Run("series starts over when source changes", func(t *testing.T) {
+		h := NewHistory(time.Hour)
+		h.Record(agentType, &common.Metrics{}, start)
+		h.Record(agentType, &common.Metrics{}, start.Add(10*time.Second))
+		assert.Len(t, h.Series("s1-a").Since(time.Time{}), 2)
+
+		rotated := &common.AgentType{Name: "s1-a", Endpoint: "b.semaphoreci.com", Token: "t1"}
+		h.Record(rotated, &common.Metrics{}, start.Add(20*time.Second))
+		assert.Len(t, h.Series("s1-a").Since(time.Time{}), 1)
+	})
+
+	t.Run("restored series continues if source is the same", func(t *testing.T) {
+		h := NewHistory(time.Hour)
+		h.Record(agentType, &common.Metrics{}, start)
+		snapshot := h.Snapshot()
+
+		restored := NewHistory(time.Hour)
+		restored.Restore(snapshot, start.Add(time.Minute))
+		restored.Record(agentType, &common.Metrics{}, start.Add(time.Minute))
+		assert.Len(t, restored.Series("s1-a").Since(time.Time{}), 2)
+	})
+
+	t.Run("restore drops samples older than retention", func(t *testing.T) {
+		h := NewHistory(time.Hour)
+		h.Record(agentType, &common.Metrics{}, start)
+		h.Record(agentType, &common.Metrics{}, start.Add(30*time.Minute))
+		snapshot := h.Snapshot()
+
+		restored := NewHistory(time.Hour)
+		restored.Restore(snapshot, start.Add(time.Hour+time.Minute))
+		assert.Len(t, restored.Series("s1-a").Since(time.Time{}), 1)
+	})
+
+	t.Run("forgets agent types that are gone", func(t *testing.T) {
+		h := NewHistory(time.Hour)
+		h.Record(agentType, &common.Metrics{}, start)
+		h.Forget(map[string]bool{})
+		_, ok := h.Series("s1-a").Latest()
+		assert.False(t, ok)
+	})
+}
+
+func sampleAt(at time.Time, queued int) Sample {
+	return Sample{At: at, Metrics: common.Metrics{Jobs: common.JobMetrics{Queued: queued}}}
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// What reads from namespaces where the requested metrics are not visible get back.
+const (
+	DeniedNamespaceEmpty     = "empty"
+	DeniedNamespaceForbidden = "forbidden"
+)
+
+// Visibility tells which values can be read from which namespaces,
+// according to the namespaces of the agent types they are for.
+type Visibility struct {
+	agentTypes []*common.AgentType
+	byName     map[string]*common.AgentType
+}
+
+func NewVisibility(agentTypes []*common.AgentType) *Visibility {
+	byName := map[string]*common.AgentType{}
+	for _, agentType := range agentTypes {
+		byName[agentType.Name] = agentType
+	}
+
+	return &Visibility{agentTypes: agentTypes, byName: byName}
+}
+
+// Allows tells whether a value can be read from a namespace.
+// Aggregated values can only be read where all the agent types in the group are visible.
+func (v *Visibility) Allows(value external_metrics.ExternalMetricValue, namespace string) bool {
+	if label, ok := value.MetricLabels[AggregateLabel]; ok {
+		for _, agentType := range v.agentTypes {
+			if inGroup(agentType, label, value.MetricLabels[label]) && !agentType.VisibleIn(namespace) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	agentType, ok := v.byName[value.MetricLabels["agent_type"]]
+	return ok && agentType.VisibleIn(namespace)
+}
+
+// AgentTypesIn returns the names of the agent types visible in a namespace, sorted.
+// For AllNamespaces, only the agent types visible in all namespaces are returned.
+func (v *Visibility) AgentTypesIn(namespace string) []string {
+	names := []string{}
+	for _, agentType := range v.agentTypes {
+		if agentType.VisibleIn(namespace) {
+			names = append(names, agentType.Name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Filter returns the values that can be read from a namespace,
+// and how many were left out.
+func (v *Visibility) Filter(values []external_metrics.ExternalMetricValue, namespace string) ([]external_metrics.ExternalMetricValue, int) {
+	allowed := []external_metrics.ExternalMetricValue{}
+	for _, value := range values {
+		if v.Allows(value, namespace) {
+			allowed = append(allowed, value)
+		}
+	}
+
+	return allowed, len(values) - len(allowed)
+}
+
+func inGroup(agentType *common.AgentType, label, group string) bool {
+	if label == AggregateAll {
+		return true
+	}
+
+	v, ok := agentType.SecretLabels[label]
+	return ok && v == group
+}
+
+func validateDeniedNamespaceResponse(response string) error {
+	switch response {
+	case DeniedNamespaceEmpty, DeniedNamespaceForbidden:
+		return nil
+	default:
+		return fmt.Errorf("invalid denied namespace response '%s': must be '%s' or '%s'", response, DeniedNamespaceEmpty, DeniedNamespaceForbidden)
+	}
+}
+
+// External metrics are not a Kubernetes resource, but errors need one.
+var externalMetricsResource = schema.GroupResource{Group: "external.metrics.k8s.io", Resource: "metrics"}
+
+func newNamespaceForbiddenError(resource schema.GroupResource, metricName, namespace string) error {
+	return apierrors.NewForbidden(resource, metricName, fmt.Errorf("metric is not visible in namespace %s", namespace))
+}
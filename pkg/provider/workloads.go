@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+)
+
+// Annotation on Deployments and StatefulSets with the name of the agent type secret
+// for the agents they run. The metrics for that agent type are attached to them.
+const AnnotationAgentType = "semaphore-agent/agent-type"
+
+// The resources custom metrics can be attached to.
+var WorkloadResources = []schema.GroupResource{
+	{Group: "apps", Resource: "deployments"},
+	{Group: "apps", Resource: "statefulsets"},
+}
+
+// A workload annotated with the agent type whose agents it runs.
+type Workload struct {
+	Object    custom_metrics.ObjectReference
+	AgentType string
+}
+
+// WorkloadFinder finds the workloads annotated with an agent type.
+// The provider needs get and list access to the workload resources for this.
+type WorkloadFinder struct {
+	client dynamic.Interface
+	mapper apimeta.RESTMapper
+}
+
+func NewWorkloadFinder(client dynamic.Interface, mapper apimeta.RESTMapper) *WorkloadFinder {
+	return &WorkloadFinder{client: client, mapper: mapper}
+}
+
+// Supports tells whether metrics can be attached to a resource,
+// e.g. "deployments.apps", but also "deployment.apps" or "deploy".
+func (f *WorkloadFinder) Supports(resource schema.GroupResource) bool {
+	_, err := f.resourceFor(resource)
+	return err == nil
+}
+
+// Get returns the workload with the given name, or nil if it is not annotated with an agent type.
+func (f *WorkloadFinder) Get(ctx context.Context, resource schema.GroupResource, name types.NamespacedName) (workload *Workload, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "WorkloadFinder.Get")
+	span.SetAttributes(
+		attribute.String("resource", resource.String()),
+		attribute.String("namespace", name.Namespace),
+		attribute.String("name", name.Name),
+	)
+
+	defer func() { tracing.End(span, err) }()
+
+	gvr, err := f.resourceFor(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := f.client.Resource(gvr).Namespace(name.Namespace).Get(ctx, name.Name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return toWorkload(o), nil
+}
+
+// List returns the workloads in a namespace matching the label selector
+// which are annotated with an agent type.
+func (f *WorkloadFinder) List(ctx context.Context, resource schema.GroupResource, namespace string, selector labels.Selector) (workloads []*Workload, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "WorkloadFinder.List")
+	span.SetAttributes(
+		attribute.String("resource", resource.String()),
+		attribute.String("namespace", namespace),
+		attribute.String("selector", selector.String()),
+	)
+
+	defer func() {
+		span.SetAttributes(attribute.Int("workloads", len(workloads)))
+		tracing.End(span, err)
+	}()
+
+	gvr, err := f.resourceFor(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := f.client.Resource(gvr).Namespace(namespace).List(ctx, v1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %v", resource.String(), err)
+	}
+
+	workloads = []*Workload{}
+	for i := range list.Items {
+		if workload := toWorkload(&list.Items[i]); workload != nil {
+			workloads = append(workloads, workload)
+		}
+	}
+
+	return workloads, nil
+}
+
+func (f *WorkloadFinder) resourceFor(resource schema.GroupResource) (schema.GroupVersionResource, error) {
+	gvr, err := f.mapper.ResourceFor(resource.WithVersion(""))
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("error finding resource %s: %v", resource.String(), err)
+	}
+
+	for _, supported := range WorkloadResources {
+		if gvr.GroupResource() == supported {
+			return gvr, nil
+		}
+	}
+
+	return schema.GroupVersionResource{}, fmt.Errorf("metrics cannot be attached to %s", resource.String())
+}
+
+func toWorkload(o *unstructured.Unstructured) *Workload {
+	agentType, ok := o.GetAnnotations()[AnnotationAgentType]
+	if !ok || agentType == "" {
+		return nil
+	}
+
+	return &Workload{
+		AgentType: agentType,
+		Object: custom_metrics.ObjectReference{
+			Kind:            o.GetKind(),
+			APIVersion:      o.GetAPIVersion(),
+			Namespace:       o.GetNamespace(),
+			Name:            o.GetName(),
+			UID:             o.GetUID(),
+			ResourceVersion: o.GetResourceVersion(),
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var deployments = schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+func Test__WorkloadFinder(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(newTestScheme(),
+		newDeployment("default", "agents-1", map[string]string{"app": "agents"}, "agent-type-1"),
+		newDeployment("default", "agents-2", map[string]string{"app": "agents"}, "agent-type-2"),
+		newDeployment("default", "web", map[string]string{"app": "web"}, ""),
+		newDeployment("other", "agents-3", map[string]string{"app": "agents"}, "agent-type-3"),
+	)
+
+	f := NewWorkloadFinder(client, newTestMapper())
+
+	t.Run("supported resources", func(t *testing.T) {
+		assert.True(t, f.Supports(deployments))
+		assert.True(t, f.Supports(schema.GroupResource{Group: "apps", Resource: "statefulsets"}))
+		assert.True(t, f.Supports(schema.GroupResource{Group: "apps", Resource: "deployment"}))
+		assert.False(t, f.Supports(schema.GroupResource{Resource: "pods"}))
+		assert.False(t, f.Supports(schema.GroupResource{Group: "apps", Resource: "daemonsets"}))
+	})
+
+	t.Run("annotated workload -> agent type", func(t *testing.T) {
+		w, err := f.Get(context.Background(), deployments, types.NamespacedName{Namespace: "default", Name: "agents-1"})
+		require.NoError(t, err)
+		require.NotNil(t, w)
+		assert.Equal(t, "agent-type-1", w.AgentType)
+		assert.Equal(t, "Deployment", w.Object.Kind)
+		assert.Equal(t, "apps/v1", w.Object.APIVersion)
+		assert.Equal(t, "default", w.Object.Namespace)
+		assert.Equal(t, "agents-1", w.Object.Name)
+	})
+
+	t.Run("workload without annotation -> nil", func(t *testing.T) {
+		w, err := f.Get(context.Background(), deployments, types.NamespacedName{Namespace: "default", Name: "web"})
+		require.NoError(t, err)
+		assert.Nil(t, w)
+	})
+
+	t.Run("workload that does not exist -> error", func(t *testing.T) {
+		_, err := f.Get(context.Background(), deployments, types.NamespacedName{Namespace: "default", Name: "nope"})
+		assert.Error(t, err)
+	})
+
+	t.Run("list only annotated workloads in namespace matching selector", func(t *testing.T) {
+		workloads, err := f.List(context.Background(), deployments, "default", labels.Everything())
+		require.NoError(t, err)
+		assert.Len(t, workloads, 2)
+
+		selector := labels.SelectorFromSet(labels.Set{"app": "web"})
+		workloads, err = f.List(context.Background(), deployments, "default", selector)
+		require.NoError(t, err)
+		assert.Empty(t, workloads)
+
+		workloads, err = f.List(context.Background(), deployments, "other", labels.Everything())
+		require.NoError(t, err)
+		require.Len(t, workloads, 1)
+		assert.Equal(t, "agent-type-3", workloads[0].AgentType)
+	})
+}
+
+func newTestMapper() apimeta.RESTMapper {
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{{Group: "apps", Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, apimeta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}, apimeta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Pod"}, apimeta.RESTScopeNamespace)
+	return mapper
+}
+
+func newDeployment(namespace, name string, labels map[string]string, agentType string) *appsv1.Deployment {
+	annotations := map[string]string{}
+	if agentType != "" {
+		annotations[AnnotationAgentType] = agentType
+	}
+
+	return &appsv1.Deployment{
+		TypeMeta: v1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+	}
+}
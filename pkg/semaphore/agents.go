@@ -0,0 +1,99 @@
+package semaphore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// How many agents are requested in each page of the agents listing.
+	AgentsPageSize = 200
+
+	// Upper bound on the number of pages fetched for a single agent type,
+	// protecting us from a server that keeps returning a next page cursor.
+	MaxAgentsPages = 50
+)
+
+type agentsPage struct {
+	Agents         *[]common.Agent `json:"agents"`
+	NextPageCursor string          `json:"next_page_cursor"`
+}
+
+// ListAgents returns the agents registered for each agent type, keyed by agent type name.
+// Like GetMetrics, agent types sharing credentials are only listed once.
+// Agent types for which the listing fails are not included.
+func (c *Client) ListAgents(ctx context.Context, agentTypes []*common.AgentType) map[string][]common.Agent {
+	agents := map[string][]common.Agent{}
+
+	for _, group := range groupByCredentials(agentTypes) {
+		list, err := c.listAgentsForGroup(ctx, group)
+		if err != nil {
+			klog.Errorf("Error listing agents from Semaphore API for %s: %v", names(group.agentTypes), err)
+			continue
+		}
+
+		for _, agentType := range group.agentTypes {
+			klog.Infof("Found %d agents for %s", len(list), agentType.Name)
+			agents[agentType.Name] = list
+		}
+	}
+
+	return agents
+}
+
+func (c *Client) listAgentsForGroup(ctx context.Context, group *agentTypeGroup) ([]common.Agent, error) {
+	agents := []common.Agent{}
+	cursor := ""
+
+	for page := 0; page < MaxAgentsPages; page++ {
+		query := url.Values{}
+		query.Set("page_size", strconv.Itoa(AgentsPageSize))
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		var p *agentsPage
+		err := c.get(ctx, group, agentsPath, query, func(response []byte) (err error) {
+			p, err = decodeAgentsPage(response)
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		agents = append(agents, *p.Agents...)
+		if p.NextPageCursor == "" {
+			return agents, nil
+		}
+
+		cursor = p.NextPageCursor
+	}
+
+	return nil, fmt.Errorf("agents listing has more than %d pages", MaxAgentsPages)
+}
+
+func decodeAgentsPage(data []byte) (*agentsPage, error) {
+	var p agentsPage
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+
+	if p.Agents == nil {
+		return nil, fmt.Errorf("missing required field 'agents'")
+	}
+
+	for i, agent := range *p.Agents {
+		if agent.Name == "" {
+			return nil, fmt.Errorf("missing required field 'agents[%d].name'", i)
+		}
+	}
+
+	return &p, nil
+}
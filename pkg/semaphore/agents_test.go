@@ -0,0 +1,79 @@
+package semaphore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	testsupport "github.com/semaphoreci/k8s-metrics-apiserver/test/support"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__ListAgents(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+	defer apiMock.Close()
+
+	agents := []common.Agent{}
+	for i := 0; i < 5; i++ {
+		agents = append(agents, common.Agent{
+			Name:        fmt.Sprintf("agent-%d", i),
+			Version:     "v2.2.0",
+			OS:          "linux",
+			Arch:        "amd64",
+			Hostname:    fmt.Sprintf("pod-%d", i),
+			ConnectedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+
+	apiMock.RegisterAgents("token-1", agents)
+	apiMock.RegisterAgents("token-2", []common.Agent{})
+	apiMock.AgentsPageSize = 2
+
+	c := NewClient(http.DefaultClient, true)
+	list := c.ListAgents(context.Background(), []*common.AgentType{
+		{Name: "agent-type-1", Endpoint: apiMock.Host(), Token: "token-1"},
+		{Name: "agent-type-2", Endpoint: apiMock.Host(), Token: "token-2"},
+		{Name: "agent-type-3", Endpoint: apiMock.Host(), Token: "token-1"},
+		{Name: "agent-type-4", Endpoint: apiMock.Host(), Token: "not-registered"},
+	})
+
+	// all pages are fetched, only once for agent types sharing credentials
+	assert.Equal(t, 3, apiMock.RequestCount("token-1"))
+	assert.Equal(t, 1, apiMock.RequestCount("token-2"))
+	assert.Equal(t, agents, list["agent-type-1"])
+	assert.Equal(t, agents, list["agent-type-3"])
+	assert.Empty(t, list["agent-type-2"])
+
+	// failed listings are not included
+	assert.NotContains(t, list, "agent-type-4")
+}
+
+func Test__DecodeAgentsPage(t *testing.T) {
+	t.Run("valid page", func(t *testing.T) {
+		p, err := decodeAgentsPage([]byte(`{"agents":[{"name":"a","version":"v2.2.0","os":"linux","arch":"arm64","hostname":"pod-a","connected_at":"2023-01-01T00:00:00Z","unknown":1}],"next_page_cursor":"abc"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", p.NextPageCursor)
+		assert.Equal(t, []common.Agent{{
+			Name:        "a",
+			Version:     "v2.2.0",
+			OS:          "linux",
+			Arch:        "arm64",
+			Hostname:    "pod-a",
+			ConnectedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		}}, *p.Agents)
+	})
+
+	t.Run("missing agents -> error", func(t *testing.T) {
+		_, err := decodeAgentsPage([]byte(`{"next_page_cursor":""}`))
+		assert.ErrorContains(t, err, "missing required field 'agents'")
+	})
+
+	t.Run("agent without name -> error", func(t *testing.T) {
+		_, err := decodeAgentsPage([]byte(`{"agents":[{"name":"a"},{"version":"v2.2.0"}]}`))
+		assert.ErrorContains(t, err, "missing required field 'agents[1].name'")
+	})
+}
@@ -0,0 +1,190 @@
+package semaphore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"k8s.io/klog/v2"
+)
+
+// Authenticator authenticates requests to the Semaphore API.
+type Authenticator interface {
+	// Authenticate adds the credentials to the request, before it is sent.
+	Authenticate(req *http.Request) error
+
+	// HTTPClient returns the client used to send authenticated requests.
+	// Most authenticators just use the base client,
+	// but some need to authenticate at the transport level.
+	HTTPClient(base *http.Client) *http.Client
+}
+
+// NewAuthenticator creates the authenticator for an agent type's token and auth config.
+// The HTTP client is used for requests the authenticator itself needs to make,
+// like fetching OAuth2 access tokens.
+func NewAuthenticator(token string, config common.AuthConfig, httpClient *http.Client) (Authenticator, error) {
+	switch config.Scheme {
+	case "", common.AuthSchemeToken:
+		return newHeaderAuthenticator("Token", token)
+	case common.AuthSchemeBearer:
+		return newHeaderAuthenticator("Bearer", token)
+	case common.AuthSchemeOAuth2:
+		return newOAuth2Authenticator(config, httpClient)
+	case common.AuthSchemeMTLS:
+		return newMTLSAuthenticator(config)
+	default:
+		return nil, fmt.Errorf("unsupported auth scheme '%s'", config.Scheme)
+	}
+}
+
+// Sends a static token in the Authorization header.
+type headerAuthenticator struct {
+	header string
+}
+
+func newHeaderAuthenticator(scheme, token string) (*headerAuthenticator, error) {
+	if token == "" {
+		return nil, fmt.Errorf("token is required for the '%s' auth scheme", strings.ToLower(scheme))
+	}
+
+	return &headerAuthenticator{header: fmt.Sprintf("%s %s", scheme, token)}, nil
+}
+
+func (a *headerAuthenticator) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", a.header)
+	return nil
+}
+
+func (a *headerAuthenticator) HTTPClient(base *http.Client) *http.Client {
+	return base
+}
+
+// Uses the OAuth2 client credentials flow to get access tokens.
+// Access tokens are cached, and only refreshed when they expire.
+// They are fetched with the context of the request being authenticated,
+// so fetching them is also bound by the collection deadline.
+type oauth2Authenticator struct {
+	config     clientcredentials.Config
+	httpClient *http.Client
+	token      *oauth2.Token
+	mu         sync.Mutex
+}
+
+func newOAuth2Authenticator(config common.AuthConfig, httpClient *http.Client) (*oauth2Authenticator, error) {
+	if config.ClientID == "" || config.ClientSecret == "" || config.TokenURL == "" {
+		return nil, fmt.Errorf("client ID, client secret and token URL are required for the 'oauth2' auth scheme")
+	}
+
+	return &oauth2Authenticator{
+		config: clientcredentials.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			TokenURL:     config.TokenURL,
+			Scopes:       strings.Fields(config.Scopes),
+		},
+		httpClient: httpClient,
+	}, nil
+}
+
+func (a *oauth2Authenticator) Authenticate(req *http.Request) error {
+	token, err := a.getToken(req.Context())
+	if err != nil {
+		return fmt.Errorf("error getting OAuth2 access token: %v", err)
+	}
+
+	token.SetAuthHeader(req)
+	return nil
+}
+
+func (a *oauth2Authenticator) getToken(ctx context.Context) (*oauth2.Token, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token.Valid() {
+		return a.token, nil
+	}
+
+	if a.httpClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, a.httpClient)
+	}
+
+	token, err := a.config.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a.token = token
+	return token, nil
+}
+
+func (a *oauth2Authenticator) HTTPClient(base *http.Client) *http.Client {
+	return base
+}
+
+// Authenticates with a client certificate, without any Authorization header.
+type mtlsAuthenticator struct {
+	tlsConfig *tls.Config
+}
+
+func newMTLSAuthenticator(config common.AuthConfig) (*mtlsAuthenticator, error) {
+	if config.ClientCert == "" || config.ClientKey == "" {
+		return nil, fmt.Errorf("client certificate and key are required for the 'mtls' auth scheme")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, fmt.Errorf("error loading CA certificate")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return &mtlsAuthenticator{tlsConfig: tlsConfig}, nil
+}
+
+func (a *mtlsAuthenticator) Authenticate(req *http.Request) error {
+	return nil
+}
+
+// The client certificate is set on a clone of the base transport,
+// so everything else about the base client, like proxy settings, is kept.
+func (a *mtlsAuthenticator) HTTPClient(base *http.Client) *http.Client {
+	if base == nil {
+		base = http.DefaultClient
+	}
+
+	var transport *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		klog.Warningf("Cannot set client certificate on transport %T, using the default transport", t)
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	transport.TLSClientConfig = a.tlsConfig
+
+	client := *base
+	client.Transport = transport
+	return &client
+}
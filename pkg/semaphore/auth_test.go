@@ -0,0 +1,249 @@
+package semaphore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Authenticator(t *testing.T) {
+	t.Run("unsupported scheme -> error", func(t *testing.T) {
+		_, err := NewAuthenticator("token", common.AuthConfig{Scheme: "basic"}, nil)
+		assert.ErrorContains(t, err, "unsupported auth scheme 'basic'")
+	})
+
+	t.Run("no scheme -> token", func(t *testing.T) {
+		a, err := NewAuthenticator("my-token", common.AuthConfig{}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "Token my-token", authorizationHeader(t, a))
+	})
+
+	t.Run("token scheme without token -> error", func(t *testing.T) {
+		_, err := NewAuthenticator("", common.AuthConfig{Scheme: common.AuthSchemeToken}, nil)
+		assert.ErrorContains(t, err, "token is required for the 'token' auth scheme")
+	})
+
+	t.Run("bearer", func(t *testing.T) {
+		a, err := NewAuthenticator("my-token", common.AuthConfig{Scheme: common.AuthSchemeBearer}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer my-token", authorizationHeader(t, a))
+	})
+
+	t.Run("oauth2 without client credentials -> error", func(t *testing.T) {
+		_, err := NewAuthenticator("", common.AuthConfig{Scheme: common.AuthSchemeOAuth2, ClientID: "id"}, nil)
+		assert.ErrorContains(t, err, "required for the 'oauth2' auth scheme")
+	})
+
+	t.Run("oauth2 caches access token", func(t *testing.T) {
+		var tokenRequests int32
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&tokenRequests, 1)
+			assert.NoError(t, r.ParseForm())
+			assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+			assert.Equal(t, "metrics:read", r.Form.Get("scope"))
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "access-token-1",
+				"token_type":   "bearer",
+				"expires_in":   3600,
+			})
+		}))
+
+		defer tokenServer.Close()
+
+		a, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:       common.AuthSchemeOAuth2,
+			ClientID:     "id",
+			ClientSecret: "secret",
+			TokenURL:     tokenServer.URL,
+			Scopes:       "metrics:read",
+		}, http.DefaultClient)
+
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer access-token-1", authorizationHeader(t, a))
+		assert.Equal(t, "Bearer access-token-1", authorizationHeader(t, a))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+	})
+
+	t.Run("oauth2 token endpoint fails -> error", func(t *testing.T) {
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(401)
+		}))
+
+		defer tokenServer.Close()
+
+		a, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:       common.AuthSchemeOAuth2,
+			ClientID:     "id",
+			ClientSecret: "secret",
+			TokenURL:     tokenServer.URL,
+		}, http.DefaultClient)
+
+		require.NoError(t, err)
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		assert.ErrorContains(t, a.Authenticate(req), "error getting OAuth2 access token")
+	})
+
+	t.Run("oauth2 token is fetched with the request context", func(t *testing.T) {
+		release := make(chan bool)
+		tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+
+		defer tokenServer.Close()
+		defer close(release)
+
+		a, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:       common.AuthSchemeOAuth2,
+			ClientID:     "id",
+			ClientSecret: "secret",
+			TokenURL:     tokenServer.URL,
+		}, http.DefaultClient)
+
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+		assert.ErrorContains(t, a.Authenticate(req), "context deadline exceeded")
+	})
+
+	t.Run("mtls without certificate -> error", func(t *testing.T) {
+		_, err := NewAuthenticator("", common.AuthConfig{Scheme: common.AuthSchemeMTLS}, nil)
+		assert.ErrorContains(t, err, "client certificate and key are required")
+	})
+
+	t.Run("mtls with invalid certificate -> error", func(t *testing.T) {
+		_, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:     common.AuthSchemeMTLS,
+			ClientCert: "not-a-cert",
+			ClientKey:  "not-a-key",
+		}, nil)
+
+		assert.ErrorContains(t, err, "error loading client certificate")
+	})
+
+	t.Run("mtls sends client certificate and no authorization header", func(t *testing.T) {
+		caCert, caKey := newTestCertificate(t, nil, nil)
+		clientCert, clientKey := newTestCertificate(t, caCert, caKey)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(caCert)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			assert.Len(t, r.TLS.PeerCertificates, 1)
+			w.WriteHeader(200)
+		}))
+
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+		server.StartTLS()
+		defer server.Close()
+
+		serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		a, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:     common.AuthSchemeMTLS,
+			ClientCert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Raw})),
+			ClientKey:  string(encodeKey(t, clientKey)),
+			CACert:     string(serverCA),
+		}, nil)
+
+		require.NoError(t, err)
+
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		require.NoError(t, a.Authenticate(req))
+		res, err := a.HTTPClient(http.DefaultClient).Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+		res.Body.Close()
+	})
+
+	t.Run("mtls keeps base transport settings", func(t *testing.T) {
+		clientCert, clientKey := newTestCertificate(t, nil, nil)
+		a, err := NewAuthenticator("", common.AuthConfig{
+			Scheme:     common.AuthSchemeMTLS,
+			ClientCert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Raw})),
+			ClientKey:  string(encodeKey(t, clientKey)),
+		}, nil)
+
+		require.NoError(t, err)
+
+		proxy := func(*http.Request) (*url.URL, error) { return url.Parse("http://proxy.example.com:3128") }
+		base := &http.Client{Transport: &http.Transport{Proxy: proxy, MaxIdleConns: 7}, Timeout: 5 * time.Second}
+
+		client := a.HTTPClient(base)
+		assert.Equal(t, 5*time.Second, client.Timeout)
+
+		transport, ok := client.Transport.(*http.Transport)
+		require.True(t, ok)
+		assert.NotNil(t, transport.Proxy)
+		assert.Equal(t, 7, transport.MaxIdleConns)
+		assert.Len(t, transport.TLSClientConfig.Certificates, 1)
+
+		// the client certificate is not set on the base transport
+		if baseTLS := base.Transport.(*http.Transport).TLSClientConfig; baseTLS != nil {
+			assert.Empty(t, baseTLS.Certificates)
+		}
+	})
+}
+
+func authorizationHeader(t *testing.T, a Authenticator) string {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, a.Authenticate(req))
+	return req.Header.Get("Authorization")
+}
+
+// Creates a certificate signed by the parent,
+// or a self-signed CA certificate, if no parent is given.
+func newTestCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func encodeKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
@@ -1,77 +1,323 @@
 package semaphore
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
 type Client struct {
-	httpClient *http.Client
-	useHTTP    bool
+	httpClient  *http.Client
+	useHTTP     bool
+	rateLimiter *RateLimiter
+
+	// Authenticators are kept around between cycles,
+	// so things like OAuth2 access tokens and TLS connections are reused.
+	authenticators map[credentials]*authenticatedClient
+	authMu         sync.Mutex
+
+	// The requests needed for each host, the last time the rate limit was checked.
+	rateLimitChecks map[string]int
+	rateLimitMu     sync.Mutex
+}
+
+type authenticatedClient struct {
+	authenticator Authenticator
+	httpClient    *http.Client
 }
 
 func NewClient(httpClient *http.Client, useHTTP bool) *Client {
-	return &Client{httpClient: httpClient, useHTTP: useHTTP}
+	return &Client{
+		httpClient:      httpClient,
+		useHTTP:         useHTTP,
+		authenticators:  map[credentials]*authenticatedClient{},
+		rateLimitChecks: map[string]int{},
+	}
+}
+
+// WithRateLimiter makes the client wait on the rate limiter before every request.
+// The same rate limiter should be used by all clients in the process,
+// so the limits for an endpoint host are enforced across all of them.
+func (c *Client) WithRateLimiter(rateLimiter *RateLimiter) *Client {
+	c.rateLimiter = rateLimiter
+	return c
+}
+
+// Agent types that point to the same endpoint with the same credentials and API version
+// get the same metrics back from the Semaphore API, so we only
+// need to fetch them once per cycle and share the result.
+type credentials struct {
+	endpoint   string
+	token      string
+	auth       common.AuthConfig
+	apiVersion string
 }
 
-func (c *Client) GetMetrics(agentTypes []*common.AgentType) []external_metrics.ExternalMetricValue {
+type agentTypeGroup struct {
+	credentials credentials
+	agentTypes  []*common.AgentType
+}
+
+func (c *Client) GetMetrics(ctx context.Context, agentTypes []*common.AgentType) []external_metrics.ExternalMetricValue {
 	values := []external_metrics.ExternalMetricValue{}
+	metrics := c.FetchMetrics(ctx, agentTypes)
 
 	for _, agentType := range agentTypes {
-		m, err := c.getForAgentType(agentType.Endpoint, agentType.Token)
+		if m, ok := metrics[agentType.Name]; ok {
+			values = append(values, common.GenerateForAgentType(agentType, m, time.Now())...)
+		}
+	}
+
+	return values
+}
+
+// FetchMetrics returns the metrics for each agent type, keyed by agent type name.
+// Agent types for which the metrics could not be fetched are not included.
+func (c *Client) FetchMetrics(ctx context.Context, agentTypes []*common.AgentType) map[string]*common.Metrics {
+	metrics := map[string]*common.Metrics{}
+	groups := groupByCredentials(agentTypes)
+	c.forgetUnusedAuthenticators(groups)
+
+	for _, group := range groups {
+		m, err := c.getForAgentType(ctx, group)
 		if err != nil {
-			klog.Errorf("Error collecting metrics from Semaphore API for %s: %v", agentType.Name, err)
+			klog.Errorf("Error collecting metrics from Semaphore API for %s: %v", names(group.agentTypes), err)
 			continue
 		}
 
-		klog.Infof("Metrics for %s: %s", agentType.Name, m.String())
-		labels := map[string]string{"agent_type": agentType.Name}
-		values = append(values, m.GenerateAll(labels)...)
+		for _, agentType := range group.agentTypes {
+			klog.Infof("Metrics for %s: %s", agentType.Name, m.String())
+			metrics[agentType.Name] = m
+		}
 	}
 
-	return values
+	return metrics
+}
+
+// CheckRateLimit warns about the endpoint hosts where the rate limit does not allow
+// the requests needed for the agent types over a period, e.g. the collection interval,
+// so some of them are abandoned every time. Agent types sharing credentials need
+// requestsPerGroup requests between them. A host is only warned about again when
+// the number of requests for it changes. Returns the requests needed for the hosts over the limit.
+func (c *Client) CheckRateLimit(agentTypes []*common.AgentType, requestsPerGroup int, period time.Duration) map[string]int {
+	overLimit := map[string]int{}
+	if c.rateLimiter == nil {
+		return overLimit
+	}
+
+	requests := map[string]int{}
+	for _, group := range groupByCredentials(agentTypes) {
+		requests[hostFromEndpoint(group.credentials.endpoint)] += requestsPerGroup
+	}
+
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+
+	allowed := c.rateLimiter.RequestsPer(period)
+	for host, n := range requests {
+		if float64(n) <= allowed {
+			continue
+		}
+
+		overLimit[host] = n
+		if c.rateLimitChecks[host] != n {
+			klog.Warningf("Rate limit for %s allows %.0f requests every %v, but %d are needed for the agent types using it: increase --semaphore-api-rate-limit, or some agent types will not have metrics", host, allowed, period, n)
+		}
+	}
+
+	c.rateLimitChecks = requests
+	return overLimit
 }
 
-func (c *Client) getURL(endpoint string) string {
+// Groups agent types by endpoint, credentials and API version,
+// keeping the order in which the groups first appear.
+func groupByCredentials(agentTypes []*common.AgentType) []*agentTypeGroup {
+	groups := []*agentTypeGroup{}
+	index := map[credentials]*agentTypeGroup{}
+
+	for _, agentType := range agentTypes {
+		key := credentials{
+			endpoint:   agentType.Endpoint,
+			token:      agentType.Token,
+			auth:       agentType.Auth,
+			apiVersion: agentType.APIVersion,
+		}
+
+		group, ok := index[key]
+		if !ok {
+			group = &agentTypeGroup{credentials: key}
+			index[key] = group
+			groups = append(groups, group)
+		}
+
+		group.agentTypes = append(group.agentTypes, agentType)
+	}
+
+	return groups
+}
+
+func names(agentTypes []*common.AgentType) []string {
+	n := []string{}
+	for _, agentType := range agentTypes {
+		n = append(n, agentType.Name)
+	}
+
+	return n
+}
+
+const (
+	metricsPath = "self_hosted_agents/metrics"
+	agentsPath  = "self_hosted_agents/agents"
+)
+
+func (c *Client) getURL(endpoint, path string, query url.Values) string {
+	scheme := "https"
 	if c.useHTTP {
-		return fmt.Sprintf("http://%s/api/v1/self_hosted_agents/metrics", endpoint)
+		scheme = "http"
+	}
+
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     endpoint,
+		Path:     "/api/v1/" + path,
+		RawQuery: query.Encode(),
 	}
 
-	return fmt.Sprintf("https://%s/api/v1/self_hosted_agents/metrics", endpoint)
+	return u.String()
 }
 
-func (c *Client) getForAgentType(endpoint, token string) (*common.Metrics, error) {
-	req, err := http.NewRequest("GET", c.getURL(endpoint), nil)
+func (c *Client) getForAgentType(ctx context.Context, group *agentTypeGroup) (*common.Metrics, error) {
+	decode, err := decoderFor(group.credentials.apiVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", token))
-	res, err := c.httpClient.Do(req)
+	var m *common.Metrics
+	err = c.get(ctx, group, metricsPath, url.Values{}, func(response []byte) (err error) {
+		m, err = decode(response)
+		return err
+	})
+
+	return m, err
+}
+
+// Sends a GET request to the Semaphore API, using the credentials for the agent type group,
+// and decodes the response body, if the request succeeds. Decoding is part of the request span,
+// so responses that cannot be decoded are recorded on it too.
+func (c *Client) get(ctx context.Context, group *agentTypeGroup, path string, query url.Values, decode func(response []byte) error) (err error) {
+	credentials := group.credentials
+	ctx, span := tracing.Tracer().Start(ctx, "Semaphore API: GET "+path, trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(
+		attribute.String("endpoint", credentials.endpoint),
+		attribute.Array("agent_types", names(group.agentTypes)),
+	)
+
+	defer func() { tracing.End(span, err) }()
+
+	client, err := c.authenticatedClientFor(credentials)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Wait(ctx, credentials.endpoint); err != nil {
+			return fmt.Errorf("rate limited: %v", err)
+		}
+
+		span.AddEvent("rate limiter released request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.getURL(credentials.endpoint, path, query), nil)
+	if err != nil {
+		return err
+	}
+
+	err = client.authenticator.Authenticate(req)
+	if err != nil {
+		return err
+	}
+
+	span.SetAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(res.StatusCode))
+
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("request failed with %d", res.StatusCode)
+		return fmt.Errorf("request failed with %d", res.StatusCode)
 	}
 
 	response, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+		return fmt.Errorf("error reading response: %v", err)
+	}
+
+	if err := decode(response); err != nil {
+		return err
+	}
+
+	span.SetStatus(codes.Ok, "")
+	return nil
+}
+
+func (c *Client) authenticatedClientFor(credentials credentials) (*authenticatedClient, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if client, ok := c.authenticators[credentials]; ok {
+		return client, nil
 	}
 
-	var m common.Metrics
-	err = json.Unmarshal(response, &m)
+	authenticator, err := NewAuthenticator(credentials.token, credentials.auth, c.httpClient)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing response: %v", err)
+		return nil, err
+	}
+
+	client := &authenticatedClient{
+		authenticator: authenticator,
+		httpClient:    authenticator.HTTPClient(c.httpClient),
 	}
 
-	return &m, nil
+	c.authenticators[credentials] = client
+	return client, nil
+}
+
+// Authenticators for agent types that are gone, or whose credentials changed,
+// are not needed anymore, so we don't keep them around.
+func (c *Client) forgetUnusedAuthenticators(groups []*agentTypeGroup) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	inUse := map[credentials]bool{}
+	for _, group := range groups {
+		inUse[group.credentials] = true
+	}
+
+	for credentials := range c.authenticators {
+		if !inUse[credentials] {
+			delete(c.authenticators, credentials)
+		}
+	}
 }
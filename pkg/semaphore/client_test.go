@@ -1,12 +1,15 @@
 package semaphore
 
 import (
+	"context"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
 	testsupport "github.com/semaphoreci/k8s-metrics-apiserver/test/support"
 	"github.com/stretchr/testify/assert"
+	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
 func Test__GetMetricsForSingleAgentType(t *testing.T) {
@@ -20,7 +23,7 @@ func Test__GetMetricsForSingleAgentType(t *testing.T) {
 	apiMock.RegisterAgentType("agent-type-1-token", m1)
 
 	c := NewClient(http.DefaultClient, true)
-	metrics := c.GetMetrics([]*common.AgentType{
+	metrics := c.GetMetrics(context.Background(), []*common.AgentType{
 		{
 			Name:     "agent-type-1",
 			Endpoint: apiMock.Host(),
@@ -28,7 +31,7 @@ func Test__GetMetricsForSingleAgentType(t *testing.T) {
 		},
 	})
 
-	expected := m1.GenerateAll(map[string]string{"agent_type": "agent-type-1"})
+	expected := expectedValues(m1, "agent-type-1")
 	for i, v := range metrics {
 		assert.Equal(t, v.MetricLabels, expected[i].MetricLabels)
 		assert.Equal(t, v.MetricName, expected[i].MetricName)
@@ -56,7 +59,7 @@ func Test__GetMetricsForMultipleAgentTypes(t *testing.T) {
 	apiMock.RegisterAgentType("agent-type-2-token", m2)
 
 	c := NewClient(http.DefaultClient, true)
-	metrics := c.GetMetrics([]*common.AgentType{
+	metrics := c.GetMetrics(context.Background(), []*common.AgentType{
 		{
 			Name:     "agent-type-1",
 			Endpoint: apiMock.Host(),
@@ -70,8 +73,8 @@ func Test__GetMetricsForMultipleAgentTypes(t *testing.T) {
 	})
 
 	expected := append(
-		m1.GenerateAll(map[string]string{"agent_type": "agent-type-1"}),
-		m2.GenerateAll(map[string]string{"agent_type": "agent-type-2"})...,
+		expectedValues(m1, "agent-type-1"),
+		expectedValues(m2, "agent-type-2")...,
 	)
 
 	for i, v := range metrics {
@@ -80,3 +83,88 @@ func Test__GetMetricsForMultipleAgentTypes(t *testing.T) {
 		assert.Equal(t, v.Value, expected[i].Value)
 	}
 }
+
+func Test__GetMetricsForAgentTypesSharingCredentials(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+
+	m1 := common.Metrics{
+		Agents: common.AgentMetrics{Idle: 2, Occupied: 3},
+		Jobs:   common.JobMetrics{Running: 3, Queued: 1},
+	}
+
+	m2 := common.Metrics{
+		Agents: common.AgentMetrics{Idle: 5, Occupied: 5},
+		Jobs:   common.JobMetrics{Running: 5, Queued: 0},
+	}
+
+	apiMock.RegisterAgentType("shared-token", m1)
+	apiMock.RegisterAgentType("other-token", m2)
+
+	c := NewClient(http.DefaultClient, true)
+	metrics := c.GetMetrics(context.Background(), []*common.AgentType{
+		{Name: "agent-type-1", Endpoint: apiMock.Host(), Token: "shared-token"},
+		{Name: "agent-type-2", Endpoint: apiMock.Host(), Token: "other-token"},
+		{Name: "agent-type-3", Endpoint: apiMock.Host(), Token: "shared-token"},
+	})
+
+	// only one request is made for agent types with the same endpoint and token
+	assert.Equal(t, 1, apiMock.RequestCount("shared-token"))
+	assert.Equal(t, 1, apiMock.RequestCount("other-token"))
+
+	// but every agent type still gets its own metrics
+	expected := append(
+		expectedValues(m1, "agent-type-1"),
+		expectedValues(m2, "agent-type-2")...,
+	)
+
+	expected = append(expected, expectedValues(m1, "agent-type-3")...)
+
+	if assert.Len(t, metrics, len(expected)) {
+		for i, v := range metrics {
+			assert.Equal(t, v.MetricLabels, expected[i].MetricLabels)
+			assert.Equal(t, v.MetricName, expected[i].MetricName)
+			assert.Equal(t, v.Value, expected[i].Value)
+		}
+	}
+
+	apiMock.Close()
+}
+
+func Test__GetMetricsWithBearerAuth(t *testing.T) {
+	apiMock := testsupport.NewAPIMockServer()
+	apiMock.Init()
+
+	m1 := common.Metrics{
+		Agents: common.AgentMetrics{Idle: 1, Occupied: 1},
+		Jobs:   common.JobMetrics{Running: 1, Queued: 0},
+	}
+
+	apiMock.RegisterAgentType("agent-type-1-token", m1)
+
+	c := NewClient(http.DefaultClient, true)
+	metrics := c.GetMetrics(context.Background(), []*common.AgentType{
+		{
+			Name:     "agent-type-1",
+			Endpoint: apiMock.Host(),
+			Token:    "agent-type-1-token",
+			Auth:     common.AuthConfig{Scheme: common.AuthSchemeBearer},
+		},
+		{
+			Name:     "agent-type-2",
+			Endpoint: apiMock.Host(),
+			Auth:     common.AuthConfig{Scheme: "unknown"},
+		},
+	})
+
+	// agent type with unknown auth scheme is skipped
+	assert.Len(t, metrics, len(expectedValues(m1, "agent-type-1")))
+	assert.Equal(t, 1, apiMock.RequestCount("agent-type-1-token"))
+
+	apiMock.Close()
+}
+
+// Values generated for an agent type with the default configuration.
+func expectedValues(m common.Metrics, agentType string) []external_metrics.ExternalMetricValue {
+	return common.GenerateForAgentType(&common.AgentType{Name: agentType}, &m, time.Now())
+}
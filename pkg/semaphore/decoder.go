@@ -0,0 +1,164 @@
+package semaphore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"k8s.io/klog/v2"
+)
+
+// The API version used when the agent type does not specify one.
+const DefaultAPIVersion = "v1"
+
+// A decoder turns the response of the self_hosted_agents/metrics endpoint into metrics.
+// Decoders must fail if a required field is missing or invalid,
+// because zeroed metrics are indistinguishable from an idle agent pool,
+// and would make the HPA scale the pool down to its minimum.
+type decoder func(data []byte) (*common.Metrics, error)
+
+// Decoders for each version of the self_hosted_agents/metrics response.
+// When the Semaphore API starts returning new fields, a new version
+// can be added here, without breaking agent types pointing to older servers.
+var decoders = map[string]decoder{
+	"v1": decodeV1,
+}
+
+func decoderFor(version string) (decoder, error) {
+	if version == "" {
+		version = DefaultAPIVersion
+	}
+
+	d, ok := decoders[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported API version '%s'", version)
+	}
+
+	return d, nil
+}
+
+type v1Response struct {
+	Jobs   *v1JobMetrics   `json:"jobs"`
+	Agents *v1AgentMetrics `json:"agents"`
+}
+
+type v1JobMetrics struct {
+	Queued  *int `json:"queued"`
+	Running *int `json:"running"`
+}
+
+type v1AgentMetrics struct {
+	Idle     *int `json:"idle"`
+	Occupied *int `json:"occupied"`
+}
+
+var v1Fields = []string{
+	"jobs",
+	"jobs.queued",
+	"jobs.running",
+	"agents",
+	"agents.idle",
+	"agents.occupied",
+}
+
+func decodeV1(data []byte) (*common.Metrics, error) {
+	var r v1Response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+
+	logUnknownFields(data, v1Fields)
+
+	if r.Jobs == nil {
+		return nil, fmt.Errorf("missing required field 'jobs'")
+	}
+
+	if r.Agents == nil {
+		return nil, fmt.Errorf("missing required field 'agents'")
+	}
+
+	queued, err := required("jobs.queued", r.Jobs.Queued)
+	if err != nil {
+		return nil, err
+	}
+
+	running, err := required("jobs.running", r.Jobs.Running)
+	if err != nil {
+		return nil, err
+	}
+
+	idle, err := required("agents.idle", r.Agents.Idle)
+	if err != nil {
+		return nil, err
+	}
+
+	occupied, err := required("agents.occupied", r.Agents.Occupied)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.Metrics{
+		Jobs:   common.JobMetrics{Queued: queued, Running: running},
+		Agents: common.AgentMetrics{Idle: idle, Occupied: occupied},
+	}, nil
+}
+
+func required(field string, v *int) (int, error) {
+	if v == nil {
+		return 0, fmt.Errorf("missing required field '%s'", field)
+	}
+
+	if *v < 0 {
+		return 0, fmt.Errorf("invalid value for field '%s': %d", field, *v)
+	}
+
+	return *v, nil
+}
+
+// Unknown fields are not a problem, since the API can add new fields at any time,
+// but knowing about them helps to figure out when a new decoder is needed.
+func logUnknownFields(data []byte, known []string) {
+	if !klog.V(4).Enabled() {
+		return
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return
+	}
+
+	knownFields := map[string]bool{}
+	for _, f := range known {
+		knownFields[f] = true
+	}
+
+	unknown := findUnknownFields(raw, "", knownFields)
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		klog.V(4).Infof("Unknown fields in Semaphore API response: %s", strings.Join(unknown, ", "))
+	}
+}
+
+func findUnknownFields(o map[string]interface{}, prefix string, known map[string]bool) []string {
+	unknown := []string{}
+
+	for k, v := range o {
+		path := strings.ToLower(k)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if !known[path] {
+			unknown = append(unknown, path)
+			continue
+		}
+
+		if nested, ok := v.(map[string]interface{}); ok {
+			unknown = append(unknown, findUnknownFields(nested, path, known)...)
+		}
+	}
+
+	return unknown
+}
@@ -0,0 +1,78 @@
+package semaphore
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__Decoder(t *testing.T) {
+	t.Run("unsupported version -> error", func(t *testing.T) {
+		_, err := decoderFor("v999")
+		assert.ErrorContains(t, err, "unsupported API version 'v999'")
+	})
+
+	t.Run("empty version -> default decoder", func(t *testing.T) {
+		d, err := decoderFor("")
+		assert.NoError(t, err)
+		assert.NotNil(t, d)
+	})
+
+	t.Run("v1 -> all fields present", func(t *testing.T) {
+		m, err := decodeV1([]byte(`{"jobs":{"queued":1,"running":2},"agents":{"idle":3,"occupied":4}}`))
+		assert.NoError(t, err)
+		assert.Equal(t, &common.Metrics{
+			Jobs:   common.JobMetrics{Queued: 1, Running: 2},
+			Agents: common.AgentMetrics{Idle: 3, Occupied: 4},
+		}, m)
+	})
+
+	t.Run("v1 -> zeros are valid", func(t *testing.T) {
+		m, err := decodeV1([]byte(`{"jobs":{"queued":0,"running":0},"agents":{"idle":0,"occupied":0}}`))
+		assert.NoError(t, err)
+		assert.Equal(t, &common.Metrics{}, m)
+	})
+
+	t.Run("v1 -> unknown fields are ignored", func(t *testing.T) {
+		m, err := decodeV1([]byte(`{"jobs":{"queued":1,"running":2,"waiting":5},"agents":{"idle":3,"occupied":4},"version":"v2"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, m.Jobs.Queued)
+		assert.Equal(t, 4, m.Agents.Occupied)
+	})
+
+	t.Run("v1 -> missing object -> error", func(t *testing.T) {
+		_, err := decodeV1([]byte(`{"jobs":{"queued":1,"running":2}}`))
+		assert.ErrorContains(t, err, "missing required field 'agents'")
+	})
+
+	t.Run("v1 -> missing field -> error", func(t *testing.T) {
+		_, err := decodeV1([]byte(`{"jobs":{"queued":1},"agents":{"idle":3,"occupied":4}}`))
+		assert.ErrorContains(t, err, "missing required field 'jobs.running'")
+	})
+
+	t.Run("v1 -> renamed field -> error", func(t *testing.T) {
+		_, err := decodeV1([]byte(`{"jobs":{"queued":1,"running":2},"agents":{"idle_count":3,"occupied":4}}`))
+		assert.ErrorContains(t, err, "missing required field 'agents.idle'")
+	})
+
+	t.Run("v1 -> negative value -> error", func(t *testing.T) {
+		_, err := decodeV1([]byte(`{"jobs":{"queued":-1,"running":2},"agents":{"idle":3,"occupied":4}}`))
+		assert.ErrorContains(t, err, "invalid value for field 'jobs.queued': -1")
+	})
+
+	t.Run("v1 -> wrong type -> error", func(t *testing.T) {
+		_, err := decodeV1([]byte(`{"jobs":{"queued":"1","running":2},"agents":{"idle":3,"occupied":4}}`))
+		assert.ErrorContains(t, err, "error parsing response")
+	})
+
+	t.Run("unknown fields are found in nested objects", func(t *testing.T) {
+		unknown := findUnknownFields(map[string]interface{}{
+			"jobs":    map[string]interface{}{"queued": 1, "waiting": 2},
+			"agents":  map[string]interface{}{"idle": 1},
+			"version": "v2",
+		}, "", map[string]bool{"jobs": true, "jobs.queued": true, "agents": true, "agents.idle": true})
+
+		assert.ElementsMatch(t, []string{"jobs.waiting", "version"}, unknown)
+	})
+}
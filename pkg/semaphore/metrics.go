@@ -0,0 +1,35 @@
+package semaphore
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// Metrics about the adapter itself, exposed through the /metrics endpoint of the API server.
+var (
+	rateLimiterWaitSeconds = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      "semaphore_adapter",
+			Name:           "rate_limiter_wait_seconds",
+			Help:           "Time spent waiting on the client-side rate limiter before sending a request to the Semaphore API.",
+			Buckets:        []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"host"},
+	)
+
+	rateLimiterAbandonedTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      "semaphore_adapter",
+			Name:           "rate_limiter_abandoned_requests_total",
+			Help:           "Requests to the Semaphore API not sent because the client-side rate limiter would not allow them before their deadline.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"host"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(rateLimiterWaitSeconds)
+	legacyregistry.MustRegister(rateLimiterAbandonedTotal)
+}
@@ -0,0 +1,91 @@
+package semaphore
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter enforces a token-bucket rate limit for requests
+// going to the Semaphore API. A separate bucket is kept for each endpoint host,
+// so agent types for different organizations do not slow each other down,
+// but every agent type and poller using the same host share the same bucket.
+type RateLimiter struct {
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*rate.Limiter
+	mu       sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter allowing requestsPerSecond requests
+// for each endpoint host, with bursts of up to burst requests.
+// A non-positive requestsPerSecond disables rate limiting.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	limit := rate.Limit(requestsPerSecond)
+	if requestsPerSecond <= 0 {
+		limit = rate.Inf
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// Wait blocks until a request to endpoint is allowed, or the context is done.
+// If the context deadline would be exceeded before the request is allowed,
+// Wait returns an error right away instead of waiting.
+func (l *RateLimiter) Wait(ctx context.Context, endpoint string) error {
+	host := hostFromEndpoint(endpoint)
+
+	start := time.Now()
+	err := l.limiterFor(host).Wait(ctx)
+	rateLimiterWaitSeconds.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rateLimiterAbandonedTotal.WithLabelValues(host).Inc()
+	}
+
+	return err
+}
+
+// RequestsPer returns how many requests the rate limit allows for each host
+// over a period, without the burst, or +Inf if rate limiting is disabled.
+func (l *RateLimiter) RequestsPer(period time.Duration) float64 {
+	if l.limit == rate.Inf {
+		return math.Inf(1)
+	}
+
+	return float64(l.limit) * period.Seconds()
+}
+
+func (l *RateLimiter) limiterFor(host string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[host] = limiter
+	}
+
+	return limiter
+}
+
+func hostFromEndpoint(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+
+	return strings.ToLower(host)
+}
@@ -0,0 +1,125 @@
+package semaphore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func Test__RateLimiter(t *testing.T) {
+	t.Run("disabled -> never waits", func(t *testing.T) {
+		l := NewRateLimiter(0, 1)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, l.Wait(context.Background(), "example.com"))
+		}
+	})
+
+	t.Run("same host shares bucket, even with different ports", func(t *testing.T) {
+		l := NewRateLimiter(0.001, 1)
+		assert.NoError(t, l.Wait(context.Background(), "example.com:8080"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Error(t, l.Wait(ctx, "EXAMPLE.com"))
+	})
+
+	t.Run("different hosts use different buckets", func(t *testing.T) {
+		l := NewRateLimiter(0.001, 1)
+		assert.NoError(t, l.Wait(context.Background(), "a.example.com"))
+		assert.NoError(t, l.Wait(context.Background(), "b.example.com"))
+	})
+
+	t.Run("respects context deadline", func(t *testing.T) {
+		l := NewRateLimiter(1, 1)
+		assert.NoError(t, l.Wait(context.Background(), "example.com"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		assert.Error(t, l.Wait(ctx, "example.com"))
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("abandoned requests are counted", func(t *testing.T) {
+		abandoned := func() float64 {
+			v, err := testutil.GetCounterMetricValue(rateLimiterAbandonedTotal.WithLabelValues("abandoned.example.com"))
+			require.NoError(t, err)
+			return v
+		}
+
+		l := NewRateLimiter(0.001, 1)
+		before := abandoned()
+		assert.NoError(t, l.Wait(context.Background(), "abandoned.example.com"))
+		assert.Equal(t, before, abandoned())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Error(t, l.Wait(ctx, "abandoned.example.com"))
+		assert.Equal(t, before+1, abandoned())
+	})
+
+	t.Run("requests allowed over a period", func(t *testing.T) {
+		assert.Equal(t, 50.0, NewRateLimiter(5, 10).RequestsPer(10*time.Second))
+		assert.True(t, math.IsInf(NewRateLimiter(0, 10).RequestsPer(10*time.Second), 1))
+	})
+}
+
+func Test__CheckRateLimit(t *testing.T) {
+	agentTypes := func(n int, endpoint string) []*common.AgentType {
+		agentTypes := []*common.AgentType{}
+		for i := 0; i < n; i++ {
+			agentTypes = append(agentTypes, &common.AgentType{
+				Name:     fmt.Sprintf("%s-%d", endpoint, i),
+				Endpoint: endpoint,
+				Token:    fmt.Sprintf("token-%d", i),
+			})
+		}
+
+		return agentTypes
+	}
+
+	t.Run("no rate limiter -> never over the limit", func(t *testing.T) {
+		c := NewClient(nil, true)
+		assert.Empty(t, c.CheckRateLimit(agentTypes(100, "a.example.com"), 2, 10*time.Second))
+	})
+
+	t.Run("hosts with more requests than allowed are over the limit", func(t *testing.T) {
+		c := NewClient(nil, true).WithRateLimiter(NewRateLimiter(5, 10))
+		types := append(agentTypes(30, "a.example.com"), agentTypes(20, "b.example.com:8080")...)
+
+		assert.Empty(t, c.CheckRateLimit(types, 1, 10*time.Second))
+		assert.Equal(t, map[string]int{"a.example.com": 60}, c.CheckRateLimit(types, 2, 10*time.Second))
+	})
+
+	t.Run("agent types sharing credentials need one request", func(t *testing.T) {
+		c := NewClient(nil, true).WithRateLimiter(NewRateLimiter(5, 10))
+		types := agentTypes(60, "a.example.com")
+		for _, agentType := range types {
+			agentType.Token = "shared"
+		}
+
+		assert.Empty(t, c.CheckRateLimit(types, 2, 10*time.Second))
+	})
+}
+
+func Test__GetMetricsWithRateLimiter(t *testing.T) {
+	l := NewRateLimiter(0.001, 1)
+
+	// exhaust the bucket
+	assert.NoError(t, l.Wait(context.Background(), "127.0.0.1"))
+
+	c := NewClient(nil, true).WithRateLimiter(l)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.getForAgentType(ctx, &agentTypeGroup{credentials: credentials{endpoint: "127.0.0.1:9999", token: "token"}})
+	assert.ErrorContains(t, err, "rate limited")
+}
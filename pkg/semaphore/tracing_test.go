@@ -0,0 +1,81 @@
+package semaphore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
+	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test__GetMetricsIsTraced(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(tracing.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var mu sync.Mutex
+	traceparents := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+
+		if strings.Contains(r.Header.Get("Authorization"), "bad-token") {
+			w.WriteHeader(401)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Authorization"), "invalid-response-token") {
+			_, _ = w.Write([]byte(`{"jobs":{"queued":1}}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"jobs":{"queued":1,"running":2},"agents":{"idle":3,"occupied":4}}`))
+	}))
+
+	defer server.Close()
+
+	c := NewClient(http.DefaultClient, true)
+	c.GetMetrics(context.Background(), []*common.AgentType{
+		{Name: "agent-type-1", Endpoint: server.Listener.Addr().String(), Token: "good-token"},
+		{Name: "agent-type-2", Endpoint: server.Listener.Addr().String(), Token: "bad-token"},
+		{Name: "agent-type-3", Endpoint: server.Listener.Addr().String(), Token: "invalid-response-token"},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	require.Len(t, traceparents, 3)
+
+	for i, span := range spans {
+		assert.Equal(t, "Semaphore API: GET self_hosted_agents/metrics", span.Name)
+
+		// trace context is propagated to the Semaphore API
+		assert.Contains(t, traceparents[i], span.SpanContext.TraceID().String())
+		assert.Contains(t, traceparents[i], span.SpanContext.SpanID().String())
+	}
+
+	assert.Equal(t, codes.Ok, spans[0].StatusCode)
+	assert.Equal(t, codes.Error, spans[1].StatusCode)
+	assert.Contains(t, spans[1].StatusMessage, "request failed with 401")
+
+	// responses that cannot be decoded are errors on the request span
+	assert.Equal(t, codes.Error, spans[2].StatusCode)
+	assert.NotEmpty(t, spans[2].StatusMessage)
+}
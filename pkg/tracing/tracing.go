@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ServiceName = "semaphore-metrics-apiserver"
+	tracerName  = "github.com/semaphoreci/k8s-metrics-apiserver"
+)
+
+type Config struct {
+	// OTLP gRPC endpoint to export spans to, e.g. localhost:4317.
+	// If empty, tracing is disabled.
+	Endpoint string
+
+	// Do not use TLS when connecting to the endpoint.
+	Insecure bool
+
+	// Fraction of traces to sample, between 0 and 1.
+	// Spans with a sampled parent are always sampled.
+	SamplingRatio float64
+}
+
+// Setup configures the global tracer provider and propagator.
+// The returned function flushes and stops the exporter, and should be called on shutdown.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if config.Endpoint == "" {
+		klog.Infof("No OTLP endpoint configured, tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if config.SamplingRatio < 0 || config.SamplingRatio > 1 {
+		return nil, fmt.Errorf("sampling ratio must be between 0 and 1, got %f", config.SamplingRatio)
+	}
+
+	options := []otlpgrpc.Option{otlpgrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlpgrpc.WithInsecure())
+	}
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(options...))
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %v", err)
+	}
+
+	provider := NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SamplingRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	klog.Infof("Exporting traces to %s, sampling %.2f%% of traces", config.Endpoint, 100*config.SamplingRatio)
+	return provider.Shutdown, nil
+}
+
+// NewTracerProvider creates a tracer provider identifying spans as coming from the adapter.
+func NewTracerProvider(options ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	options = append(options, sdktrace.WithResource(
+		resource.NewWithAttributes(semconv.ServiceNameKey.String(ServiceName)),
+	))
+
+	return sdktrace.NewTracerProvider(options...)
+}
+
+// Tracer returns the tracer used for all the adapter spans.
+// Since it uses the global tracer provider, it is a no-op until Setup() is called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// RecordError records the error, if any, and marks the span as failed.
+func RecordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End records the error, if any, and ends the span.
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
@@ -0,0 +1,24 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func Test__Setup(t *testing.T) {
+	t.Run("no endpoint -> tracing disabled, but propagation is configured", func(t *testing.T) {
+		shutdown, err := Setup(context.Background(), Config{})
+		assert.NoError(t, err)
+		assert.NoError(t, shutdown(context.Background()))
+		assert.IsType(t, propagation.TraceContext{}, otel.GetTextMapPropagator())
+	})
+
+	t.Run("invalid sampling ratio -> error", func(t *testing.T) {
+		_, err := Setup(context.Background(), Config{Endpoint: "localhost:4317", SamplingRatio: 2})
+		assert.ErrorContains(t, err, "sampling ratio must be between 0 and 1")
+	})
+}
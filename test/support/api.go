@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/semaphoreci/k8s-metrics-apiserver/pkg/common"
 )
@@ -14,11 +16,20 @@ type APIMockServer struct {
 	Server     *httptest.Server
 	Handler    http.Handler
 	AgentTypes map[string]common.Metrics
+	Agents     map[string][]common.Agent
+	Requests   map[string]int
+	mu         sync.Mutex
+
+	// If set, the agents listing returns at most this many agents per page,
+	// regardless of the page size requested.
+	AgentsPageSize int
 }
 
 func NewAPIMockServer() *APIMockServer {
 	return &APIMockServer{
 		AgentTypes: map[string]common.Metrics{},
+		Agents:     map[string][]common.Agent{},
+		Requests:   map[string]int{},
 	}
 }
 
@@ -26,6 +37,8 @@ func (m *APIMockServer) Init() {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/api/v1/self_hosted_agents/metrics") {
 			m.handleRequest(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/api/v1/self_hosted_agents/agents") {
+			m.handleAgentsRequest(w, r)
 		} else {
 			w.WriteHeader(404)
 		}
@@ -39,9 +52,62 @@ func (m *APIMockServer) RegisterAgentType(token string, metrics common.Metrics)
 	m.AgentTypes[token] = metrics
 }
 
+func (m *APIMockServer) RegisterAgents(token string, agents []common.Agent) {
+	m.Agents[token] = agents
+}
+
+func (m *APIMockServer) token(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	token = strings.TrimPrefix(token, "Token ")
+	token = strings.TrimPrefix(token, "Bearer ")
+	fmt.Printf("[Semaphore API mock] Received request for %s with token %s\n", r.URL.Path, token)
+	m.mu.Lock()
+	m.Requests[token]++
+	m.mu.Unlock()
+	return token
+}
+
+func (m *APIMockServer) handleAgentsRequest(w http.ResponseWriter, r *http.Request) {
+	token := m.token(r)
+	agents, exists := m.Agents[token]
+	if !exists {
+		fmt.Printf("[Semaphore API mock] Agents for token %s are not registered\n", token)
+		w.WriteHeader(500)
+		return
+	}
+
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if m.AgentsPageSize > 0 {
+		pageSize = m.AgentsPageSize
+	}
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+	end := len(agents)
+	if pageSize > 0 && start+pageSize < end {
+		end = start + pageSize
+	}
+
+	nextPageCursor := ""
+	if end < len(agents) {
+		nextPageCursor = strconv.Itoa(end)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"agents":           agents[start:end],
+		"next_page_cursor": nextPageCursor,
+	})
+
+	if err != nil {
+		fmt.Printf("[Semaphore API mock] Error marshaling response: %v\n", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	_, _ = w.Write(data)
+}
+
 func (m *APIMockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
-	token := strings.Replace(r.Header.Get("Authorization"), "Token ", "", 1)
-	fmt.Printf("[Semaphore API mock] Received request with token %s", token)
+	token := m.token(r)
 
 	metrics, exists := m.AgentTypes[token]
 	if !exists {
@@ -60,6 +126,12 @@ func (m *APIMockServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(data)
 }
 
+func (m *APIMockServer) RequestCount(token string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Requests[token]
+}
+
 func (m *APIMockServer) URL() string {
 	return m.Server.URL
 }